@@ -0,0 +1,49 @@
+package pythondeployer
+
+import (
+	"go.flow.arcalot.io/pythondeployer/internal/cgroup"
+	"go.flow.arcalot.io/pythondeployer/internal/cliwrapper"
+	"go.flow.arcalot.io/pythondeployer/internal/connector"
+)
+
+// PullError is returned by Connector.Deploy when a python module cannot be
+// pulled. It carries the classified cause of the failure, which can be
+// matched with errors.Is against the errors below, and the details needed to
+// act on it.
+type PullError = cliwrapper.PullError
+
+// PluginExitError is returned by the Read, Write and Close methods of a
+// plugin whose python process exited with a failure while it was in use. It
+// carries the exit code or signal of the process, and the end of its stderr.
+type PluginExitError = connector.PluginExitError
+
+var (
+	// ErrModuleSpecInvalid means the module name does not follow the
+	// <module-name>@git+<repo_url>[@<commit_sha>] format.
+	ErrModuleSpecInvalid = cliwrapper.ErrModuleSpecInvalid
+	// ErrRepositoryNotFound means the module's git repository does not exist.
+	ErrRepositoryNotFound = cliwrapper.ErrRepositoryNotFound
+	// ErrAuthenticationRequired means the git repository asked for credentials.
+	ErrAuthenticationRequired = cliwrapper.ErrAuthenticationRequired
+	// ErrRevisionNotFound means the requested commit does not exist.
+	ErrRevisionNotFound = cliwrapper.ErrRevisionNotFound
+	// ErrDependencyConflict means pip could not resolve the module's dependencies.
+	ErrDependencyConflict = cliwrapper.ErrDependencyConflict
+	// ErrBuildFailed means the module or one of its dependencies failed to build.
+	ErrBuildFailed = cliwrapper.ErrBuildFailed
+	// ErrNetworkUnavailable means the repository or package index could not be
+	// reached. Pulls failing with this error are worth retrying.
+	ErrNetworkUnavailable = cliwrapper.ErrNetworkUnavailable
+	// ErrInterpreterIncompatible means the module does not support the
+	// deployer's python version.
+	ErrInterpreterIncompatible = cliwrapper.ErrInterpreterIncompatible
+	// ErrLandlockUnavailable means Landlock is required, but the kernel does
+	// not support it, or it is disabled.
+	ErrLandlockUnavailable = cliwrapper.ErrLandlockUnavailable
+	// ErrPluginUserPermission means the engine lacks the privileges to run
+	// plugins as the configured plugin user.
+	ErrPluginUserPermission = cliwrapper.ErrPluginUserPermission
+	// ErrCgroupParentRequired means cgroups are enabled without a delegated
+	// parent cgroup to create them in.
+	ErrCgroupParentRequired = cgroup.ErrParentRequired
+)
@@ -14,21 +14,36 @@ import (
 	"go.arcalot.io/log/v2"
 	"go.flow.arcalot.io/deployer"
 	"go.flow.arcalot.io/pluginsdk/schema"
+	"go.flow.arcalot.io/pythondeployer/internal/cgroup"
 	"go.flow.arcalot.io/pythondeployer/internal/cliwrapper"
 	"go.flow.arcalot.io/pythondeployer/internal/config"
 	"go.flow.arcalot.io/pythondeployer/internal/connector"
+	"go.flow.arcalot.io/pythondeployer/internal/gitmirror"
 )
 
 // NewFactory creates a new factory for the Docker deployer.
 func NewFactory() deployer.ConnectorFactory[*config.Config] {
+	return NewFactoryWithProgress(nil)
+}
+
+// NewFactoryWithProgress creates a new factory for the python deployer,
+// whose connectors report the progress of pulling python modules to the
+// given reporter.
+func NewFactoryWithProgress(progress ProgressReporter) deployer.ConnectorFactory[*config.Config] {
 	connectorCounter := int64(0)
 	return &factory{
 		connectorCounter: &connectorCounter,
+		pulls:            connector.NewPullCoordinator(),
+		progress:         progress,
 	}
 }
 
 type factory struct {
 	connectorCounter *int64
+	// pulls is shared by all the connectors of this factory, so that a
+	// python module is only pulled once per process
+	pulls    *connector.PullCoordinator
+	progress ProgressReporter
 }
 
 func (f factory) Name() string {
@@ -48,6 +63,10 @@ func (f factory) NextConnectorIndex() int64 {
 }
 
 func (f factory) Create(config *config.Config, logger log.Logger) (deployer.Connector, error) {
+	if config.Cgroup.Enabled && config.Cgroup.Parent == "" {
+		return nil, fmt.Errorf("%w, cgroup.parent must name a cgroup delegated to the engine "+
+			"that holds no process", ErrCgroupParentRequired)
+	}
 	pythonPath, err := binaryCheck(config.PythonPath)
 	if err != nil {
 		return &connector.Connector{}, fmt.Errorf("python binary check failed with error: %w", err)
@@ -62,11 +81,16 @@ func (f factory) Create(config *config.Config, logger log.Logger) (deployer.Conn
 		pythonSemver = outputSemver
 	}
 
+	semverDashed := strings.Replace(pythonSemver, ".", "-", -1)
 	connectorFilename := strings.Join([]string{
 		"connector",
-		strings.Replace(pythonSemver, ".", "-", -1),
+		semverDashed,
 		strconv.FormatInt(f.NextConnectorIndex(), 10)},
 		"_")
+	// python modules are shared by all connectors using the same python
+	// version, and by the later runs of the engine, so that they only need
+	// to be pulled once
+	modulesDirname := strings.Join([]string{"modules", semverDashed}, "_")
 
 	absWorkDir, err := filepath.Abs(config.WorkDir)
 	if err != nil {
@@ -81,10 +105,35 @@ func (f factory) Create(config *config.Config, logger log.Logger) (deployer.Conn
 			"error creating temporary directory for python connector (%w)", err)
 	}
 
-	pythonCli := cliwrapper.NewCliWrapper(pythonPath, connectorFilepath, logger)
+	modulesFilepath := filepath.Join(absWorkDir, modulesDirname)
+	err = os.MkdirAll(modulesFilepath, 0750)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error creating python module directory (%w)", err)
+	}
+
+	var caches cliwrapper.Caches
+	if config.GitMirror {
+		caches.GitMirrors = gitmirror.New(filepath.Join(absWorkDir, "git-mirrors"), logger)
+	}
+	if config.WheelCache {
+		caches.WheelDir = filepath.Join(absWorkDir, "wheels")
+		caches.PipCacheDir = filepath.Join(absWorkDir, "pip-cache")
+	}
+
+	pythonCli := cliwrapper.NewCliWrapper(
+		pythonPath, modulesFilepath, caches, config, logger, f.progress)
+
+	var cgroups *cgroup.Parent
+	if config.Cgroup.Enabled {
+		cgroups, err = cgroup.NewParent(config.Cgroup.Parent)
+		if err != nil {
+			logger.Warningf("running plugins without cgroups of their own (%s)", err)
+		}
+	}
 
 	cn := connector.NewConnector(
-		config, logger, connectorFilepath, pythonCli)
+		config, logger, connectorFilepath, pythonCli, f.pulls, cgroups)
 	return &cn, nil
 }
 
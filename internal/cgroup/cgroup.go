@@ -0,0 +1,221 @@
+package cgroup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrUnavailable means cgroup v2 is not mounted, or the parent cgroup was
+// not delegated to the engine, so plugins cannot get cgroups of their own.
+var ErrUnavailable = errors.New("cgroup v2 delegation unavailable")
+
+// ErrParentRequired means no parent cgroup was given. The cgroup of the
+// engine cannot be the parent, since a cgroup holding processes cannot
+// enable controllers for its children.
+var ErrParentRequired = errors.New("delegated parent cgroup required")
+
+// controllers are the controllers enabled for the plugin cgroups.
+var controllers = []string{"memory", "cpu", "pids"}
+
+// cpuPeriod is the cpu.max period, in microseconds.
+const cpuPeriod = 100000
+
+// Limits are the limits of a plugin cgroup. The limits left unset do not
+// restrict the plugin.
+type Limits struct {
+	// MemoryMax is memory.max, the memory usage of the cgroup in bytes above
+	// which its processes are OOM killed.
+	MemoryMax *int64
+	// CPUMax is cpu.max, the number of CPUs the cgroup can use at most.
+	CPUMax *float64
+	// PidsMax is pids.max, the maximum number of processes in the cgroup.
+	PidsMax *int64
+}
+
+// Stats is the resource usage of a cgroup.
+type Stats struct {
+	// MemoryPeak is the peak memory usage of the cgroup in bytes, or 0 if
+	// the kernel does not report it.
+	MemoryPeak int64
+	// CPUUsage is the CPU time used by the cgroup.
+	CPUUsage time.Duration
+	// OOMKills is the number of processes of the cgroup killed by the OOM
+	// killer.
+	OOMKills int64
+}
+
+// Parent is a delegated cgroup v2 holding the cgroups of plugins.
+type Parent struct {
+	path string
+}
+
+// NewParent prepares the cgroup at path to hold the cgroups of plugins, by
+// enabling the memory, cpu and pids controllers for its children. The path
+// is relative to the cgroup v2 mount point. The cgroup must have been
+// delegated to the engine, and must not contain any process itself.
+func NewParent(path string) (*Parent, error) {
+	if path == "" {
+		return nil, ErrParentRequired
+	}
+	mountPoint, err := findMountPoint()
+	if err != nil {
+		return nil, err
+	}
+	parentPath := filepath.Join(mountPoint, filepath.Clean("/"+path))
+
+	available, err := os.ReadFile(filepath.Join(parentPath, "cgroup.controllers"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot read the controllers of %s (%s)", ErrUnavailable, parentPath, err)
+	}
+	for _, controller := range controllers {
+		if !strings.Contains(" "+strings.TrimSpace(string(available))+" ", " "+controller+" ") {
+			return nil, fmt.Errorf("%w: controller %s is not available in %s", ErrUnavailable, controller, parentPath)
+		}
+		err := writeFile(parentPath, "cgroup.subtree_control", "+"+controller)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"%w: cannot enable controller %s for the children of %s, it must be delegated and "+
+					"must not contain processes (%s)", ErrUnavailable, controller, parentPath, err)
+		}
+	}
+	return &Parent{path: parentPath}, nil
+}
+
+// Create creates the cgroup of a plugin, with the given limits.
+func (p *Parent) Create(name string, limits Limits) (*Cgroup, error) {
+	cgroup := &Cgroup{path: filepath.Join(p.path, name)}
+	if err := os.Mkdir(cgroup.path, 0750); err != nil {
+		return nil, fmt.Errorf("error creating cgroup %s (%w)", cgroup.path, err)
+	}
+	settings := map[string]string{
+		// OOM kill the whole plugin, instead of one of its processes
+		"memory.oom.group": "1",
+	}
+	if limits.MemoryMax != nil {
+		settings["memory.max"] = strconv.FormatInt(*limits.MemoryMax, 10)
+	}
+	if limits.CPUMax != nil {
+		settings["cpu.max"] = fmt.Sprintf("%d %d", int64(*limits.CPUMax*cpuPeriod), cpuPeriod)
+	}
+	if limits.PidsMax != nil {
+		settings["pids.max"] = strconv.FormatInt(*limits.PidsMax, 10)
+	}
+	for file, value := range settings {
+		if err := writeFile(cgroup.path, file, value); err != nil {
+			_ = cgroup.Remove()
+			return nil, fmt.Errorf("error setting %s of cgroup %s to %s (%w)", file, cgroup.path, value, err)
+		}
+	}
+	return cgroup, nil
+}
+
+// Cgroup is the cgroup of a single plugin.
+type Cgroup struct {
+	path string
+}
+
+// Path returns the path of the cgroup directory.
+func (c *Cgroup) Path() string {
+	return c.path
+}
+
+// Open opens the cgroup directory, whose file descriptor can be used to
+// start a process directly in the cgroup, see syscall.SysProcAttr.CgroupFD.
+func (c *Cgroup) Open() (*os.File, error) {
+	return os.Open(c.path)
+}
+
+// Stats reads the resource usage of the cgroup.
+func (c *Cgroup) Stats() (Stats, error) {
+	var stats Stats
+	peak, err := os.ReadFile(filepath.Join(c.path, "memory.peak"))
+	if err == nil {
+		stats.MemoryPeak, _ = strconv.ParseInt(strings.TrimSpace(string(peak)), 10, 64)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return stats, err
+	}
+	cpuStat, err := readKeyedFile(filepath.Join(c.path, "cpu.stat"))
+	if err != nil {
+		return stats, err
+	}
+	stats.CPUUsage = time.Duration(cpuStat["usage_usec"]) * time.Microsecond
+	memoryEvents, err := readKeyedFile(filepath.Join(c.path, "memory.events"))
+	if err != nil {
+		return stats, err
+	}
+	stats.OOMKills = memoryEvents["oom_kill"]
+	return stats, nil
+}
+
+// Kill kills every process left in the cgroup.
+func (c *Cgroup) Kill() error {
+	return writeFile(c.path, "cgroup.kill", "1")
+}
+
+// Remove removes the cgroup, waiting a moment for its killed processes to
+// be gone.
+func (c *Cgroup) Remove() error {
+	var err error
+	for i := 0; i < 20; i++ {
+		err = syscall.Rmdir(c.path)
+		if !errors.Is(err, syscall.EBUSY) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil && !errors.Is(err, syscall.ENOENT) {
+		return fmt.Errorf("error removing cgroup %s (%w)", c.path, err)
+	}
+	return nil
+}
+
+// findMountPoint returns the mount point of the cgroup v2 hierarchy.
+func findMountPoint() (string, error) {
+	mountInfo, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", fmt.Errorf("%w: cannot read mount points (%s)", ErrUnavailable, err)
+	}
+	defer func() {
+		_ = mountInfo.Close()
+	}()
+	scanner := bufio.NewScanner(mountInfo)
+	for scanner.Scan() {
+		// the filesystem type follows the "-" separator
+		fields := strings.Fields(scanner.Text())
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) && fields[i+1] == "cgroup2" {
+				return fields[4], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w: cgroup v2 is not mounted", ErrUnavailable)
+}
+
+// readKeyedFile reads a cgroup file made of "key value" lines.
+func readKeyedFile(path string) (map[string]int64, error) {
+	content, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]int64{}
+	for _, line := range strings.Split(string(content), "\n") {
+		key, value, found := strings.Cut(line, " ")
+		if !found {
+			continue
+		}
+		values[key], _ = strconv.ParseInt(value, 10, 64)
+	}
+	return values, nil
+}
+
+// writeFile writes a value to a cgroup interface file.
+func writeFile(dir string, file string, value string) error {
+	return os.WriteFile(filepath.Join(dir, file), []byte(value), 0600)
+}
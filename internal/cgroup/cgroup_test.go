@@ -0,0 +1,92 @@
+package cgroup_test
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"go.arcalot.io/assert"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"go.flow.arcalot.io/pythondeployer/internal/cgroup"
+)
+
+func TestNewParent_Unavailable(t *testing.T) {
+	_, err := cgroup.NewParent("/arcaflow-nonexistent-cgroup")
+	assert.Equals(t, errors.Is(err, cgroup.ErrUnavailable), true)
+}
+
+func TestNewParent_Required(t *testing.T) {
+	_, err := cgroup.NewParent("")
+	assert.Equals(t, errors.Is(err, cgroup.ErrParentRequired), true)
+}
+
+// CreateTestParent creates a child of the cgroup of the test process to hold
+// the cgroups of the test, so that the cgroup of the test process, which
+// holds processes, is left alone. The test is skipped when the controllers
+// are not available to the child.
+func CreateTestParent(t *testing.T) *cgroup.Parent {
+	const mountPoint = "/sys/fs/cgroup"
+	cgroups, err := os.ReadFile("/proc/self/cgroup")
+	assert.NoError(t, err)
+	ownCgroup, found := "", false
+	for _, line := range strings.Split(string(cgroups), "\n") {
+		if ownCgroup, found = strings.CutPrefix(line, "0::"); found {
+			break
+		}
+	}
+	if _, err := os.Stat(filepath.Join(mountPoint, "cgroup.controllers")); !found || err != nil {
+		t.Skipf("cgroup v2 is not mounted on %s", mountPoint)
+	}
+	parentPath, err := os.MkdirTemp(filepath.Join(mountPoint, ownCgroup), "arcaflow-test-")
+	if err != nil {
+		t.Skipf("cannot create a child of cgroup %s (%s)", ownCgroup, err)
+	}
+	t.Cleanup(func() {
+		assert.NoError(t, syscall.Rmdir(parentPath))
+	})
+	parent, err := cgroup.NewParent(strings.TrimPrefix(parentPath, mountPoint))
+	if errors.Is(err, cgroup.ErrUnavailable) {
+		t.Skipf("cgroup v2 delegation is unavailable on this host (%s)", err)
+	}
+	assert.NoError(t, err)
+	return parent
+}
+
+func TestCgroup_LimitsAndStats(t *testing.T) {
+	parent := CreateTestParent(t)
+
+	pluginCgroup, err := parent.Create("plugin-test", cgroup.Limits{
+		MemoryMax: schema.PointerTo(int64(64 << 20)),
+		CPUMax:    schema.PointerTo(0.5),
+		PidsMax:   schema.PointerTo(int64(16)),
+	})
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, pluginCgroup.Remove())
+	}()
+	memoryMax, err := os.ReadFile(filepath.Join(pluginCgroup.Path(), "memory.max"))
+	assert.NoError(t, err)
+	assert.Equals(t, strings.TrimSpace(string(memoryMax)), "67108864")
+	cpuMax, err := os.ReadFile(filepath.Join(pluginCgroup.Path(), "cpu.max"))
+	assert.NoError(t, err)
+	assert.Equals(t, strings.TrimSpace(string(cpuMax)), "50000 100000")
+
+	cgroupDir, err := pluginCgroup.Open()
+	assert.NoError(t, err)
+	defer func() {
+		_ = cgroupDir.Close()
+	}()
+	cmd := exec.Command("sh", "-c", "i=0; while [ $i -lt 100000 ]; do i=$((i+1)); done")
+	cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: int(cgroupDir.Fd())}
+	assert.NoError(t, cmd.Run())
+
+	stats, err := pluginCgroup.Stats()
+	assert.NoError(t, err)
+	assert.Equals(t, stats.CPUUsage > 0, true)
+	assert.Equals(t, stats.OOMKills, int64(0))
+	assert.NoError(t, pluginCgroup.Kill())
+}
@@ -0,0 +1,132 @@
+package cliwrapper
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.flow.arcalot.io/pythondeployer/internal/config"
+)
+
+// auditHookScript is the audit hook of plugins, which every python
+// interpreter of a plugin loads as its sitecustomize module.
+//
+//go:embed audit_hook.py
+var auditHookScript []byte
+
+// auditHookDir is the directory of the venv of a module holding the audit
+// hook, which the venv, and so the sandbox, Landlock and the plugin user,
+// already give plugins access to.
+const auditHookDir = "arcaflow-audit"
+
+// auditReportFD is the file descriptor of the plugin process the audit hook
+// reports the audited events to, the first one after stderr.
+const auditReportFD = 3
+
+// AuditEvent is an event reported by the audit hook of a plugin, one JSON
+// line per event.
+type AuditEvent struct {
+	// PID is the process of the plugin that raised the event.
+	PID int `json:"pid"`
+	// Category is the category of the event in the audit policy.
+	Category config.AuditCategory `json:"category"`
+	// Event is the name of the python audit event.
+	Event string `json:"event"`
+	// Action is what the audit hook did with the event.
+	Action config.AuditAction `json:"action"`
+	// Detail describes the event, such as the command line of a subprocess,
+	// the address of a connection or the path of a file.
+	Detail string `json:"detail"`
+}
+
+// auditSettings are the launcherSettings installing the audit hook in the
+// plugin process.
+type auditSettings struct {
+	// Path is the directory of the audit hook, which is added to the
+	// PYTHONPATH of the plugin.
+	Path string `json:"path"`
+	// ReportFD is the file descriptor the events are reported to.
+	ReportFD int         `json:"reportFd"`
+	Policy   auditPolicy `json:"policy"`
+}
+
+// auditPolicy is the policy of the audit hook, which the launcher passes on
+// to the python subprocesses of the plugin through the environment.
+type auditPolicy struct {
+	// Events maps the audited categories to their action.
+	Events map[config.AuditCategory]config.AuditAction `json:"events"`
+	// PluginDir is where the plugin opens files without being audited.
+	PluginDir string `json:"pluginDir"`
+	// ReadOnly are where the plugin reads files without being audited, in
+	// addition to its interpreter and venv.
+	ReadOnly []string `json:"readOnly"`
+}
+
+// newAuditSettings installs the audit hook in the venv of a module, and
+// returns the settings of the audit hook of one of its plugins. When the
+// configuration lists no category, every category is logged.
+func newAuditSettings(
+	cfg config.AuditHook,
+	venvPath string,
+	pluginDirAbsPath string,
+	secretsDir string,
+) (*auditSettings, error) {
+	absVenvPath, err := filepath.Abs(venvPath)
+	if err != nil {
+		return nil, err
+	}
+	hookDir := filepath.Join(absVenvPath, auditHookDir)
+	if err := installAuditHook(hookDir); err != nil {
+		return nil, fmt.Errorf("error installing the audit hook in %s (%w)", hookDir, err)
+	}
+	events := cfg.Events.Actions()
+	if len(events) == 0 {
+		events = map[config.AuditCategory]config.AuditAction{}
+		for _, category := range config.AuditCategories {
+			events[category] = config.AuditActionLog
+		}
+	}
+	policy := auditPolicy{
+		Events:    events,
+		PluginDir: pluginDirAbsPath,
+		ReadOnly:  []string{absVenvPath},
+	}
+	if secretsDir != "" {
+		policy.ReadOnly = append(policy.ReadOnly, secretsDir)
+	}
+	return &auditSettings{Path: hookDir, ReportFD: auditReportFD, Policy: policy}, nil
+}
+
+// installAuditHook writes the audit hook to hookDir as sitecustomize.py,
+// unless it is already there. It is replaced atomically, since plugins of
+// the same module may be starting with it.
+func installAuditHook(hookDir string) error {
+	hookPath := filepath.Join(hookDir, "sitecustomize.py")
+	if installed, err := os.ReadFile(hookPath); err == nil && bytes.Equal(installed, auditHookScript) {
+		return nil
+	}
+	if err := os.MkdirAll(hookDir, 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(hookDir, ".sitecustomize-*.py")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(file.Name())
+	}()
+	if _, err := file.Write(auditHookScript); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Chmod(0644); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), hookPath)
+}
@@ -0,0 +1,137 @@
+# Audit hook of the python deployer (PEP 578). The deployer puts it in the
+# venv of plugins as sitecustomize.py, and puts its directory on PYTHONPATH,
+# so that every python interpreter of the plugin installs it at startup, and
+# the launcher installs it in the plugin process once its settings are
+# applied. The audit policy is passed as JSON in ARCAFLOW_AUDIT_POLICY, and
+# the events are reported to the deployer as JSON lines on the report file
+# descriptor, by the processes that inherited it from the plugin process.
+import json
+import os
+import sys
+
+POLICY_VARIABLE = "ARCAFLOW_AUDIT_POLICY"
+
+# the audit events of each category of the policy
+CATEGORIES = {
+    "subprocess.Popen": ("subprocess.Popen", "os.exec", "os.posix_spawn", "os.spawn"),
+    "os.system": ("os.system",),
+    "socket.connect": ("socket.connect",),
+    "open": ("open",),
+}
+
+# the open flags of anything but reading
+WRITE_FLAGS = os.O_WRONLY | os.O_RDWR | os.O_CREAT | os.O_TRUNC | os.O_APPEND
+
+# details are truncated, so that every report is written in one piece
+MAX_DETAIL_LENGTH = 1024
+
+
+def install(policy):
+    actions = {}
+    for category, action in policy["events"].items():
+        for event in CATEGORIES[category]:
+            actions[event] = (category, action)
+    # opened paths are resolved, so the directories are resolved too
+    plugin_dir = os.path.realpath(policy["pluginDir"])
+    # the interpreter and the venv, and whatever the deployer adds to them
+    read_only = {sys.prefix, sys.exec_prefix, sys.base_prefix, sys.base_exec_prefix}
+    read_only.update(policy.get("readOnly", []))
+    read_only = {os.path.realpath(directory) for directory in read_only}
+    report_fd = report_descriptor(policy.get("report"))
+
+    def inside(path, directory):
+        return path == directory or path.startswith(directory.rstrip(os.sep) + os.sep)
+
+    def audited_open(path, flags):
+        if isinstance(path, int):
+            # file descriptors were opened before
+            return None
+        # symbolic links in the plugin directory may point anywhere
+        path = os.path.realpath(os.fsdecode(path))
+        if inside(path, plugin_dir) or path == os.devnull:
+            return None
+        if isinstance(flags, int) and flags & WRITE_FLAGS == 0:
+            if any(inside(path, directory) for directory in read_only):
+                return None
+        return path
+
+    def describe(event, args):
+        if event == "subprocess.Popen":
+            executable, command = args[0], args[1]
+            if isinstance(command, (list, tuple)):
+                return " ".join(os.fsdecode(arg) if isinstance(arg, bytes) else str(arg) for arg in command)
+            return str(command if command is not None else executable)
+        if event in ("os.exec", "os.posix_spawn"):
+            return " ".join(str(arg) for arg in args[1])
+        if event == "os.spawn":
+            return " ".join(str(arg) for arg in args[2])
+        if event == "os.system":
+            return os.fsdecode(args[0])
+        if event == "socket.connect":
+            address = args[1]
+            if isinstance(address, tuple) and len(address) >= 2:
+                return "%s:%s" % address[:2]
+            return str(address)
+        return str(args[0])
+
+    def hook(event, args):
+        if event not in actions:
+            return
+        category, action = actions[event]
+        if event == "open":
+            path = audited_open(args[0], args[2])
+            if path is None:
+                return
+            detail = path
+        else:
+            detail = describe(event, args)
+        detail = detail[:MAX_DETAIL_LENGTH]
+        if report_fd is not None:
+            report = json.dumps({
+                "pid": os.getpid(),
+                "category": category,
+                "event": event,
+                "action": action,
+                "detail": detail,
+            })
+            try:
+                os.write(report_fd, (report + "\n").encode())
+            except OSError:
+                pass
+        if action == "block":
+            raise PermissionError("%s blocked by the audit policy of the plugin (%s)" % (event, detail))
+
+    sys.addaudithook(hook)
+
+
+def report_descriptor(report):
+    # the report descriptor is only used by the processes that inherited it
+    # from the plugin process, in any other it may be an unrelated file
+    if report is None:
+        return None
+    try:
+        stat = os.fstat(report["fd"])
+    except OSError:
+        return None
+    if (stat.st_dev, stat.st_ino) != (report["device"], report["inode"]):
+        return None
+    return report["fd"]
+
+
+def chain_sitecustomize():
+    # this module shadows the sitecustomize of the interpreter, if any
+    import importlib.machinery
+    import importlib.util
+    here = os.path.dirname(os.path.abspath(__file__))
+    path = [entry for entry in sys.path if os.path.abspath(entry or ".") != here]
+    spec = importlib.machinery.PathFinder.find_spec("sitecustomize", path)
+    if spec is not None:
+        module = importlib.util.module_from_spec(spec)
+        sys.modules["sitecustomize"] = module
+        spec.loader.exec_module(module)
+
+
+if POLICY_VARIABLE in os.environ:
+    install(json.loads(os.environ[POLICY_VARIABLE]))
+if __name__ == "sitecustomize":
+    chain_sitecustomize()
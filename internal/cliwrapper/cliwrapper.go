@@ -1,56 +1,92 @@
 package cliwrapper
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"go.arcalot.io/exex"
 
 	"go.arcalot.io/log/v2"
+	"go.flow.arcalot.io/pythondeployer/internal/cgroup"
+	"go.flow.arcalot.io/pythondeployer/internal/config"
+	"go.flow.arcalot.io/pythondeployer/internal/gitmirror"
 	"go.flow.arcalot.io/pythondeployer/internal/models"
+	"go.flow.arcalot.io/pythondeployer/internal/util"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"syscall"
 )
 
 type cliWrapper struct {
 	pythonFullPath string
 	connectorDir   string
+	caches         Caches
+	config         *config.Config
 	logger         log.Logger
+	progress       ProgressReporter
 }
 
 const RunnableClassifier string = "Arcaflow :: Python Deployer :: Runnable"
 
+// Caches are shared by the python modules of all connectors, to speed up
+// repeated pulls. Each cache is disabled when left empty.
+type Caches struct {
+	// GitMirrors keeps the git repositories of modules.
+	GitMirrors *gitmirror.Mirrors
+	// WheelDir keeps the wheels built for pinned commits of modules.
+	WheelDir string
+	// PipCacheDir is pip's cache directory.
+	PipCacheDir string
+}
+
 func NewCliWrapper(
 	pythonFullPath string,
 	connectorDir string,
+	caches Caches,
+	config *config.Config,
 	logger log.Logger,
+	progress ProgressReporter,
 ) CliWrapper {
+	if progress == nil {
+		progress = noopProgressReporter{}
+	}
 	return &cliWrapper{
 		pythonFullPath: pythonFullPath,
 		logger:         logger,
 		connectorDir:   connectorDir,
+		caches:         caches,
+		config:         config,
+		progress:       progress,
 	}
 }
 
-func parseModuleNameGit(fullModuleName string, module *models.PythonModule) {
-	nameSourceVersion := strings.Split(fullModuleName, "@")
-	source := strings.Replace(nameSourceVersion[1], "git+", "", 1)
-	(*module).ModuleName = &nameSourceVersion[0]
-	(*module).Repo = &source
-	if len(nameSourceVersion) == 3 {
-		(*module).ModuleVersion = &nameSourceVersion[2]
+// gitModuleRegex matches <module-name>@git+<repo_url>[@<commit_sha>], where
+// the repository URL is either http(s) or ssh, with an optional user.
+var gitModuleRegex = regexp.MustCompile(
+	`^([a-zA-Z0-9]+(?:[-_.][a-zA-Z0-9]+)*)` +
+		`@git\+((?:https?://|ssh://(?:[a-zA-Z0-9._-]+@)?)[a-zA-Z0-9]+(?:[-._/:][a-zA-Z0-9]*)*)` +
+		`(?:@([a-zA-Z0-9]+))?$`)
+
+func parseModuleNameGit(nameSourceVersion []string, module *models.PythonModule) {
+	(*module).ModuleName = &nameSourceVersion[1]
+	(*module).Repo = &nameSourceVersion[2]
+	if nameSourceVersion[3] != "" {
+		(*module).ModuleVersion = &nameSourceVersion[3]
 	}
 }
 
 func parseModuleName(fullModuleName string) (*models.PythonModule, error) {
 	pythonModule := models.NewPythonModule(fullModuleName)
-	gitRegex := `^[a-zA-Z0-9]+([-_.][a-zA-Z0-9]+)*@git\+https?://[a-zA-Z0-9]+([-._/][a-zA-Z0-9]*)*(@[a-zA-Z0-9]+)?$`
-	matchGit, _ := regexp.MatchString(gitRegex, fullModuleName)
-	if !matchGit {
-		return nil, fmt.Errorf("%q has wrong module name format, please use <module-name>@git+<repo_url>[@<commit_sha>]", fullModuleName)
+	matchGit := gitModuleRegex.FindStringSubmatch(fullModuleName)
+	if matchGit == nil {
+		return nil, newModuleSpecError(fullModuleName)
 	}
-	parseModuleNameGit(fullModuleName, &pythonModule)
+	parseModuleNameGit(matchGit, &pythonModule)
 	return &pythonModule, nil
 }
 
@@ -75,7 +111,8 @@ func (p *cliWrapper) ModuleExists(fullModuleName string) (*bool, error) {
 		return nil, err
 	}
 
-	if _, err := os.Stat(*modulePath); os.IsNotExist(err) {
+	// the venv of a module is only linked to once its pull succeeded
+	if _, err := os.Stat(filepath.Join(*modulePath, venvLinkName)); os.IsNotExist(err) {
 		// false
 		return &moduleExists, nil
 	}
@@ -84,89 +121,521 @@ func (p *cliWrapper) ModuleExists(fullModuleName string) (*bool, error) {
 	return &moduleExists, nil
 }
 
+// PullModule pulls a python module into a new pull directory of its module
+// path, and makes its venv the venv of the module once the pull succeeded,
+// leaving the venvs of running plugins alone.
 func (p *cliWrapper) PullModule(fullModuleName string) error {
-	// every plugin python module gets its own python virtual environment
-	err := p.Venv(fullModuleName)
+	modulePath, err := p.GetModulePath(fullModuleName)
 	if err != nil {
 		return err
 	}
+	pullDir, lock, err := newPullDir(*modulePath)
+	if err != nil {
+		return fmt.Errorf("error creating a pull directory for python module %s (%w)", fullModuleName, err)
+	}
+	defer func() {
+		_ = lock.Close()
+	}()
+	err = p.pullModule(fullModuleName, pullDir)
+	if err == nil {
+		err = p.preparePluginVenv(pullDir)
+	}
+	if err != nil {
+		if removeErr := os.RemoveAll(pullDir); removeErr != nil {
+			p.logger.Warningf("error removing pull directory %s (%s)", pullDir, removeErr)
+		}
+		return err
+	}
+	if err := publishVenv(*modulePath, pullDir); err != nil {
+		return fmt.Errorf("error publishing the venv of python module %s (%w)", fullModuleName, err)
+	}
+	return nil
+}
 
-	pipInstallArgs := []string{"install"}
+// preparePluginVenv installs the audit hook in the venv of a pull, once per
+// pull rather than on every deployment.
+func (p *cliWrapper) preparePluginVenv(pullDir string) error {
+	if !p.config.AuditHook.Enabled {
+		return nil
+	}
+	hookDir := filepath.Join(pullDir, venvLinkName, auditHookDir)
+	if err := installAuditHook(hookDir); err != nil {
+		return fmt.Errorf("error installing the audit hook in %s (%w)", hookDir, err)
+	}
+	return nil
+}
+
+// pullModule creates the venv of a python module in pullDir, and installs
+// the module in it. The scratch directories of the pull are in pullDir too.
+func (p *cliWrapper) pullModule(fullModuleName string, pullDir string) error {
+	// every plugin python module gets its own python virtual environment
+	err := p.venv(fullModuleName, filepath.Join(pullDir, venvLinkName))
+	if err != nil {
+		return err
+	}
 
 	pythonModule, err := parseModuleName(fullModuleName)
 	if err != nil {
 		return err
 	}
+	// the wheels are keyed by the original repository of the module
+	wheelRepoDir, err := p.wheelRepoDir(pythonModule)
+	if err != nil {
+		return err
+	}
+	p.rewriteSource(pythonModule)
 	module, err := pythonModule.PipPackageName()
 	if err != nil {
 		return err
 	}
-	pipInstallArgs = append(pipInstallArgs, *module)
 
-	modulePath, err := p.GetModulePath(fullModuleName)
+	env := PullEnvironment(p.config, os.Environ())
+	if p.caches.PipCacheDir != "" {
+		env = util.MergeEnviron(env, map[string]string{"PIP_CACHE_DIR": p.caches.PipCacheDir})
+	}
+	wheelDir := ""
+	if wheelRepoDir != "" {
+		var found bool
+		wheelDir, found = cachedWheelDir(wheelRepoDir, *pythonModule.ModuleVersion)
+		if found {
+			p.logger.Infof("installing %s from the wheels built earlier in %s", fullModuleName, wheelDir)
+			return p.pipInstallWheels(pythonModule, pullDir, wheelDir, env)
+		}
+	}
+
+	mirrors := p.caches.GitMirrors
+	if mirrors == nil && wheelRepoDir != "" && wheelDir == "" {
+		// only a checkout tells which commit a short SHA stands for
+		mirrorsDir := filepath.Join(pullDir, "git-mirror")
+		mirrors = gitmirror.New(mirrorsDir, p.logger)
+		defer func() {
+			if err := os.RemoveAll(mirrorsDir); err != nil {
+				p.logger.Warningf("error removing git mirror %s (%s)", mirrorsDir, err)
+			}
+		}()
+	}
+	if mirrors != nil {
+		source, commit, err := p.checkoutMirror(mirrors, pythonModule, pullDir, env)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := os.RemoveAll(source); err != nil {
+				p.logger.Warningf("error removing git checkout %s (%s)", source, err)
+			}
+		}()
+		// install from the local checkout instead of the repository
+		module = &source
+		if wheelRepoDir != "" {
+			wheelDir = filepath.Join(wheelRepoDir, commit)
+			if _, err := os.Stat(wheelDir); err == nil {
+				p.logger.Infof("installing %s from the wheels built earlier in %s", fullModuleName, wheelDir)
+				return p.pipInstallWheels(pythonModule, pullDir, wheelDir, env)
+			}
+		}
+	}
+
+	if wheelDir != "" {
+		if err := p.pipBuildWheels(pythonModule, pullDir, *module, wheelDir, env); err != nil {
+			return err
+		}
+		return p.pipInstallWheels(pythonModule, pullDir, wheelDir, env)
+	}
+	return p.pip(pythonModule, pullDir, env, "install", *module)
+}
+
+// pip runs a pip command in the virtual environment of the pull in pullDir,
+// reporting the progress of the command, and classifying its failure.
+func (p *cliWrapper) pip(pythonModule *models.PythonModule, pullDir string, env []string, args ...string) error {
+	fullModuleName := pythonModule.FullModuleName()
+	pipPath := filepath.Join(pullDir, "venv/bin/pip")
+	cmdPip := exex.Command(pipPath, args...)
+	cmdPip.Env = env
+
+	err := p.runStreaming(cmdPip, fullModuleName, "pip "+args[0], func(line string) {
+		if stage, subject, found := ParsePipProgress(line); found {
+			p.progress.ReportProgress(ProgressEvent{
+				Module:  fullModuleName,
+				Stage:   stage,
+				Subject: subject,
+			})
+		}
+	})
 	if err != nil {
+		err = ClassifyPullError(fullModuleName, exex.CommandError(
+			err,
+			fmt.Sprintf("error in pip installing %s", fullModuleName)))
+		var pullErr *PullError
+		if errors.As(err, &pullErr) {
+			// report the repository that was actually pulled from
+			pullErr.Repository = *pythonModule.Repo
+		}
 		return err
 	}
+	return nil
+}
 
-	pipPath := filepath.Join(*modulePath, "venv/bin/pip")
-	cmdPip := exex.Command(pipPath, pipInstallArgs...)
+// pinnedRevisionRegex matches revisions that are commit SHAs, which always
+// refer to the same content, unlike branch or tag names.
+var pinnedRevisionRegex = regexp.MustCompile(`^[0-9a-fA-F]{7,40}$`)
 
-	// Make git non-interactive, so that it never prompts for credentials.
-	// Otherwise, you can hit edge cases where git will wait for manual
-	// authentication causing pip to hang because pip calls `git clone` in
-	// a subprocess.
-	cmdPip.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+// fullCommitRegex matches full commit SHAs, which key the wheels of a module.
+var fullCommitRegex = regexp.MustCompile(`^[0-9a-f]{40}$`)
 
-	output, err := cmdPip.Output()
-	if len(output) > 0 {
-		p.logger.Debugf("pip install stdout: %s", output)
+// wheelABIScript prints the ABI tag of the interpreter, which the wheels
+// built by the interpreter depend on.
+const wheelABIScript = `import sys, sysconfig; print(sysconfig.get_config_var("SOABI") or sys.implementation.cache_tag)`
+
+// wheelRepoDir returns the directory keeping the wheels of the commits of a
+// python module and its dependencies, keyed by the ABI of the interpreter
+// and the module's original repository, or an empty string if the wheel
+// cache is disabled or the module is not pinned to a commit.
+func (p *cliWrapper) wheelRepoDir(pythonModule *models.PythonModule) (string, error) {
+	if p.caches.WheelDir == "" || pythonModule.ModuleVersion == nil ||
+		!pinnedRevisionRegex.MatchString(*pythonModule.ModuleVersion) {
+		return "", nil
 	}
+	output, err := exex.Command(p.pythonFullPath, "-c", wheelABIScript).Output()
 	if err != nil {
-		return exex.CommandError(
-			err,
-			fmt.Sprintf("error in pip installing %s", fullModuleName))
+		return "", exex.CommandError(err, "error getting the ABI of the python interpreter")
+	}
+	repoHash := sha256.Sum256([]byte(*pythonModule.Repo))
+	return filepath.Join(
+		p.caches.WheelDir,
+		strings.TrimSpace(string(output)),
+		hex.EncodeToString(repoHash[:12])), nil
+}
+
+// cachedWheelDir returns the directory of wheelRepoDir keeping the wheels of
+// a commit, and whether the wheels are there. The directories are named
+// after full commit SHAs, so a short SHA only has a directory when it is the
+// prefix of exactly one of the commits built earlier, and the commit it
+// stands for is unknown otherwise.
+func cachedWheelDir(wheelRepoDir string, revision string) (string, bool) {
+	revision = strings.ToLower(revision)
+	if fullCommitRegex.MatchString(revision) {
+		wheelDir := filepath.Join(wheelRepoDir, revision)
+		_, err := os.Stat(wheelDir)
+		return wheelDir, err == nil
+	}
+	entries, err := os.ReadDir(wheelRepoDir)
+	if err != nil {
+		return "", false
+	}
+	var matches []string
+	for _, entry := range entries {
+		if fullCommitRegex.MatchString(entry.Name()) && strings.HasPrefix(entry.Name(), revision) {
+			matches = append(matches, entry.Name())
+		}
+	}
+	if len(matches) != 1 {
+		return "", false
+	}
+	return filepath.Join(wheelRepoDir, matches[0]), true
+}
+
+// pipBuildWheels builds the wheels of a python module and its dependencies
+// into wheelDir. The wheels are built into a temporary directory first, so
+// that wheelDir only ever holds a complete set of wheels.
+func (p *cliWrapper) pipBuildWheels(
+	pythonModule *models.PythonModule,
+	pullDir string,
+	source string,
+	wheelDir string,
+	env []string,
+) error {
+	if err := os.MkdirAll(filepath.Dir(wheelDir), 0750); err != nil {
+		return fmt.Errorf("error creating wheel cache directory (%w)", err)
+	}
+	tempDir, err := os.MkdirTemp(filepath.Dir(wheelDir), filepath.Base(wheelDir)+".tmp")
+	if err != nil {
+		return fmt.Errorf("error creating wheel cache directory (%w)", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+	if err := p.pip(pythonModule, pullDir, env, "wheel", "--wheel-dir", tempDir, source); err != nil {
+		return err
+	}
+	err = os.Rename(tempDir, wheelDir)
+	if err != nil {
+		if _, statErr := os.Stat(wheelDir); statErr == nil {
+			// another pull built the same wheels in the meantime
+			return nil
+		}
+		return fmt.Errorf("error storing wheels in the wheel cache (%w)", err)
 	}
 	return nil
 }
 
-func (p *cliWrapper) Deploy(fullModuleName string, pluginDirAbsPath string) (io.WriteCloser, io.ReadCloser, io.ReadCloser, *exex.Cmd, error) {
+// pipInstallWheels installs a python module from the wheels kept in
+// wheelDir, without touching git or any package index.
+func (p *cliWrapper) pipInstallWheels(
+	pythonModule *models.PythonModule,
+	pullDir string,
+	wheelDir string,
+	env []string,
+) error {
+	return p.pip(pythonModule, pullDir, env,
+		"install", "--no-index", "--find-links", wheelDir, *pythonModule.ModuleName)
+}
+
+// checkoutMirror checks out the requested commit of a python module from
+// the git mirror of its repository, and returns the directory pip should
+// install the module from, along with the SHA of the commit.
+func (p *cliWrapper) checkoutMirror(
+	mirrors *gitmirror.Mirrors,
+	pythonModule *models.PythonModule,
+	pullDir string,
+	env []string,
+) (string, string, error) {
+	fullModuleName := pythonModule.FullModuleName()
+	revision := ""
+	if pythonModule.ModuleVersion != nil {
+		revision = *pythonModule.ModuleVersion
+	}
+	checkoutDir := filepath.Join(pullDir, "source")
+	if err := os.RemoveAll(checkoutDir); err != nil {
+		return "", "", err
+	}
+	p.progress.ReportProgress(ProgressEvent{
+		Module:  fullModuleName,
+		Stage:   ProgressDownloading,
+		Subject: *pythonModule.Repo,
+	})
+	commit, err := mirrors.Checkout(*pythonModule.Repo, revision, checkoutDir, env)
+	if errors.Is(err, gitmirror.ErrRevisionNotFound) {
+		return "", "", &PullError{
+			Module:     fullModuleName,
+			Kind:       ErrRevisionNotFound,
+			Repository: *pythonModule.Repo,
+			Revision:   revision,
+			Err:        err,
+		}
+	} else if err != nil {
+		return "", "", ClassifyPullError(fullModuleName, err)
+	}
+	p.logger.Debugf("installing %s from commit %s of its git mirror", fullModuleName, commit)
+	return checkoutDir, commit, nil
+}
+
+// rewriteSource applies the first configured source rewrite matching the
+// repository of a python module, so that it gets pulled from elsewhere.
+// Only the repository changes, so the module path, which caches the module,
+// still only depends on the module name and version.
+func (p *cliWrapper) rewriteSource(pythonModule *models.PythonModule) {
+	repo := *pythonModule.Repo
+	for _, rewrite := range p.config.SourceRewrites {
+		var rewritten string
+		switch {
+		case rewrite.Regex != nil && rewrite.Regex.MatchString(repo):
+			rewritten = rewrite.Regex.ReplaceAllString(repo, rewrite.Replacement)
+		case rewrite.Regex == nil && rewrite.Prefix != "" && strings.HasPrefix(repo, rewrite.Prefix):
+			rewritten = rewrite.Replacement + strings.TrimPrefix(repo, rewrite.Prefix)
+		default:
+			continue
+		}
+		p.logger.Infof("rewrote source of python module %s from %s to %s",
+			pythonModule.FullModuleName(), repo, rewritten)
+		pythonModule.Repo = &rewritten
+		return
+	}
+}
+
+func (p *cliWrapper) Deploy(
+	fullModuleName string,
+	pluginDirAbsPath string,
+	cgroup *cgroup.Cgroup,
+	secretsDir string,
+) (io.WriteCloser, io.ReadCloser, io.ReadCloser, io.ReadCloser, *exex.Cmd, error) {
 	pythonModule, err := parseModuleName(fullModuleName)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
 	}
 
 	modulePath, err := p.GetModulePath(fullModuleName)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
+	}
+	moduleSettings, err := ModuleSettings(p.config, fullModuleName)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	// the plugin runs from the venv the module links to now, which later
+	// pulls leave alone for as long as the plugin holds its lock
+	venvPath, venvLock, err := lockVenv(*modulePath)
+	if err != nil {
+		return nil, nil, nil, nil, nil, fmt.Errorf("error finding the venv of python module %s (%w)",
+			fullModuleName, err)
+	}
+	if venvLock != nil {
+		// the lock is released once the plugin process has it
+		defer func() {
+			_ = venvLock.Close()
+		}()
 	}
-	venvPython := filepath.Join(*modulePath, "venv/bin/python")
-	args := []string{"-m"}
+	venvPython := filepath.Join(venvPath, "bin/python")
 	moduleInvokableName := strings.ReplaceAll(*pythonModule.ModuleName, "-", "_")
-	args = append(args, moduleInvokableName, "--atp")
+	settings := launcherSettings{
+		Module:  moduleInvokableName,
+		Args:    []string{"--atp"},
+		Rlimits: rlimits(moduleSettings.ResourceLimits),
+	}
+	if p.config.AuditHook.Enabled {
+		settings.Audit, err = newAuditSettings(p.config.AuditHook, venvPath, pluginDirAbsPath, secretsDir)
+		if err != nil {
+			return nil, nil, nil, nil, nil, err
+		}
+	}
+	credential, err := pluginCredential(p.config.PluginUser)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	if credential != nil {
+		if err := checkPluginUserCapabilities(credential); err != nil {
+			return nil, nil, nil, nil, nil, err
+		}
+		// the modules directory is in the working directory, along with the
+		// connector directories holding the plugin directories
+		workDir := filepath.Dir(p.connectorDir)
+		if err := preparePluginUser(credential, workDir, venvPath, pluginDirAbsPath, secretsDir); err != nil {
+			return nil, nil, nil, nil, nil, fmt.Errorf("error preparing python module %s to run as uid %d (%w)",
+				fullModuleName, credential.Uid, err)
+		}
+	}
+	// the sandbox and the private network both need new namespaces
+	privateNetwork := moduleSettings.Network == config.NetworkNone
+	namespaced := p.config.Sandbox.Enabled || privateNetwork
+	if p.config.Sandbox.Enabled {
+		settings.Sandbox, err = newSandboxSettings(venvPath, pluginDirAbsPath, secretsDir)
+		if err != nil {
+			return nil, nil, nil, nil, nil, err
+		}
+	}
+	if namespaced {
+		settings.PrivateNetwork = privateNetwork
+		settings.UserNamespace = &userNamespaceSettings{UID: os.Getuid(), GID: os.Getgid()}
+		if credential != nil {
+			settings.UserNamespace = &userNamespaceSettings{UID: int(credential.Uid), GID: int(credential.Gid)}
+		}
+	}
+	if p.config.Sandbox.Landlock.Enabled {
+		settings.Landlock, err = p.newLandlockSettings(fullModuleName, venvPath, pluginDirAbsPath, secretsDir)
+		if err != nil {
+			return nil, nil, nil, nil, nil, err
+		}
+	}
+	if p.config.Sandbox.Seccomp.Enabled {
+		settings.Seccomp, err = newSeccompSettings(p.config.Sandbox.Seccomp, fullModuleName)
+		if err != nil {
+			return nil, nil, nil, nil, nil, err
+		}
+	}
+	// never pass the engine's secrets on to the plugin
+	args, env, err := launcherCommand(settings, PluginEnvironment(p.config, moduleSettings, venvPath, os.Environ()))
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
 
 	deployCommand := exex.Command(venvPython, args...)
 	// execute plugin in its own directory in case the plugin needs
 	// to write to its current working directory
 	deployCommand.Dir = pluginDirAbsPath
+	deployCommand.Env = env
+	if secretsDir != "" {
+		deployCommand.Env = util.MergeEnviron(deployCommand.Env, map[string]string{SecretsDirVariable: secretsDir})
+	}
+	// start the plugin in its own process group, so that the processes it
+	// starts can be signaled along with it
+	deployCommand.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if namespaced {
+		applyNamespaces(deployCommand.SysProcAttr, p.config.Sandbox.Enabled, privateNetwork, credential)
+	} else if credential != nil {
+		deployCommand.SysProcAttr.Credential = credential
+	}
+	if credential != nil {
+		// the home directory of the engine belongs to another user
+		deployCommand.Env = util.MergeEnviron(deployCommand.Env, map[string]string{"HOME": pluginDirAbsPath})
+	}
+	if p.config.Sandbox.Enabled {
+		// the home directory and the temporary directory of the engine are
+		// not visible in the sandbox
+		deployCommand.Env = util.MergeEnviron(deployCommand.Env, map[string]string{
+			"HOME":   pluginDirAbsPath,
+			"TMPDIR": "/tmp",
+		})
+	}
+	if settings.Landlock != nil {
+		// the plugin directory is the only one Landlock lets the plugin write to
+		deployCommand.Env = util.MergeEnviron(deployCommand.Env, map[string]string{
+			"HOME":   pluginDirAbsPath,
+			"TMPDIR": pluginDirAbsPath,
+		})
+	}
 
 	stdin, err := deployCommand.StdinPipe()
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
 	}
 	stdout, err := deployCommand.StdoutPipe()
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
 	}
 	stderr, err := deployCommand.StderrPipe()
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
+	}
+	if cgroup != nil {
+		// start the process right in its cgroup, so that it cannot start
+		// any subprocess outside of it
+		cgroupDir, err := cgroup.Open()
+		if err != nil {
+			return nil, nil, nil, nil, nil, fmt.Errorf("error opening cgroup %s (%w)", cgroup.Path(), err)
+		}
+		defer func() {
+			_ = cgroupDir.Close()
+		}()
+		deployCommand.SysProcAttr.UseCgroupFD = true
+		deployCommand.SysProcAttr.CgroupFD = int(cgroupDir.Fd())
+	}
+	var auditReport, auditWriter *os.File
+	if settings.Audit != nil {
+		auditReport, auditWriter, err = os.Pipe()
+		if err != nil {
+			return nil, nil, nil, nil, nil, fmt.Errorf("error creating the audit report pipe (%w)", err)
+		}
+		// the write end is closed once the plugin process has it
+		defer func() {
+			_ = auditWriter.Close()
+		}()
+		deployCommand.ExtraFiles = []*os.File{auditWriter}
+	}
+	if venvLock != nil {
+		// the plugin process inherits the lock on its venv, holding it until
+		// it exits
+		deployCommand.ExtraFiles = append(deployCommand.ExtraFiles, venvLock)
 	}
 	err = deployCommand.Start()
-	if err != nil {
-		return nil, nil, nil, nil, fmt.Errorf(
+	if err != nil && auditReport != nil {
+		_ = auditReport.Close()
+	}
+	// clone fails with EPERM or EINVAL when unprivileged user namespaces are
+	// disabled, any other error has nothing to do with them
+	if err != nil && namespaced && (errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EINVAL)) {
+		return nil, nil, nil, nil, nil, fmt.Errorf(
+			"error starting python process for %s in new namespaces, unprivileged user namespaces may be "+
+				"disabled on this host (%w)", fullModuleName, err)
+	} else if err != nil && credential != nil && errors.Is(err, syscall.EPERM) {
+		return nil, nil, nil, nil, nil, fmt.Errorf("%w, error starting python process for %s as uid %d and gid %d (%w)",
+			ErrPluginUserPermission, fullModuleName, credential.Uid, credential.Gid, err)
+	} else if err != nil {
+		return nil, nil, nil, nil, nil, fmt.Errorf(
 			"error starting python process for %s (%w)", fullModuleName, err)
 	}
-	return stdin, stdout, stderr, deployCommand, nil
+	if auditReport == nil {
+		return stdin, stdout, stderr, nil, deployCommand, nil
+	}
+	return stdin, stdout, stderr, auditReport, deployCommand, nil
 }
 
 // Venv creates a Python virtual environment for the given
@@ -176,16 +645,153 @@ func (p *cliWrapper) Venv(fullModuleName string) error {
 	if err != nil {
 		return err
 	}
-	venvPath := filepath.Join(*modulePath, "venv")
-	cmdCreateVenv := exex.Command(p.pythonFullPath, "-m", "venv", "--clear", venvPath)
-	output, err := cmdCreateVenv.Output()
-	if len(output) > 0 {
-		p.logger.Debugf("venv creation stdout %s", output)
+	pullDir, lock, err := newPullDir(*modulePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = lock.Close()
+	}()
+	if err := p.venv(fullModuleName, filepath.Join(pullDir, venvLinkName)); err != nil {
+		_ = os.RemoveAll(pullDir)
+		return err
 	}
+	return publishVenv(*modulePath, pullDir)
+}
+
+// venv creates a Python virtual environment for the given Python module at
+// venvPath.
+func (p *cliWrapper) venv(fullModuleName string, venvPath string) error {
+	p.progress.ReportProgress(ProgressEvent{
+		Module:  fullModuleName,
+		Stage:   ProgressCreatingVenv,
+		Subject: venvPath,
+	})
+	cmdCreateVenv := exex.Command(p.pythonFullPath, "-m", "venv", "--clear", venvPath)
+	err := p.runStreaming(cmdCreateVenv, fullModuleName, "venv creation", func(_ string) {})
 	if err != nil {
 		return exex.CommandError(err,
 			fmt.Sprintf("error creating venv for %s", fullModuleName))
 	}
 	return nil
+}
+
+// PullEnvironment returns the environment of the pip and git subprocesses
+// pulling a python module, built from the engine's environment according to
+// the given configuration.
+func PullEnvironment(cfg *config.Config, environ []string) []string {
+	pullEnv := cfg.PullEnvironment
+	if pullEnv.Isolated {
+		environ = util.FilterEnviron(environ, pullEnv.Inherit)
+	}
+	env := util.MergeEnviron(environ, pullEnv.Variables)
+	env = util.MergeEnviron(env, GitCredentialsEnvironment(cfg.GitCredentials, env))
+	// Make git non-interactive, so that it never prompts for credentials.
+	// Otherwise, you can hit edge cases where git will wait for manual
+	// authentication causing pip to hang because pip calls `git clone` in
+	// a subprocess.
+	return util.MergeEnviron(env, map[string]string{"GIT_TERMINAL_PROMPT": "0"})
+}
+
+// PullSettings returns a digest of the settings of cfg changing how python
+// modules are pulled, and what their venvs hold: the interpreter, where the
+// modules come from and the credentials and environment they are pulled
+// with, the caches, and how the venvs are prepared for plugins.
+func PullSettings(cfg *config.Config) (string, error) {
+	settingsJSON, err := json.Marshal(struct {
+		PythonPath      string
+		PythonSemVer    string
+		PullEnvironment config.PullEnvironment
+		GitCredentials  config.GitCredentials
+		SourceRewrites  []config.SourceRewrite
+		GitMirror       bool
+		WheelCache      bool
+		PluginUser      config.PluginUser
+		AuditHook       bool
+	}{
+		cfg.PythonPath,
+		cfg.PythonSemVer,
+		cfg.PullEnvironment,
+		cfg.GitCredentials,
+		cfg.SourceRewrites,
+		cfg.GitMirror,
+		cfg.WheelCache,
+		cfg.PluginUser,
+		cfg.AuditHook.Enabled,
+	})
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(settingsJSON)
+	return hex.EncodeToString(digest[:]), nil
+}
 
+// SecretsDirVariable is the environment variable giving plugins the path
+// of the directory holding their secrets, one file per secret named after it.
+const SecretsDirVariable = "ARCAFLOW_SECRETS_DIR"
+
+// defaultPluginPath is the PATH of plugins that do not inherit one.
+const defaultPluginPath = "/usr/local/bin:/usr/bin:/bin"
+
+// PluginEnvironment returns the environment of a plugin process running in
+// the venv at venvPath. It starts clean, with only the variables of environ
+// allowed by the plugin environment of cfg, then adds the variables of the
+// module settings, and activates the venv, so that the plugin's subprocesses
+// resolve the tools of the venv first.
+func PluginEnvironment(
+	cfg *config.Config,
+	moduleSettings config.ModuleSettings,
+	venvPath string,
+	environ []string,
+) []string {
+	env := util.FilterEnviron(environ, cfg.PluginEnvironment.Inherit)
+	env = util.MergeEnviron(env, moduleSettings.Environment)
+	path := defaultPluginPath
+	for _, variable := range env {
+		if value, found := strings.CutPrefix(variable, "PATH="); found && value != "" {
+			path = value
+		}
+	}
+	return util.MergeEnviron(env, map[string]string{
+		"VIRTUAL_ENV": venvPath,
+		"PATH":        filepath.Join(venvPath, "bin") + string(os.PathListSeparator) + path,
+	})
+}
+
+// pullStderrTailSize is the number of bytes kept from the end of the stderr
+// of the commands of a pull, to explain their failure.
+const pullStderrTailSize = 64 * 1024
+
+// runStreaming runs a command, logging its stdout and stderr line by line
+// while it is running, labeled with the module it runs for, and passes each
+// line of stdout to onStdout. Like exex.Cmd.Output, a failed command results
+// in an exex.ExitError carrying the command's stderr, its last
+// pullStderrTailSize bytes that is.
+func (p *cliWrapper) runStreaming(
+	cmd *exex.Cmd,
+	fullModuleName string,
+	description string,
+	onStdout func(line string),
+) error {
+	logger := p.logger.WithLabel("module", fullModuleName)
+	stderr := util.NewTailBuffer(pullStderrTailSize)
+	stdoutLines := &util.LineWriter{OnLine: func(line string) {
+		logger.Debugf("%s stdout: %s", description, line)
+		onStdout(line)
+	}}
+	stderrLines := &util.LineWriter{OnLine: func(line string) {
+		logger.Debugf("%s stderr: %s", description, line)
+		_, _ = stderr.Write([]byte(line + "\n"))
+	}}
+	cmd.Stdout = stdoutLines
+	cmd.Stderr = stderrLines
+	err := cmd.Run()
+	stdoutLines.Flush()
+	stderrLines.Flush()
+
+	var exErr *exex.ExitError
+	if errors.As(err, &exErr) {
+		exErr.Stderr = []byte(stderr.String())
+	}
+	return err
 }
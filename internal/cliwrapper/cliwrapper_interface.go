@@ -2,12 +2,23 @@ package cliwrapper
 
 import (
 	"go.arcalot.io/exex"
+	"go.flow.arcalot.io/pythondeployer/internal/cgroup"
 	"io"
 )
 
 type CliWrapper interface {
 	PullModule(fullModuleName string) error
-	Deploy(fullModuleName string, pluginDirAbsPath string) (io.WriteCloser, io.ReadCloser, io.ReadCloser, *exex.Cmd, error)
+	// Deploy starts the plugin process of a module in its plugin directory,
+	// inside the given cgroup unless it is nil. The plugin finds its secrets
+	// in secretsDir, if it is not empty. It returns the stdin, stdout and
+	// stderr of the plugin process, and the events reported by its audit
+	// hook, as AuditEvent JSON lines, or nil if it has no audit hook.
+	Deploy(
+		fullModuleName string,
+		pluginDirAbsPath string,
+		cgroup *cgroup.Cgroup,
+		secretsDir string,
+	) (io.WriteCloser, io.ReadCloser, io.ReadCloser, io.ReadCloser, *exex.Cmd, error)
 	GetModulePath(fullModuleName string) (*string, error)
 	ModuleExists(fullModuleName string) (*bool, error)
 	Venv(fullModuleName string) error
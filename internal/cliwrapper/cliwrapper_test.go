@@ -1,16 +1,30 @@
 package cliwrapper_test
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"go.arcalot.io/assert"
 	"go.arcalot.io/exex"
 	"go.arcalot.io/log/v2"
+	"go.flow.arcalot.io/pluginsdk/schema"
 	"go.flow.arcalot.io/pythondeployer/internal/cliwrapper"
+	"go.flow.arcalot.io/pythondeployer/internal/config"
+	"go.flow.arcalot.io/pythondeployer/internal/gitmirror"
+	"go.flow.arcalot.io/pythondeployer/internal/seccomp"
 )
 
 type TestModule struct {
@@ -49,11 +63,18 @@ func Test_PullModule_NonexistentGitLocation(t *testing.T) {
 	assert.NoError(t, err)
 
 	logger := log.NewTestLogger(t)
-	wrap := cliwrapper.NewCliWrapper(pythonPath, tempdir, logger)
+	progress := &progressRecorder{}
+	wrap := cliwrapper.NewCliWrapper(pythonPath, tempdir, cliwrapper.Caches{}, &config.Config{}, logger, progress)
 
 	err = wrap.PullModule(testModule.Location)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "pip installing")
+	assert.Equals(t, progress.Stages()[:2], []cliwrapper.ProgressStage{
+		cliwrapper.ProgressCreatingVenv,
+		cliwrapper.ProgressResolving,
+	})
+	var pullErr *cliwrapper.PullError
+	assert.Equals(t, errors.As(err, &pullErr), true)
 	var exErr *exex.ExitError
 	assert.Equals(t, errors.As(err, &exErr), true)
 	stderrStr := string(exErr.Stderr)
@@ -78,9 +99,1268 @@ func Test_PullModule_ErrorModuleNameFmt(t *testing.T) {
 	assert.NoError(t, err)
 
 	logger := log.NewTestLogger(t)
-	wrap := cliwrapper.NewCliWrapper(pythonPath, tempdir, logger)
+	wrap := cliwrapper.NewCliWrapper(pythonPath, tempdir, cliwrapper.Caches{}, &config.Config{}, logger, nil)
 
 	err = wrap.PullModule(testModule.Location)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "wrong module name format")
+	assert.Equals(t, errors.Is(err, cliwrapper.ErrModuleSpecInvalid), true)
+}
+
+// Test the function ClassifyPullError turns pip and git failures
+// into typed errors carrying the details of the failure, and that
+// only network failures are considered worth retrying.
+func Test_ClassifyPullError(t *testing.T) {
+	const moduleName = "nonexistent@git+https://github.com/arcalot/nonexistent.git@2b8e8c3"
+	testCases := map[string]struct {
+		stderr    string
+		kind      error
+		detail    string
+		transient bool
+	}{
+		"authentication_required": {
+			"fatal: could not read Username for 'https://github.com': terminal prompts disabled\n" +
+				"error: subprocess-exited-with-error\n× git clone --filter=blob:none --quiet did not run successfully.\n" +
+				"│ exit code: 128",
+			cliwrapper.ErrAuthenticationRequired,
+			"fatal: could not read Username for 'https://github.com': terminal prompts disabled",
+			false,
+		},
+		"repository_not_found": {
+			"remote: Repository not found.\nfatal: repository 'https://example.com/x.git/' not found",
+			cliwrapper.ErrRepositoryNotFound,
+			"remote: Repository not found.",
+			false,
+		},
+		"revision_not_found": {
+			"error: pathspec '2b8e8c3' did not match any file(s) known to git",
+			cliwrapper.ErrRevisionNotFound,
+			"error: pathspec '2b8e8c3' did not match any file(s) known to git",
+			false,
+		},
+		"network_unavailable": {
+			"fatal: unable to access 'https://github.com/arcalot/x.git/': Could not resolve host: github.com",
+			cliwrapper.ErrNetworkUnavailable,
+			"fatal: unable to access 'https://github.com/arcalot/x.git/': Could not resolve host: github.com",
+			true,
+		},
+		"index_unavailable": {
+			"ERROR: HTTP error 503 Service Unavailable while getting https://pypi.org/simple/x",
+			cliwrapper.ErrNetworkUnavailable,
+			"ERROR: HTTP error 503 Service Unavailable while getting https://pypi.org/simple/x",
+			true,
+		},
+		"interpreter_incompatible": {
+			"ERROR: Package 'nonexistent' requires a different Python: 3.9.18 not in '>=3.11'",
+			cliwrapper.ErrInterpreterIncompatible,
+			"ERROR: Package 'nonexistent' requires a different Python: 3.9.18 not in '>=3.11'",
+			false,
+		},
+		"dependency_conflict": {
+			"ERROR: Cannot install nonexistent because these package versions have conflicting dependencies.\n" +
+				"ERROR: ResolutionImpossible: for help visit https://pip.pypa.io",
+			cliwrapper.ErrDependencyConflict,
+			"ERROR: Cannot install nonexistent because these package versions have conflicting dependencies.",
+			false,
+		},
+		"build_failure": {
+			"error: subprocess-exited-with-error\n  Building wheel for nonexistent (pyproject.toml) did not run successfully.\n" +
+				"ERROR: Could not build wheels for nonexistent, which is required to install pyproject.toml-based projects",
+			cliwrapper.ErrBuildFailed,
+			"ERROR: Could not build wheels for nonexistent, which is required to install pyproject.toml-based projects",
+			false,
+		},
+	}
+	for name, tc := range testCases {
+		localTc := tc
+		t.Run(name, func(t *testing.T) {
+			exitErr := &exex.ExitError{Stderr: []byte(localTc.stderr)}
+			err := cliwrapper.ClassifyPullError(
+				moduleName, fmt.Errorf("error in pip installing %s (%w)", moduleName, exitErr))
+			assert.Equals(t, errors.Is(err, localTc.kind), true)
+			assert.Equals(t, cliwrapper.IsTransientPullError(err), localTc.transient)
+			var pullErr *cliwrapper.PullError
+			assert.Equals(t, errors.As(err, &pullErr), true)
+			assert.Equals(t, pullErr.Detail, localTc.detail)
+			assert.Equals(t, pullErr.Repository, "https://github.com/arcalot/nonexistent.git")
+			assert.Equals(t, pullErr.Revision, "2b8e8c3")
+			var exErr *exex.ExitError
+			assert.Equals(t, errors.As(err, &exErr), true)
+		})
+	}
+
+	// errors that cannot be classified are left alone
+	unknownErr := fmt.Errorf("error in pip installing (%w)",
+		&exex.ExitError{Stderr: []byte("error: something unexpected happened")})
+	assert.Equals(t, cliwrapper.ClassifyPullError(moduleName, unknownErr), unknownErr)
+	assert.Equals(t, cliwrapper.IsTransientPullError(unknownErr), false)
+}
+
+// Test the commands of a pull that fail only keep the end of their
+// stderr for the error, however much they write to it.
+func Test_Venv_StderrTail(t *testing.T) {
+	tempdir := t.TempDir()
+	// a stand-in for a python interpreter failing with a flood of errors
+	pythonPath := filepath.Join(tempdir, "python")
+	assert.NoError(t, os.WriteFile(pythonPath, []byte(
+		"#!/bin/sh\nseq 1 100000 >&2\necho 'last words' >&2\nexit 1\n"),
+		0700)) //nolint:gosec // the stand-in needs to be executable
+	wrap := cliwrapper.NewCliWrapper(pythonPath, tempdir, cliwrapper.Caches{}, &config.Config{}, log.NewTestLogger(t), nil)
+
+	err := wrap.Venv("fixture-plugin@git+https://github.com/arcalot/fixture-plugin.git")
+	var exitErr *exex.ExitError
+	assert.Equals(t, errors.As(err, &exitErr), true)
+	assert.Equals(t, len(exitErr.Stderr) <= 64*1024, true)
+	assert.Equals(t, strings.HasSuffix(string(exitErr.Stderr), "100000\nlast words\n"), true)
+}
+
+// Test the function ParsePipProgress recognizes the lines of pip
+// install output marking a progress stage.
+func Test_ParsePipProgress(t *testing.T) {
+	testCases := map[string]struct {
+		line    string
+		stage   cliwrapper.ProgressStage
+		subject string
+		found   bool
+	}{
+		"collecting": {
+			"Collecting arcaflow-plugin-utilities@ git+https://github.com/arcalot/arcaflow-plugin-utilities.git",
+			cliwrapper.ProgressResolving,
+			"arcaflow-plugin-utilities",
+			true,
+		},
+		"collecting_dependency": {
+			"Collecting cbor2~=5.6.5 (from arcaflow-plugin-sdk)",
+			cliwrapper.ProgressResolving,
+			"cbor2~=5.6.5",
+			true,
+		},
+		"cloning": {
+			"  Cloning https://github.com/arcalot/arcaflow-plugin-utilities.git to /tmp/pip-req-build-7u3x",
+			cliwrapper.ProgressDownloading,
+			"https://github.com/arcalot/arcaflow-plugin-utilities.git",
+			true,
+		},
+		"downloading": {
+			"  Downloading cbor2-5.6.5-cp311-cp311-manylinux_2_17_x86_64.whl (250 kB)",
+			cliwrapper.ProgressDownloading,
+			"cbor2-5.6.5-cp311-cp311-manylinux_2_17_x86_64.whl",
+			true,
+		},
+		"building": {
+			"  Building wheel for arcaflow-plugin-utilities (pyproject.toml): started",
+			cliwrapper.ProgressBuilding,
+			"arcaflow-plugin-utilities",
+			true,
+		},
+		"installing": {
+			"Installing collected packages: cbor2, arcaflow-plugin-sdk",
+			cliwrapper.ProgressInstalling,
+			"cbor2, arcaflow-plugin-sdk",
+			true,
+		},
+		"installed": {
+			"Successfully installed arcaflow-plugin-sdk-0.14.0 cbor2-5.6.5",
+			cliwrapper.ProgressInstalled,
+			"arcaflow-plugin-sdk-0.14.0 cbor2-5.6.5",
+			true,
+		},
+		"other": {
+			"  Preparing metadata (pyproject.toml): started",
+			"",
+			"",
+			false,
+		},
+	}
+	for name, tc := range testCases {
+		localTc := tc
+		t.Run(name, func(t *testing.T) {
+			stage, subject, found := cliwrapper.ParsePipProgress(localTc.line)
+			assert.Equals(t, found, localTc.found)
+			assert.Equals(t, stage, localTc.stage)
+			assert.Equals(t, subject, localTc.subject)
+		})
+	}
+}
+
+type progressRecorder struct {
+	lock   sync.Mutex
+	events []cliwrapper.ProgressEvent
+}
+
+func (p *progressRecorder) ReportProgress(event cliwrapper.ProgressEvent) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.events = append(p.events, event)
+}
+
+func (p *progressRecorder) Stages() []cliwrapper.ProgressStage {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	stages := make([]cliwrapper.ProgressStage, 0, len(p.events))
+	for _, event := range p.events {
+		stages = append(stages, event.Stage)
+	}
+	return stages
+}
+
+// Test the function PullEnvironment passes the engine's environment
+// on to pulls, or only the allowed part of it when isolated, with
+// the explicitly configured variables on top.
+func Test_PullEnvironment(t *testing.T) {
+	environ := []string{
+		"PATH=/usr/bin",
+		"HTTPS_PROXY=http://proxy:3128",
+		"PIP_INDEX_URL=https://mirror/simple",
+		"ENGINE_TOKEN=secret",
+		"GIT_TERMINAL_PROMPT=1",
+	}
+	testCases := map[string]struct {
+		pullEnv  config.PullEnvironment
+		expected []string
+	}{
+		"inherit_all": {
+			config.PullEnvironment{},
+			[]string{
+				"PATH=/usr/bin",
+				"HTTPS_PROXY=http://proxy:3128",
+				"PIP_INDEX_URL=https://mirror/simple",
+				"ENGINE_TOKEN=secret",
+				"GIT_TERMINAL_PROMPT=0",
+			},
+		},
+		"isolated_allowlist": {
+			config.PullEnvironment{
+				Isolated:  true,
+				Inherit:   config.DefaultPullEnvironmentInherit,
+				Variables: map[string]string{"PIP_INDEX_URL": "https://other/simple", "NO_PROXY": "localhost"},
+			},
+			[]string{
+				"PATH=/usr/bin",
+				"HTTPS_PROXY=http://proxy:3128",
+				"NO_PROXY=localhost",
+				"PIP_INDEX_URL=https://other/simple",
+				"GIT_TERMINAL_PROMPT=0",
+			},
+		},
+		"isolated_nothing_inherited": {
+			config.PullEnvironment{
+				Isolated:  true,
+				Variables: map[string]string{"PATH": "/opt/git/bin"},
+			},
+			[]string{
+				"PATH=/opt/git/bin",
+				"GIT_TERMINAL_PROMPT=0",
+			},
+		},
+	}
+	for name, tc := range testCases {
+		localTc := tc
+		t.Run(name, func(t *testing.T) {
+			cfg := &config.Config{PullEnvironment: localTc.pullEnv}
+			assert.Equals(t, cliwrapper.PullEnvironment(cfg, environ), localTc.expected)
+		})
+	}
+}
+
+// Test the git credentials configured for pulls are picked up by
+// git, while the secrets themselves never show up in the
+// environment of the pull subprocesses.
+func Test_GitCredentialsEnvironment(t *testing.T) {
+	tempdir := t.TempDir()
+	tokenFile := filepath.Join(tempdir, "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("token-secret"), 0600))
+	// a stand-in for a credential helper, like the ones of a secret store
+	helper := filepath.Join(tempdir, "git-credential-standin")
+	assert.NoError(t, os.WriteFile(helper, []byte(
+		"#!/bin/sh\ntest \"$1\" = get && echo username=helper && echo password=helper-secret\n"),
+		0700)) //nolint:gosec // the helper needs to be executable
+	// keep the git configuration of the machine out of the test
+	environ := []string{"PATH=" + os.Getenv("PATH"), "HOME=" + tempdir, "GIT_CONFIG_NOSYSTEM=1"}
+
+	testCases := map[string]struct {
+		credentials config.GitCredentials
+		host        string
+		expected    string
+		secret      string
+	}{
+		"token_file": {
+			config.GitCredentials{
+				TokenFiles: map[string]string{"git.example.com": tokenFile},
+			},
+			"git.example.com",
+			"username=x-access-token\npassword=token-secret",
+			"token-secret",
+		},
+		"helper": {
+			config.GitCredentials{
+				Helper: helper,
+			},
+			"git.example.org",
+			"username=helper\npassword=helper-secret",
+			"helper-secret",
+		},
+	}
+	for name, tc := range testCases {
+		localTc := tc
+		t.Run(name, func(t *testing.T) {
+			env := cliwrapper.PullEnvironment(
+				&config.Config{GitCredentials: localTc.credentials}, environ)
+			for _, variable := range env {
+				assert.Equals(t, strings.Contains(variable, localTc.secret), false)
+			}
+
+			cmd := exex.Command("git", "credential", "fill")
+			cmd.Env = env
+			cmd.Stdin = strings.NewReader(fmt.Sprintf("protocol=https\nhost=%s\n\n", localTc.host))
+			output, err := cmd.Output()
+			assert.NoError(t, err)
+			assert.Contains(t, string(output), localTc.expected)
+		})
+	}
+}
+
+// Test the git credentials are appended to the git configuration already
+// passed to git in the pull environment, instead of replacing it.
+func Test_GitCredentialsEnvironment_ExistingConfig(t *testing.T) {
+	tempdir := t.TempDir()
+	tokenFile := filepath.Join(tempdir, "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("token-secret"), 0600))
+	environ := []string{
+		"PATH=" + os.Getenv("PATH"), "HOME=" + tempdir, "GIT_CONFIG_NOSYSTEM=1",
+		"GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.proxy", "GIT_CONFIG_VALUE_0=http://proxy.example.com",
+	}
+	env := cliwrapper.PullEnvironment(&config.Config{GitCredentials: config.GitCredentials{
+		TokenFiles: map[string]string{"git.example.com": tokenFile},
+	}}, environ)
+	assert.Equals(t, slices.Contains(env, "GIT_CONFIG_COUNT=2"), true)
+	assert.Equals(t, slices.Contains(env, "GIT_CONFIG_KEY_1=credential.https://git.example.com.helper"), true)
+
+	cmd := exex.Command("git", "config", "--get", "http.proxy")
+	cmd.Env = env
+	output, err := cmd.Output()
+	assert.NoError(t, err)
+	assert.Equals(t, string(output), "http://proxy.example.com\n")
+	cmd = exex.Command("git", "credential", "fill")
+	cmd.Env = env
+	cmd.Stdin = strings.NewReader("protocol=https\nhost=git.example.com\n\n")
+	output, err = cmd.Output()
+	assert.NoError(t, err)
+	assert.Contains(t, string(output), "password=token-secret")
+}
+
+// Test pulls from git+ssh:// repositories use the configured key
+// and known hosts file, and never prompt.
+func Test_GitCredentialsEnvironment_SSH(t *testing.T) {
+	env := cliwrapper.GitCredentialsEnvironment(config.GitCredentials{
+		SSHKeyFile:        "/etc/arcaflow/deploy key",
+		SSHKnownHostsFile: "/etc/arcaflow/known_hosts",
+	}, nil)
+	assert.Equals(t, env, map[string]string{
+		"GIT_SSH_COMMAND": "ssh -o BatchMode=yes -o StrictHostKeyChecking=yes " +
+			"-o IdentitiesOnly=yes -i '/etc/arcaflow/deploy key' " +
+			"-o UserKnownHostsFile='/etc/arcaflow/known_hosts'",
+	})
+
+	wrap := cliwrapper.NewCliWrapper("python", "/tmp/modules", cliwrapper.Caches{}, &config.Config{}, log.NewTestLogger(t), nil)
+	modulePath, err := wrap.GetModulePath(
+		"arcaflow-plugin-private@git+ssh://git@github.com/arcalot/arcaflow-plugin-private.git@52d1a95")
+	assert.NoError(t, err)
+	assert.Equals(t, *modulePath, "/tmp/modules/arcaflow-plugin-private_52d1a95")
+}
+
+// Test the function PullModule pulls a module from the repository
+// a source rewrite redirects it to, while the module is still stored
+// under its original name and version.
+func Test_PullModule_SourceRewrite(t *testing.T) {
+	repoDir, commit := CreateFixtureRepo(t)
+	testCases := map[string]config.SourceRewrite{
+		"prefix": {
+			Prefix:      "https://github.com/arcalot/",
+			Replacement: "file://localhost" + filepath.Dir(repoDir) + "/",
+		},
+		"regex": {
+			Regex:       regexp.MustCompile(`^https://github\.com/arcalot/(.*)$`),
+			Replacement: "file://localhost" + filepath.Dir(repoDir) + "/$1",
+		},
+	}
+	for name, rewrite := range testCases {
+		localRewrite := rewrite
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			tempdir := t.TempDir()
+			pythonPath, err := GetPythonPath()
+			assert.NoError(t, err)
+			cfg := &config.Config{
+				SourceRewrites: []config.SourceRewrite{
+					{Prefix: "https://example.com/", Replacement: "https://unused.example.com/"},
+					localRewrite,
+				},
+			}
+			wrap := cliwrapper.NewCliWrapper(pythonPath, tempdir, cliwrapper.Caches{}, cfg, log.NewTestLogger(t), nil)
+
+			moduleName := "fixture-plugin@git+https://github.com/arcalot/" + filepath.Base(repoDir) + "@" + commit
+			assert.NoError(t, wrap.PullModule(moduleName))
+			modulePath, err := wrap.GetModulePath(moduleName)
+			assert.NoError(t, err)
+			assert.Equals(t, *modulePath, filepath.Join(tempdir, "fixture-plugin_"+commit))
+
+			output, err := exex.Command(
+				filepath.Join(*modulePath, "venv/bin/python"), "-m", "fixture_plugin").Output()
+			assert.NoError(t, err)
+			assert.Equals(t, string(output), "hello from fixture\n")
+		})
+	}
+}
+
+// CreateFixtureRepo creates a git repository holding the fixture
+// plugin of the testdata directory, which can be installed by pip
+// without network access, and returns its path and commit SHA.
+func CreateFixtureRepo(t *testing.T) (string, string) {
+	repoDir := filepath.Join(t.TempDir(), "fixture-plugin.git")
+	assert.NoError(t, os.CopyFS(repoDir, os.DirFS("testdata/fixture-plugin")))
+	git := func(args ...string) string {
+		cmd := exex.Command("git", append([]string{
+			"-c", "user.name=arcaflow", "-c", "user.email=arcaflow@example.com"}, args...)...)
+		cmd.Dir = repoDir
+		output, err := cmd.Output()
+		assert.NoError(t, err)
+		return strings.TrimSpace(string(output))
+	}
+	git("init", "--quiet")
+	git("add", "--all")
+	git("commit", "--quiet", "--message", "fixture plugin")
+	return repoDir, git("rev-parse", "HEAD")
+}
+
+// Test the function PullModule installs a module from the git mirror
+// of its repository, which keeps working once the repository is gone.
+func Test_PullModule_GitMirror(t *testing.T) {
+	repoDir, commit := CreateFixtureRepo(t)
+	tempdir := t.TempDir()
+	pythonPath, err := GetPythonPath()
+	assert.NoError(t, err)
+	cfg := &config.Config{
+		SourceRewrites: []config.SourceRewrite{{
+			Prefix:      "https://github.com/arcalot/",
+			Replacement: "file://localhost" + filepath.Dir(repoDir) + "/",
+		}},
+	}
+	logger := log.NewTestLogger(t)
+	mirrors := gitmirror.New(filepath.Join(tempdir, "git-mirrors"), logger)
+	wrap := cliwrapper.NewCliWrapper(pythonPath, tempdir, cliwrapper.Caches{GitMirrors: mirrors}, cfg, logger, nil)
+
+	moduleName := "fixture-plugin@git+https://github.com/arcalot/" + filepath.Base(repoDir) + "@" + commit
+	assert.NoError(t, wrap.PullModule(moduleName))
+	assert.NoError(t, os.RemoveAll(repoDir))
+	assert.NoError(t, wrap.PullModule(moduleName))
+
+	modulePath, err := wrap.GetModulePath(moduleName)
+	assert.NoError(t, err)
+	output, err := exex.Command(
+		filepath.Join(*modulePath, "venv/bin/python"), "-m", "fixture_plugin").Output()
+	assert.NoError(t, err)
+	assert.Equals(t, string(output), "hello from fixture\n")
+	// the checkout is only needed while installing
+	_, err = os.Stat(filepath.Join(*modulePath, "source"))
+	assert.Equals(t, os.IsNotExist(err), true)
+}
+
+// Test the function PullModule reuses the wheels built for a pinned commit,
+// whether pinned to its short or full SHA, without touching its repository or
+// building it again.
+func Test_PullModule_WheelCache(t *testing.T) {
+	repoDir, commit := CreateFixtureRepo(t)
+	tempdir := t.TempDir()
+	pythonPath, err := GetPythonPath()
+	assert.NoError(t, err)
+	caches := cliwrapper.Caches{
+		WheelDir:    filepath.Join(tempdir, "wheels"),
+		PipCacheDir: filepath.Join(tempdir, "pip-cache"),
+	}
+	cfg := &config.Config{
+		SourceRewrites: []config.SourceRewrite{{
+			Prefix:      "https://github.com/arcalot/",
+			Replacement: "file://localhost" + filepath.Dir(repoDir) + "/",
+		}},
+	}
+	moduleName := "fixture-plugin@git+https://github.com/arcalot/" + filepath.Base(repoDir) + "@"
+
+	firstWrap := cliwrapper.NewCliWrapper(
+		pythonPath, filepath.Join(tempdir, "first"), caches, cfg, log.NewTestLogger(t), nil)
+	assert.NoError(t, firstWrap.PullModule(moduleName+commit[:10]))
+	assert.NoError(t, os.RemoveAll(repoDir))
+	// keyed by the ABI of the interpreter, the repository and the full SHA
+	wheelDirs, err := filepath.Glob(filepath.Join(caches.WheelDir, "*", "*", commit))
+	assert.NoError(t, err)
+	assert.Equals(t, len(wheelDirs), 1)
+	abi, err := exex.Command(pythonPath, "-c", "import sysconfig; print(sysconfig.get_config_var('SOABI'))").Output()
+	assert.NoError(t, err)
+	assert.Equals(t, filepath.Base(filepath.Dir(filepath.Dir(wheelDirs[0]))), strings.TrimSpace(string(abi)))
+
+	for i, revision := range []string{commit, commit[:7]} {
+		progress := &progressRecorder{}
+		wrap := cliwrapper.NewCliWrapper(
+			pythonPath, filepath.Join(tempdir, strconv.Itoa(i)), caches, cfg, log.NewTestLogger(t), progress)
+		assert.NoError(t, wrap.PullModule(moduleName+revision))
+		assert.Equals(t, slices.Contains(progress.Stages(), cliwrapper.ProgressBuilding), false)
+
+		modulePath, err := wrap.GetModulePath(moduleName + revision)
+		assert.NoError(t, err)
+		output, err := exex.Command(
+			filepath.Join(*modulePath, "venv/bin/python"), "-m", "fixture_plugin").Output()
+		assert.NoError(t, err)
+		assert.Equals(t, string(output), "hello from fixture\n")
+	}
+}
+
+// Test pulling a module again replaces its venv for the plugins deployed
+// later, while the plugins running from the previous venv keep it, until
+// they exit.
+func Test_PullModule_VenvInUse(t *testing.T) {
+	cfg := &config.Config{Modules: map[string]config.ModuleSettings{
+		"fixture-plugin": {Environment: map[string]string{"FIXTURE_WAIT": "1"}},
+	}}
+	wrap, moduleName := PullFixture(t, cfg)
+	modulePath, err := wrap.GetModulePath(moduleName)
+	assert.NoError(t, err)
+	firstVenv, err := filepath.EvalSymlinks(filepath.Join(*modulePath, "venv"))
+	assert.NoError(t, err)
+
+	stdin, stdout, _, _, deployCommand, err := wrap.Deploy(moduleName, t.TempDir(), nil, "")
+	assert.NoError(t, err)
+	assert.NoError(t, wrap.PullModule(moduleName))
+	secondVenv, err := filepath.EvalSymlinks(filepath.Join(*modulePath, "venv"))
+	assert.NoError(t, err)
+	assert.Equals(t, secondVenv != firstVenv, true)
+	_, err = os.Stat(firstVenv)
+	assert.NoError(t, err)
+
+	assert.NoError(t, stdin.Close())
+	process := ReadFixtureProcess(t, stdout, deployCommand)
+	assert.Equals(t, process.Environ["VIRTUAL_ENV"], firstVenv)
+	// the next pull removes the venv no plugin runs from anymore
+	assert.NoError(t, wrap.PullModule(moduleName))
+	_, err = os.Stat(firstVenv)
+	assert.Equals(t, os.IsNotExist(err), true)
+}
+
+// FixtureProcess is what the fixture plugin reports about its process when
+// it is deployed.
+type FixtureProcess struct {
+	Argv         []string          `json:"argv"`
+	Environ      map[string]string `json:"environ"`
+	PID          int               `json:"pid"`
+	SysPath      []string          `json:"sysPath"`
+	UID          int               `json:"uid"`
+	GID          int               `json:"gid"`
+	Groups       []int             `json:"groups"`
+	Writable     map[string]bool   `json:"writable"`
+	Visible      map[string]bool   `json:"visible"`
+	Readable     map[string]bool   `json:"readable"`
+	Interfaces   []string          `json:"interfaces"`
+	ConnectError string            `json:"connectError"`
+	Loopback     bool              `json:"loopback"`
+	Audit        map[string]string `json:"audit"`
+	Interpreter  struct {
+		HashRandomization int      `json:"hashRandomization"`
+		DontWriteBytecode bool     `json:"dontWriteBytecode"`
+		WarnOptions       []string `json:"warnOptions"`
+		StdoutEncoding    string   `json:"stdoutEncoding"`
+	} `json:"interpreter"`
+	Rlimits map[string]int64 `json:"rlimits"`
+}
+
+// PullFixture pulls the fixture plugin with the settings of cfg, and returns
+// the wrapper it was pulled with along with its module name.
+func PullFixture(t *testing.T, cfg *config.Config) (cliwrapper.CliWrapper, string) {
+	repoDir, commit := CreateFixtureRepo(t)
+	pythonPath, err := GetPythonPath()
+	assert.NoError(t, err)
+	cfg.SourceRewrites = []config.SourceRewrite{{
+		Prefix:      "https://github.com/arcalot/",
+		Replacement: "file://localhost" + filepath.Dir(repoDir) + "/",
+	}}
+	wrap := cliwrapper.NewCliWrapper(pythonPath, t.TempDir(), cliwrapper.Caches{}, cfg, log.NewTestLogger(t), nil)
+	moduleName := "fixture-plugin@git+https://github.com/arcalot/" + filepath.Base(repoDir) + "@" + commit
+	assert.NoError(t, wrap.PullModule(moduleName))
+	return wrap, moduleName
+}
+
+// ReadFixtureProcess reads the output of the deployed fixture plugin until
+// it exits, and returns what it reported about its process.
+func ReadFixtureProcess(t *testing.T, stdout io.Reader, deployCommand *exex.Cmd) FixtureProcess {
+	output, err := io.ReadAll(stdout)
+	assert.NoError(t, err)
+	assert.NoError(t, deployCommand.Wait())
+	greeting, processJSON, found := strings.Cut(string(output), "\n")
+	assert.Equals(t, found, true)
+	assert.Equals(t, greeting, "hello from fixture")
+	var process FixtureProcess
+	assert.NoError(t, json.Unmarshal([]byte(processJSON), &process))
+	return process
+}
+
+// Test the function Deploy starts the plugin process in its own process
+// group, so that its subprocesses can be stopped along with it.
+func Test_Deploy_ProcessGroup(t *testing.T) {
+	wrap, moduleName := PullFixture(t, &config.Config{})
+
+	_, stdout, _, _, deployCommand, err := wrap.Deploy(moduleName, t.TempDir(), nil, "")
+	assert.NoError(t, err)
+	// the process stays a zombie until it is waited for
+	pgid, err := syscall.Getpgid(deployCommand.Process.Pid)
+	assert.NoError(t, err)
+	assert.Equals(t, pgid, deployCommand.Process.Pid)
+	process := ReadFixtureProcess(t, stdout, deployCommand)
+	assert.Equals(t, process.Argv, []string{"--atp"})
+}
+
+// Test the function Deploy applies the resource limits of the deployer,
+// overridden by the limits of the module.
+func Test_Deploy_ResourceLimits(t *testing.T) {
+	cfg := &config.Config{
+		ResourceLimits: config.ResourceLimits{
+			AddressSpace: schema.PointerTo(int64(4 << 30)),
+			CPUTime:      schema.PointerTo(1500 * time.Millisecond),
+			OpenFiles:    schema.PointerTo(int64(64)),
+		},
+		Modules: map[string]config.ModuleSettings{
+			"fixture-plugin": {
+				ResourceLimits: config.ResourceLimits{
+					AddressSpace: schema.PointerTo(int64(8 << 30)),
+					CoreSize:     schema.PointerTo(int64(0)),
+				},
+			},
+			"other-plugin": {
+				ResourceLimits: config.ResourceLimits{
+					OpenFiles: schema.PointerTo(int64(32)),
+				},
+			},
+		},
+	}
+	wrap, moduleName := PullFixture(t, cfg)
+
+	_, stdout, _, _, deployCommand, err := wrap.Deploy(moduleName, t.TempDir(), nil, "")
+	assert.NoError(t, err)
+	process := ReadFixtureProcess(t, stdout, deployCommand)
+	assert.Equals(t, process.Rlimits["RLIMIT_AS"], int64(8<<30))
+	assert.Equals(t, process.Rlimits["RLIMIT_CPU"], int64(2))
+	assert.Equals(t, process.Rlimits["RLIMIT_NOFILE"], int64(64))
+	assert.Equals(t, process.Rlimits["RLIMIT_CORE"], int64(0))
+}
+
+func Test_PluginEnvironment(t *testing.T) {
+	environ := []string{
+		"PATH=/usr/bin",
+		"HOME=/home/engine",
+		"LC_ALL=C.UTF-8",
+		"ENGINE_TOKEN=secret",
+		"AWS_SECRET_ACCESS_KEY=secret",
+	}
+	testCases := map[string]struct {
+		pluginEnv config.PluginEnvironment
+		module    config.ModuleSettings
+		expected  []string
+	}{
+		"default_allowlist": {
+			config.PluginEnvironment{Inherit: config.DefaultPluginEnvironmentInherit},
+			config.ModuleSettings{},
+			[]string{
+				"HOME=/home/engine",
+				"LC_ALL=C.UTF-8",
+				"PATH=/venv/bin:/usr/bin",
+				"VIRTUAL_ENV=/venv",
+			},
+		},
+		"nothing_inherited": {
+			config.PluginEnvironment{},
+			config.ModuleSettings{Environment: map[string]string{"PLUGIN_MODE": "fast"}},
+			[]string{
+				"PLUGIN_MODE=fast",
+				"PATH=/venv/bin:/usr/local/bin:/usr/bin:/bin",
+				"VIRTUAL_ENV=/venv",
+			},
+		},
+		"module_variables": {
+			config.PluginEnvironment{Inherit: []string{"PATH", "HOME"}},
+			config.ModuleSettings{Environment: map[string]string{"HOME": "/tmp", "PATH": "/opt/bin"}},
+			[]string{
+				"HOME=/tmp",
+				"PATH=/venv/bin:/opt/bin",
+				"VIRTUAL_ENV=/venv",
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			cfg := &config.Config{PluginEnvironment: tc.pluginEnv}
+			assert.Equals(t, cliwrapper.PluginEnvironment(cfg, tc.module, "/venv", environ), tc.expected)
+		})
+	}
+}
+
+// Test the function Deploy starts the plugin with a clean environment, made
+// of the allowed variables of the engine, the variables of the deployer and
+// the module, and the activated venv.
+func Test_Deploy_Environment(t *testing.T) {
+	t.Setenv("ARCAFLOW_TEST_SECRET", "secret")
+	t.Setenv("ARCAFLOW_TEST_ALLOWED", "allowed")
+	cfg := &config.Config{
+		PluginEnvironment: config.PluginEnvironment{
+			Inherit:   append([]string{"ARCAFLOW_TEST_ALLOWED"}, config.DefaultPluginEnvironmentInherit...),
+			Variables: map[string]string{"DEPLOYER_VARIABLE": "deployer", "OVERRIDDEN": "deployer"},
+		},
+		Modules: map[string]config.ModuleSettings{
+			"fixture-plugin": {Environment: map[string]string{"OVERRIDDEN": "module"}},
+		},
+	}
+	wrap, moduleName := PullFixture(t, cfg)
+	modulePath, err := wrap.GetModulePath(moduleName)
+	assert.NoError(t, err)
+	// the plugin runs from the venv the module links to
+	venvPath, err := filepath.EvalSymlinks(filepath.Join(*modulePath, "venv"))
+	assert.NoError(t, err)
+
+	_, stdout, _, _, deployCommand, err := wrap.Deploy(moduleName, t.TempDir(), nil, "")
+	assert.NoError(t, err)
+	process := ReadFixtureProcess(t, stdout, deployCommand)
+	_, leaked := process.Environ["ARCAFLOW_TEST_SECRET"]
+	assert.Equals(t, leaked, false)
+	assert.Equals(t, process.Environ["ARCAFLOW_TEST_ALLOWED"], "allowed")
+	assert.Equals(t, process.Environ["DEPLOYER_VARIABLE"], "deployer")
+	assert.Equals(t, process.Environ["OVERRIDDEN"], "module")
+	assert.Equals(t, process.Environ["VIRTUAL_ENV"], venvPath)
+	assert.Equals(t, strings.HasPrefix(process.Environ["PATH"], filepath.Join(venvPath, "bin")+":"), true)
+}
+
+// SkipWithoutUserNamespaces skips a test on hosts where unprivileged user
+// namespaces are disabled.
+func SkipWithoutUserNamespaces(t *testing.T) {
+	cmd := exex.Command("true")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+	}
+	if err := cmd.Run(); err != nil {
+		t.Skipf("unprivileged user namespaces are unavailable on this host (%s)", err)
+	}
+}
+
+// Test the function Deploy only blames user namespaces for the failures to
+// start a plugin in new namespaces that they can cause.
+func Test_Deploy_NamespacedStartError(t *testing.T) {
+	SkipWithoutUserNamespaces(t)
+	cfg := &config.Config{
+		Modules: map[string]config.ModuleSettings{"fixture-plugin": {Network: config.NetworkNone}},
+	}
+	wrap, moduleName := PullFixture(t, cfg)
+	modulePath, err := wrap.GetModulePath(moduleName)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Remove(filepath.Join(*modulePath, "venv/bin/python")))
+
+	_, _, _, _, _, err = wrap.Deploy(moduleName, t.TempDir(), nil, "")
+	assert.Error(t, err)
+	assert.Equals(t, errors.Is(err, syscall.ENOENT), true)
+	assert.Equals(t, strings.Contains(err.Error(), "user namespaces"), false)
+}
+
+// Test the function Deploy runs the plugin in a sandbox, where it only sees
+// the system, its venv and its plugin directory, and can only write to its
+// plugin directory and /tmp.
+func Test_Deploy_Sandbox(t *testing.T) {
+	SkipWithoutUserNamespaces(t)
+	for name, privateNetwork := range map[string]bool{"host_network": false, "private_network": true} {
+		t.Run(name, func(t *testing.T) {
+			pluginDir := t.TempDir()
+			pluginFile := filepath.Join(pluginDir, "input.yaml")
+			assert.NoError(t, os.WriteFile(pluginFile, []byte("{}"), 0600))
+			hiddenFile := filepath.Join(t.TempDir(), "hidden")
+			assert.NoError(t, os.WriteFile(hiddenFile, []byte("secret"), 0600))
+			cfg := &config.Config{
+				Sandbox: config.Sandbox{Enabled: true, PrivateNetwork: privateNetwork},
+				PluginEnvironment: config.PluginEnvironment{
+					Inherit:   config.DefaultPluginEnvironmentInherit,
+					Variables: map[string]string{"FIXTURE_PROBE_PATHS": pluginFile + ":" + hiddenFile},
+				},
+			}
+			wrap, moduleName := PullFixture(t, cfg)
+
+			_, stdout, _, _, deployCommand, err := wrap.Deploy(moduleName, pluginDir, nil, "")
+			assert.NoError(t, err)
+			process := ReadFixtureProcess(t, stdout, deployCommand)
+			// the plugin runs under the launcher, the init of the PID namespace
+			assert.Equals(t, process.PID, 2)
+			assert.Equals(t, process.UID, os.Getuid())
+			assert.Equals(t, process.Visible, map[string]bool{pluginFile: true, hiddenFile: false})
+			assert.Equals(t, process.Writable, map[string]bool{"cwd": true, "tmp": true, "venv": false})
+			assert.Equals(t, process.Environ["HOME"], pluginDir)
+			if privateNetwork {
+				assert.Equals(t, process.Interfaces, []string{"lo"})
+			} else {
+				assert.Equals(t, len(process.Interfaces) > 1, true)
+			}
+		})
+	}
+}
+
+// Test the function Deploy restricts the plugin to reading the system, its
+// venv and its plugin directory, and to writing to its plugin directory,
+// with Landlock.
+func Test_Deploy_Landlock(t *testing.T) {
+	if _, err := cliwrapper.LandlockABI(); err != nil {
+		t.Skipf("Landlock is unavailable on this host (%s)", err)
+	}
+	pluginDir := t.TempDir()
+	pluginFile := filepath.Join(pluginDir, "input.yaml")
+	assert.NoError(t, os.WriteFile(pluginFile, []byte("{}"), 0600))
+	hiddenFile := filepath.Join(t.TempDir(), "hidden")
+	assert.NoError(t, os.WriteFile(hiddenFile, []byte("secret"), 0600))
+	cfg := &config.Config{
+		Sandbox: config.Sandbox{Landlock: config.Landlock{Enabled: true, Required: true}},
+		PluginEnvironment: config.PluginEnvironment{
+			Inherit:   config.DefaultPluginEnvironmentInherit,
+			Variables: map[string]string{"FIXTURE_PROBE_PATHS": pluginFile + ":" + hiddenFile},
+		},
+	}
+	wrap, moduleName := PullFixture(t, cfg)
+
+	_, stdout, _, _, deployCommand, err := wrap.Deploy(moduleName, pluginDir, nil, "")
+	assert.NoError(t, err)
+	process := ReadFixtureProcess(t, stdout, deployCommand)
+	assert.Equals(t, process.Readable, map[string]bool{pluginFile: true, hiddenFile: false})
+	assert.Equals(t, process.Writable, map[string]bool{"cwd": true, "tmp": false, "venv": false})
+	assert.Equals(t, process.Environ["TMPDIR"], pluginDir)
+}
+
+// Test the function Deploy applies the PYTHON* variables of a module to the
+// interpreter of the plugin, with or without the launcher.
+func Test_Deploy_PythonVariables(t *testing.T) {
+	testCases := map[string]config.ResourceLimits{
+		"plain":    {},
+		"launcher": {OpenFiles: schema.PointerTo(int64(123))},
+	}
+	for name, limits := range testCases {
+		localLimits := limits
+		t.Run(name, func(t *testing.T) {
+			pythonPath := t.TempDir()
+			cfg := &config.Config{
+				ResourceLimits: localLimits,
+				PluginEnvironment: config.PluginEnvironment{
+					Inherit: config.DefaultPluginEnvironmentInherit,
+				},
+				Modules: map[string]config.ModuleSettings{
+					"fixture-plugin": {Environment: map[string]string{
+						"PYTHONHASHSEED":          "0",
+						"PYTHONDONTWRITEBYTECODE": "1",
+						"PYTHONWARNINGS":          "error::DeprecationWarning",
+						"PYTHONIOENCODING":        "iso8859-1",
+						"PYTHONPATH":              pythonPath,
+					}},
+				},
+			}
+			wrap, moduleName := PullFixture(t, cfg)
+			_, stdout, _, _, deployCommand, err := wrap.Deploy(moduleName, t.TempDir(), nil, "")
+			assert.NoError(t, err)
+			process := ReadFixtureProcess(t, stdout, deployCommand)
+			assert.Equals(t, process.Interpreter.HashRandomization, 0)
+			assert.Equals(t, process.Interpreter.DontWriteBytecode, true)
+			assert.Equals(t, process.Interpreter.WarnOptions, []string{"error::DeprecationWarning"})
+			assert.Equals(t, process.Interpreter.StdoutEncoding, "iso8859-1")
+			assert.Equals(t, process.Environ["PYTHONPATH"], pythonPath)
+			assert.Equals(t, slices.Contains(process.SysPath, pythonPath), true)
+			assert.Equals(t, process.Rlimits["RLIMIT_NOFILE"] == 123, localLimits.OpenFiles != nil)
+		})
+	}
+}
+
+// Test the function Deploy only runs the .pth files of the venv once the
+// settings of the plugin are applied, so that they cannot escape them, and
+// still applies PYTHONPATH.
+func Test_Deploy_PthAfterSettings(t *testing.T) {
+	if _, err := cliwrapper.LandlockABI(); err != nil {
+		t.Skipf("Landlock is unavailable on this host (%s)", err)
+	}
+	pluginDir := t.TempDir()
+	escapePath := filepath.Join(t.TempDir(), "escaped")
+	pythonPath := t.TempDir()
+	cfg := &config.Config{
+		ResourceLimits: config.ResourceLimits{OpenFiles: schema.PointerTo(int64(123))},
+		Sandbox:        config.Sandbox{Landlock: config.Landlock{Enabled: true, Required: true}},
+		PluginEnvironment: config.PluginEnvironment{
+			Inherit: config.DefaultPluginEnvironmentInherit,
+			Variables: map[string]string{
+				"FIXTURE_PTH_ESCAPE": escapePath,
+				"PYTHONPATH":         pythonPath,
+			},
+		},
+	}
+	wrap, moduleName := PullFixture(t, cfg)
+	modulePath, err := wrap.GetModulePath(moduleName)
+	assert.NoError(t, err)
+	venvPath, err := filepath.EvalSymlinks(filepath.Join(*modulePath, "venv"))
+	assert.NoError(t, err)
+	sitePackages, err := filepath.Glob(filepath.Join(venvPath, "lib/python*/site-packages"))
+	assert.NoError(t, err)
+	assert.Equals(t, len(sitePackages), 1)
+	// a package running code at interpreter startup, which tries to write
+	// outside of the plugin directory
+	assert.NoError(t, os.WriteFile(filepath.Join(sitePackages[0], "fixture_pth.py"), []byte(`
+import os, resource
+try:
+    open(os.environ["FIXTURE_PTH_ESCAPE"], "w").close()
+    result = "escaped"
+except OSError as e:
+    result = type(e).__name__
+with open("pth-result", "w") as f:
+    f.write("%s %d" % (result, resource.getrlimit(resource.RLIMIT_NOFILE)[0]))
+`), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(sitePackages[0], "fixture_pth.pth"), []byte("import fixture_pth\n"), 0600))
+
+	_, stdout, _, _, deployCommand, err := wrap.Deploy(moduleName, pluginDir, nil, "")
+	assert.NoError(t, err)
+	process := ReadFixtureProcess(t, stdout, deployCommand)
+	result, err := os.ReadFile(filepath.Join(pluginDir, "pth-result"))
+	assert.NoError(t, err)
+	assert.Equals(t, string(result), "PermissionError 123")
+	_, err = os.Stat(escapePath)
+	assert.Equals(t, os.IsNotExist(err), true)
+	assert.Equals(t, slices.Contains(process.SysPath, pythonPath), true)
+	assert.Equals(t, slices.Contains(process.SysPath, sitePackages[0]), true)
+}
+
+// Test the function Deploy filters the system calls of the plugin with the
+// default seccomp profile, which lets CPython run, and kills the plugin when
+// it makes a blocked system call, after it reported which one, even if it
+// tries to handle SIGSYS.
+func Test_Deploy_Seccomp(t *testing.T) {
+	if _, err := seccomp.DefaultProfile().Compile(); err != nil {
+		t.Skipf("seccomp profiles are unavailable on this host (%s)", err)
+	}
+	cfg := &config.Config{
+		Sandbox: config.Sandbox{Seccomp: config.Seccomp{Enabled: true}},
+		PluginEnvironment: config.PluginEnvironment{
+			Inherit: config.DefaultPluginEnvironmentInherit,
+		},
+		Modules: map[string]config.ModuleSettings{},
+	}
+	wrap, moduleName := PullFixture(t, cfg)
+
+	t.Run("allowed", func(t *testing.T) {
+		_, stdout, _, _, deployCommand, err := wrap.Deploy(moduleName, t.TempDir(), nil, "")
+		assert.NoError(t, err)
+		process := ReadFixtureProcess(t, stdout, deployCommand)
+		assert.Equals(t, process.Argv, []string{"--atp"})
+	})
+	t.Run("blocked", func(t *testing.T) {
+		cfg.Modules["fixture-plugin"] = config.ModuleSettings{Environment: map[string]string{"FIXTURE_PTRACE": "1"}}
+		_, stdout, stderr, _, deployCommand, err := wrap.Deploy(moduleName, t.TempDir(), nil, "")
+		assert.NoError(t, err)
+		output, err := io.ReadAll(stdout)
+		assert.NoError(t, err)
+		assert.Equals(t, string(output), "hello from fixture\n")
+		errOutput, err := io.ReadAll(stderr)
+		assert.NoError(t, err)
+		ptrace, _ := seccomp.SyscallNumber("ptrace")
+		assert.Contains(t, string(errOutput), fmt.Sprintf("seccomp profile blocked system call %d\n", ptrace))
+		var exitErr *exex.ExitError
+		assert.Equals(t, errors.As(deployCommand.Wait(), &exitErr), true)
+		status := exitErr.Sys().(syscall.WaitStatus)
+		assert.Equals(t, status.Signaled(), true)
+		assert.Equals(t, status.Signal(), syscall.SIGSYS)
+	})
+	t.Run("blocked_sandboxed", func(t *testing.T) {
+		SkipWithoutUserNamespaces(t)
+		cfg.Sandbox.Enabled = true
+		cfg.Modules["fixture-plugin"] = config.ModuleSettings{Environment: map[string]string{"FIXTURE_PTRACE": "1"}}
+		_, stdout, stderr, _, deployCommand, err := wrap.Deploy(moduleName, t.TempDir(), nil, "")
+		assert.NoError(t, err)
+		_, err = io.ReadAll(stdout)
+		assert.NoError(t, err)
+		errOutput, err := io.ReadAll(stderr)
+		assert.NoError(t, err)
+		ptrace, _ := seccomp.SyscallNumber("ptrace")
+		assert.Contains(t, string(errOutput), fmt.Sprintf("seccomp profile blocked system call %d\n", ptrace))
+		var exitErr *exex.ExitError
+		assert.Equals(t, errors.As(deployCommand.Wait(), &exitErr), true)
+		// the launcher, the init of the sandbox, exits with 128 + signal
+		assert.Equals(t, exitErr.ExitCode(), 128+int(syscall.SIGSYS))
+	})
+}
+
+// Test the function Deploy runs the plugins with no network in an empty
+// network namespace, where connecting anywhere but loopback fails with a
+// permission error, with or without the sandbox.
+func Test_Deploy_NetworkNone(t *testing.T) {
+	SkipWithoutUserNamespaces(t)
+	for name, sandboxed := range map[string]bool{"unsandboxed": false, "sandboxed": true} {
+		t.Run(name, func(t *testing.T) {
+			cfg := &config.Config{
+				Sandbox: config.Sandbox{Enabled: sandboxed},
+				Network: config.NetworkHost,
+				PluginEnvironment: config.PluginEnvironment{
+					Inherit: config.DefaultPluginEnvironmentInherit,
+					// a documentation address, which no route ever leads to
+					Variables: map[string]string{"FIXTURE_CONNECT": "192.0.2.1:443"},
+				},
+				Modules: map[string]config.ModuleSettings{
+					"fixture-plugin": {Network: config.NetworkNone},
+				},
+			}
+			wrap, moduleName := PullFixture(t, cfg)
+
+			_, stdout, _, _, deployCommand, err := wrap.Deploy(moduleName, t.TempDir(), nil, "")
+			assert.NoError(t, err)
+			process := ReadFixtureProcess(t, stdout, deployCommand)
+			assert.Equals(t, process.ConnectError, "PermissionError: [Errno 13] Permission denied")
+			assert.Equals(t, process.Loopback, true)
+			assert.Equals(t, process.Interfaces, []string{"lo"})
+			assert.Equals(t, process.UID, os.Getuid())
+		})
+	}
+}
+
+func Test_ModuleSettings_Network(t *testing.T) {
+	testCases := map[string]struct {
+		cfg      config.Config
+		expected config.Network
+	}{
+		"default": {
+			config.Config{},
+			config.NetworkHost,
+		},
+		"deployer": {
+			config.Config{Network: config.NetworkNone},
+			config.NetworkNone,
+		},
+		"module": {
+			config.Config{
+				Network: config.NetworkNone,
+				Modules: map[string]config.ModuleSettings{"fixture-plugin": {Network: config.NetworkHost}},
+			},
+			config.NetworkHost,
+		},
+		"sandbox_private_network": {
+			config.Config{Sandbox: config.Sandbox{Enabled: true, PrivateNetwork: true}},
+			config.NetworkNone,
+		},
+		"sandbox_private_network_overridden": {
+			config.Config{Sandbox: config.Sandbox{Enabled: true, PrivateNetwork: true}, Network: config.NetworkHost},
+			config.NetworkHost,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			moduleSettings, err := cliwrapper.ModuleSettings(
+				&tc.cfg, "fixture-plugin@git+https://github.com/arcalot/fixture-plugin.git")
+			assert.NoError(t, err)
+			assert.Equals(t, moduleSettings.Network, tc.expected)
+		})
+	}
+}
+
+// MakeSearchable makes the directories above path searchable by everyone,
+// up to the temporary directory.
+func MakeSearchable(t *testing.T, path string) {
+	for dir := filepath.Dir(path); dir != os.TempDir() && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		assert.NoError(t, err)
+		assert.NoError(t, os.Chmod(dir, info.Mode().Perm()|0111))
+	}
+}
+
+// Test the function Deploy runs the plugin as the plugin user, which gets
+// its plugin directory and can read its venv, with or without namespaces.
+func Test_Deploy_PluginUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skipf("running plugins as another user needs root")
+	}
+	// the interpreter must be accessible to the plugin user, unlike one in
+	// the home directory of root
+	if _, err := os.Stat("/usr/bin/python3"); err != nil {
+		t.Skipf("no system python interpreter (%s)", err)
+	}
+	t.Setenv("PATH", "/usr/bin:"+os.Getenv("PATH"))
+	for name, sandboxed := range map[string]bool{"unsandboxed": false, "sandboxed": true} {
+		t.Run(name, func(t *testing.T) {
+			if sandboxed {
+				SkipWithoutUserNamespaces(t)
+			}
+			cfg := &config.Config{
+				Sandbox: config.Sandbox{Enabled: sandboxed},
+				PluginUser: config.PluginUser{
+					UID:    schema.PointerTo(int64(4242)),
+					GID:    schema.PointerTo(int64(4243)),
+					Groups: []int64{4244, 4243},
+				},
+				PluginEnvironment: config.PluginEnvironment{Inherit: config.DefaultPluginEnvironmentInherit},
+			}
+			// a venv only its owner can read, until a deployment grants access to it
+			umask := syscall.Umask(0077)
+			wrap, moduleName := PullFixture(t, cfg)
+			syscall.Umask(umask)
+			modulePath, err := wrap.GetModulePath(moduleName)
+			assert.NoError(t, err)
+			venvPath, err := filepath.EvalSymlinks(filepath.Join(*modulePath, "venv"))
+			assert.NoError(t, err)
+			pluginDir := t.TempDir()
+
+			// the directories above the venv and the plugin directory are left alone
+			_, _, _, _, _, err = wrap.Deploy(moduleName, pluginDir, nil, "")
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "is not searchable by it")
+
+			MakeSearchable(t, venvPath)
+			MakeSearchable(t, pluginDir)
+			// every deployment makes the venv readable by the plugin user
+			activatePath := filepath.Join(venvPath, "bin/activate")
+			assert.NoError(t, os.Chmod(activatePath, 0600))
+			_, stdout, _, _, deployCommand, err := wrap.Deploy(moduleName, pluginDir, nil, "")
+			assert.NoError(t, err)
+			process := ReadFixtureProcess(t, stdout, deployCommand)
+			assert.Equals(t, process.UID, 4242)
+			assert.Equals(t, process.GID, 4243)
+			if !sandboxed {
+				// in namespaces, the supplementary groups are not mapped
+				assert.Equals(t, process.Groups, []int{4243, 4244})
+			}
+			assert.Equals(t, process.Writable["cwd"], true)
+			assert.Equals(t, process.Writable["venv"], false)
+			assert.Equals(t, process.Environ["HOME"], pluginDir)
+			info, err := os.Stat(activatePath)
+			assert.NoError(t, err)
+			assert.Equals(t, info.Mode().Perm(), os.FileMode(0640))
+		})
+	}
+}
+
+// ReadAuditEvents reads the events reported by the audit hook of the
+// deployed fixture plugin, once it exited, and returns their details by
+// event and action.
+func ReadAuditEvents(t *testing.T, audit io.Reader) map[string][]string {
+	output, err := io.ReadAll(audit)
+	assert.NoError(t, err)
+	details := map[string][]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		var event cliwrapper.AuditEvent
+		assert.NoError(t, json.Unmarshal([]byte(line), &event))
+		key := event.Event + " " + string(event.Action)
+		details[key] = append(details[key], event.Detail)
+	}
+	return details
+}
+
+// Test the function Deploy installs the audit hook in the plugin and its
+// python subprocesses, which logs or blocks the events of the plugin
+// according to the policy, and reports them to the deployer.
+func Test_Deploy_AuditHook(t *testing.T) {
+	// a file outside of the plugin directory, visible in the sandbox
+	const outsidePath = "/etc/passwd"
+	blocked := func(event string, detail string) string {
+		return fmt.Sprintf("PermissionError: %s blocked by the audit policy of the plugin (%s)", event, detail)
+	}
+	t.Run("log", func(t *testing.T) {
+		cfg := &config.Config{
+			AuditHook: config.AuditHook{Enabled: true},
+			PluginEnvironment: config.PluginEnvironment{
+				Inherit:   config.DefaultPluginEnvironmentInherit,
+				Variables: map[string]string{"FIXTURE_AUDIT_OPEN": outsidePath},
+			},
+		}
+		wrap, moduleName := PullFixture(t, cfg)
+		pluginDir := t.TempDir()
+
+		_, stdout, _, audit, deployCommand, err := wrap.Deploy(moduleName, pluginDir, nil, "")
+		assert.NoError(t, err)
+		assert.NotNil(t, audit)
+		process := ReadFixtureProcess(t, stdout, deployCommand)
+		assert.Equals(t, process.Audit, map[string]string{
+			"subprocess.Popen": "",
+			"os.system":        "",
+			"socket.connect":   "",
+			"open":             "",
+			"child":            "",
+		})
+		events := ReadAuditEvents(t, audit)
+		assert.Equals(t, slices.Contains(events["subprocess.Popen log"], "true"), true)
+		assert.Equals(t, slices.Contains(events["os.system log"], "true"), true)
+		assert.Equals(t, slices.Contains(events["open log"], outsidePath), true)
+		assert.Equals(t, len(events["socket.connect log"]) > 0, true)
+		assert.Equals(t, len(events["open block"]), 0)
+		for _, path := range events["open log"] {
+			// the plugin directory and the interpreter are not audited
+			assert.Equals(t, strings.HasPrefix(path, pluginDir), false)
+			assert.Equals(t, strings.HasSuffix(path, ".py"), false)
+		}
+		// the launcher tells the python subprocesses about the hook
+		assert.Contains(t, process.Environ["PYTHONPATH"], "arcaflow-audit")
+	})
+	for name, sandboxed := range map[string]bool{"block": false, "block_sandboxed": true} {
+		t.Run(name, func(t *testing.T) {
+			if sandboxed {
+				SkipWithoutUserNamespaces(t)
+			}
+			cfg := &config.Config{
+				Sandbox: config.Sandbox{
+					Enabled:  sandboxed,
+					Landlock: config.Landlock{Enabled: sandboxed},
+					Seccomp:  config.Seccomp{Enabled: sandboxed},
+				},
+				AuditHook: config.AuditHook{
+					Enabled: true,
+					Events: config.AuditEvents{
+						Subprocess: config.AuditActionLog,
+						System:     config.AuditActionBlock,
+						Connect:    config.AuditActionBlock,
+						Open:       config.AuditActionBlock,
+					},
+				},
+				PluginEnvironment: config.PluginEnvironment{
+					Inherit:   config.DefaultPluginEnvironmentInherit,
+					Variables: map[string]string{"FIXTURE_AUDIT_OPEN": outsidePath},
+				},
+			}
+			wrap, moduleName := PullFixture(t, cfg)
+
+			_, stdout, _, audit, deployCommand, err := wrap.Deploy(moduleName, t.TempDir(), nil, "")
+			assert.NoError(t, err)
+			process := ReadFixtureProcess(t, stdout, deployCommand)
+			assert.Equals(t, process.Audit["subprocess.Popen"], "")
+			assert.Equals(t, process.Audit["os.system"], blocked("os.system", "true"))
+			assert.Contains(t, process.Audit["socket.connect"], "PermissionError: socket.connect blocked")
+			assert.Equals(t, process.Audit["open"], blocked("open", outsidePath))
+			// python subprocesses enforce the policy without reporting to the deployer
+			assert.Equals(t, process.Audit["child"], blocked("open", outsidePath))
+			assert.Equals(t, process.Loopback, false)
+			assert.Equals(t, process.Writable["cwd"], true)
+			events := ReadAuditEvents(t, audit)
+			assert.Equals(t, slices.Contains(events["os.system block"], "true"), true)
+			assert.Equals(t, slices.Contains(events["open block"], outsidePath), true)
+		})
+	}
+	t.Run("block_symlink", func(t *testing.T) {
+		pluginDir := t.TempDir()
+		linkPath := filepath.Join(pluginDir, "passwd")
+		assert.NoError(t, os.Symlink(outsidePath, linkPath))
+		cfg := &config.Config{
+			AuditHook: config.AuditHook{
+				Enabled: true,
+				Events:  config.AuditEvents{Open: config.AuditActionBlock},
+			},
+			PluginEnvironment: config.PluginEnvironment{
+				Inherit:   config.DefaultPluginEnvironmentInherit,
+				Variables: map[string]string{"FIXTURE_AUDIT_OPEN": linkPath},
+			},
+		}
+		wrap, moduleName := PullFixture(t, cfg)
+
+		_, stdout, _, audit, deployCommand, err := wrap.Deploy(moduleName, pluginDir, nil, "")
+		assert.NoError(t, err)
+		process := ReadFixtureProcess(t, stdout, deployCommand)
+		// the link is in the plugin directory, the file it opens is not
+		assert.Equals(t, process.Audit["open"], blocked("open", outsidePath))
+		assert.Equals(t, process.Audit["child"], blocked("open", outsidePath))
+		events := ReadAuditEvents(t, audit)
+		assert.Equals(t, slices.Contains(events["open block"], outsidePath), true)
+	})
 }
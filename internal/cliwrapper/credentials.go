@@ -0,0 +1,96 @@
+package cliwrapper
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.flow.arcalot.io/pythondeployer/internal/config"
+)
+
+// tokenUsername is the user name sent along with access tokens, which is
+// accepted by the common git hosts.
+const tokenUsername = "x-access-token"
+
+// GitCredentialsEnvironment returns the environment variables that make git
+// use the given credentials, to be merged into environ. The configuration
+// entries already passed to git in environ through GIT_CONFIG_COUNT are kept,
+// and the credentials are appended to them. Secrets are only referenced by
+// path, so that they never end up in the environment of the pull
+// subprocesses, such as a module's build backend, or in the module's virtual
+// environment.
+func GitCredentialsEnvironment(credentials config.GitCredentials, environ []string) map[string]string {
+	var gitConfig [][2]string
+	if credentials.Helper != "" {
+		gitConfig = append(gitConfig, [2]string{"credential.helper", credentials.Helper})
+	}
+	hosts := make([]string, 0, len(credentials.TokenFiles))
+	for host := range credentials.TokenFiles {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		gitConfig = append(gitConfig, [2]string{
+			"credential.https://" + host + ".helper",
+			tokenFileHelper(credentials.TokenFiles[host]),
+		})
+	}
+
+	env := make(map[string]string)
+	if len(gitConfig) > 0 {
+		// git reads these in addition to its configuration files
+		first := gitConfigCount(environ)
+		env["GIT_CONFIG_COUNT"] = strconv.Itoa(first + len(gitConfig))
+		for i, keyValue := range gitConfig {
+			env["GIT_CONFIG_KEY_"+strconv.Itoa(first+i)] = keyValue[0]
+			env["GIT_CONFIG_VALUE_"+strconv.Itoa(first+i)] = keyValue[1]
+		}
+	}
+	if credentials.SSHKeyFile != "" || credentials.SSHKnownHostsFile != "" {
+		env["GIT_SSH_COMMAND"] = sshCommand(credentials)
+	}
+	return env
+}
+
+// gitConfigCount returns the number of configuration entries passed to git
+// in environ, or 0 if GIT_CONFIG_COUNT is unset or invalid, in which case git
+// would not read them anyway.
+func gitConfigCount(environ []string) int {
+	count := 0
+	for _, variable := range environ {
+		if value, found := strings.CutPrefix(variable, "GIT_CONFIG_COUNT="); found {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				parsed = 0
+			}
+			count = parsed
+		}
+	}
+	return count
+}
+
+// tokenFileHelper returns an inline git credential helper answering with
+// the token stored in tokenFile, which is only read when git asks for it.
+func tokenFileHelper(tokenFile string) string {
+	return `!f() { test "$1" = get || return 0; ` +
+		`echo username=` + tokenUsername + `; ` +
+		`printf 'password=%s\n' "$(cat ` + shellQuote(tokenFile) + `)"; }; f`
+}
+
+// sshCommand returns the ssh command git uses for git+ssh:// repositories,
+// which never prompts, and refuses unknown hosts.
+func sshCommand(credentials config.GitCredentials) string {
+	command := []string{"ssh", "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=yes"}
+	if credentials.SSHKeyFile != "" {
+		command = append(command, "-o", "IdentitiesOnly=yes", "-i", shellQuote(credentials.SSHKeyFile))
+	}
+	if credentials.SSHKnownHostsFile != "" {
+		command = append(command, "-o", "UserKnownHostsFile="+shellQuote(credentials.SSHKnownHostsFile))
+	}
+	return strings.Join(command, " ")
+}
+
+// shellQuote quotes a string for use as a single word in a shell command.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
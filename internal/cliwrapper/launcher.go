@@ -0,0 +1,141 @@
+package cliwrapper
+
+import (
+	_ "embed"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"go.flow.arcalot.io/pythondeployer/internal/config"
+)
+
+// launcherScript runs a plugin module after applying the launcherSettings
+// passed as its first argument, which is how the settings that can only be
+// applied from inside the plugin process get there.
+//
+//go:embed launcher.py
+var launcherScript string
+
+// launcherSettings are passed to launcherScript as JSON.
+type launcherSettings struct {
+	// Module is the python module to run.
+	Module string `json:"module"`
+	// Args are the arguments of the module.
+	Args []string `json:"args"`
+	// Rlimits maps the names of the resource module constants to limits.
+	Rlimits map[string]int64 `json:"rlimits,omitempty"`
+	// Sandbox sets up the sandbox of the plugin, if it is sandboxed.
+	Sandbox *sandboxSettings `json:"sandbox,omitempty"`
+	// PrivateNetwork isolates the plugin in its new network namespace, where
+	// only loopback is reachable.
+	PrivateNetwork bool `json:"privateNetwork,omitempty"`
+	// UserNamespace gives up the privileges of the plugin in its namespaces,
+	// if it is started in new ones.
+	UserNamespace *userNamespaceSettings `json:"userNamespace,omitempty"`
+	// Landlock restricts the filesystem access of the plugin, if enabled.
+	Landlock *landlockSettings `json:"landlock,omitempty"`
+	// Seccomp filters the system calls of the plugin, if enabled.
+	Seccomp *seccompSettings `json:"seccomp,omitempty"`
+	// Audit installs the audit hook in the plugin, if enabled.
+	Audit *auditSettings `json:"audit,omitempty"`
+	// PythonPath is the PYTHONPATH of the plugin, if it has one, which the
+	// launcher applies once the other settings are.
+	PythonPath *string `json:"pythonPath,omitempty"`
+}
+
+// needed tells whether any of the settings can only be applied by the
+// launcher.
+func (s launcherSettings) needed() bool {
+	return len(s.Rlimits) > 0 || s.Sandbox != nil || s.PrivateNetwork || s.UserNamespace != nil ||
+		s.Landlock != nil || s.Seccomp != nil || s.Audit != nil
+}
+
+// launcherCommand returns the arguments of the python interpreter running
+// the module of settings, and the environment it runs in, from the
+// environment environ of the plugin. Without settings only the launcher can
+// apply, the interpreter runs the module with -m. Otherwise, it starts
+// without the site module, which the launcher loads once the settings are
+// applied, so that none of the code installed in the venv, such as .pth
+// files, runs before them. PYTHONPATH is passed on to the launcher, which
+// applies it along with the site module, and the other PYTHON* variables
+// apply to the interpreter as usual.
+func launcherCommand(settings launcherSettings, environ []string) ([]string, []string, error) {
+	if !settings.needed() {
+		return append([]string{"-m", settings.Module}, settings.Args...), environ, nil
+	}
+	env := make([]string, 0, len(environ))
+	for _, variable := range environ {
+		if value, found := strings.CutPrefix(variable, "PYTHONPATH="); found {
+			settings.PythonPath = &value
+			continue
+		}
+		env = append(env, variable)
+	}
+	settingsJSON, err := json.Marshal(settings)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []string{"-S", "-c", launcherScript, string(settingsJSON)}, env, nil
+}
+
+// ModuleSettings returns the settings of a python module, which are the
+// settings of the deployer overridden by the module's own settings.
+func ModuleSettings(cfg *config.Config, fullModuleName string) (config.ModuleSettings, error) {
+	pythonModule, err := parseModuleName(fullModuleName)
+	if err != nil {
+		return config.ModuleSettings{}, err
+	}
+	moduleSettings := cfg.Modules[*pythonModule.ModuleName]
+	environment := map[string]string{}
+	for name, value := range cfg.PluginEnvironment.Variables {
+		environment[name] = value
+	}
+	for name, value := range moduleSettings.Environment {
+		environment[name] = value
+	}
+	secrets := map[string]string{}
+	for name, path := range cfg.Secrets {
+		secrets[name] = path
+	}
+	for name, path := range moduleSettings.Secrets {
+		secrets[name] = path
+	}
+	network := moduleSettings.Network
+	if network == "" {
+		network = cfg.Network
+	}
+	if network == "" {
+		network = config.NetworkHost
+		if cfg.Sandbox.Enabled && cfg.Sandbox.PrivateNetwork {
+			network = config.NetworkNone
+		}
+	}
+	return config.ModuleSettings{
+		ResourceLimits: cfg.ResourceLimits.Merge(moduleSettings.ResourceLimits),
+		Environment:    environment,
+		Secrets:        secrets,
+		Network:        network,
+	}, nil
+}
+
+// rlimits maps resource limits to the names of the resource module constants.
+func rlimits(limits config.ResourceLimits) map[string]int64 {
+	result := map[string]int64{}
+	if limits.AddressSpace != nil {
+		result["RLIMIT_AS"] = *limits.AddressSpace
+	}
+	if limits.CPUTime != nil {
+		// round up, so that a limit below one second does not mean no limit
+		result["RLIMIT_CPU"] = int64((*limits.CPUTime + time.Second - 1) / time.Second)
+	}
+	if limits.OpenFiles != nil {
+		result["RLIMIT_NOFILE"] = *limits.OpenFiles
+	}
+	if limits.Processes != nil {
+		result["RLIMIT_NPROC"] = *limits.Processes
+	}
+	if limits.CoreSize != nil {
+		result["RLIMIT_CORE"] = *limits.CoreSize
+	}
+	return result
+}
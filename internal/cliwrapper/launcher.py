@@ -0,0 +1,409 @@
+# Runs a python plugin module the way "python -m" does, after applying the
+# settings of the python deployer to the plugin process. The settings are
+# passed as JSON in the first argument, and are removed from sys.argv before
+# the module runs. The interpreter starts without the site module, which is
+# only loaded once the settings are applied, along with PYTHONPATH, so that
+# the code of the venv, like .pth files, does not run before them.
+import importlib.util
+import json
+import os
+import resource
+import runpy
+import sys
+
+
+def apply_settings(settings):
+    for name, limit in settings.get("rlimits", {}).items():
+        hard = limit
+        if name == "RLIMIT_CPU":
+            # SIGXCPU is sent at the soft limit, SIGKILL at the hard limit
+            hard = limit + 1
+        try:
+            resource.setrlimit(getattr(resource, name), (limit, hard))
+        except (ValueError, OSError) as e:
+            sys.exit("error setting resource limit %s to %d (%s)" % (name, limit, e))
+    if "sandbox" in settings:
+        try:
+            enter_sandbox(settings["sandbox"])
+        except OSError as e:
+            sys.exit("error setting up the plugin sandbox (%s)" % e)
+    if settings.get("privateNetwork"):
+        try:
+            isolate_network()
+        except OSError as e:
+            sys.exit("error isolating the network of the plugin (%s)" % e)
+    if "userNamespace" in settings:
+        try:
+            drop_privileges(settings["userNamespace"])
+        except OSError as e:
+            sys.exit("error giving up the privileges of the plugin in its namespaces (%s)" % e)
+    if "landlock" in settings:
+        try:
+            restrict_filesystem(settings["landlock"])
+        except OSError as e:
+            sys.exit("error restricting the filesystem access of the plugin with Landlock (%s)" % e)
+    if "sandbox" in settings:
+        run_init()
+    if "seccomp" in settings:
+        try:
+            filter_syscalls(settings["seccomp"])
+        except OSError as e:
+            sys.exit("error installing the seccomp filter of the plugin (%s)" % e)
+    if "audit" in settings:
+        try:
+            install_audit_hook(settings["audit"])
+        except OSError as e:
+            sys.exit("error installing the audit hook of the plugin (%s)" % e)
+    sys.argv = [sys.argv[0]] + settings["args"]
+    return settings["module"]
+
+
+# The deployer starts the plugin process as root of a new user namespace, with
+# new mount, PID and IPC namespaces when it is sandboxed, and a new network
+# namespace when its network is private, which it sets up before giving up
+# its privileges.
+MS_RDONLY = 0x1
+MS_NOSUID = 0x2
+MS_NODEV = 0x4
+MS_NOEXEC = 0x8
+MS_REMOUNT = 0x20
+MS_NOATIME = 0x400
+MS_NODIRATIME = 0x800
+MS_BIND = 0x1000
+MS_REC = 0x4000
+MS_PRIVATE = 0x40000
+MS_RELATIME = 0x200000
+ST_RELATIME = 0x1000
+MNT_DETACH = 0x2
+CLONE_NEWUSER = 0x10000000
+SIOCGIFFLAGS = 0x8913
+SIOCSIFFLAGS = 0x8914
+IFF_UP = 0x1
+RTM_NEWROUTE = 24
+NLMSG_HDRLEN = 16
+NLM_F_REQUEST = 0x1
+NLM_F_ACK = 0x4
+NLM_F_EXCL = 0x200
+NLM_F_CREATE = 0x400
+RT_TABLE_MAIN = 254
+RTPROT_STATIC = 4
+RT_SCOPE_UNIVERSE = 0
+RTN_PROHIBIT = 8
+# pivot_root has no libc wrapper
+PIVOT_ROOT_SYSCALLS = {"x86_64": 155, "aarch64": 41, "ppc64le": 203, "s390x": 217}
+# the system directories the interpreter and the tools of plugins rely on
+SYSTEM_PATHS = ["/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/etc"]
+DEVICES = ["null", "zero", "full", "random", "urandom", "tty"]
+OLD_ROOT = "/.oldroot"
+
+
+def load_libc():
+    import ctypes
+
+    return ctypes.CDLL(None, use_errno=True)
+
+
+def check(result, description):
+    import ctypes
+
+    if result < 0:
+        errno = ctypes.get_errno()
+        raise OSError(errno, os.strerror(errno), description)
+    return result
+
+
+def enter_sandbox(sandbox):
+    import ctypes
+
+    libc = load_libc()
+
+    def mount(source, target, fstype, flags):
+        check(libc.mount(
+            source and source.encode(), target.encode(), fstype and fstype.encode(), ctypes.c_ulong(flags), None,
+        ), target)
+
+    def bind(source, target, writable):
+        if os.path.isdir(source):
+            os.makedirs(target, exist_ok=True)
+        else:
+            os.makedirs(os.path.dirname(target), exist_ok=True)
+            open(target, "a").close()
+        mount(source, target, None, MS_BIND | MS_REC)
+        if writable:
+            return
+        # the flags locked by the user namespace must be kept, or remounting fails
+        flags = os.statvfs(target).f_flag
+        locked = flags & (MS_NOSUID | MS_NODEV | MS_NOEXEC | MS_NOATIME | MS_NODIRATIME)
+        if flags & ST_RELATIME:
+            locked |= MS_RELATIME
+        mount(None, target, None, MS_BIND | MS_REMOUNT | MS_RDONLY | locked)
+
+    # the paths are resolved before the root changes, since the symlinks of
+    # the host do not resolve in the sandbox
+    symlinks = {}
+    binds = {}
+    for path in SYSTEM_PATHS:
+        if os.path.islink(path):
+            symlinks[path] = os.readlink(path)
+        elif os.path.isdir(path):
+            binds[path] = False
+    for path in [sys.base_prefix, sys.base_exec_prefix]:
+        binds.setdefault(os.path.realpath(path), False)
+    for bind_settings in sandbox["binds"]:
+        binds[os.path.realpath(bind_settings["path"])] = bind_settings["writable"]
+
+    pivot_root = PIVOT_ROOT_SYSCALLS.get(os.uname().machine)
+    if pivot_root is None:
+        raise OSError("pivot_root is not supported on %s" % os.uname().machine)
+    cwd = os.getcwd()
+    mount(None, "/", None, MS_REC | MS_PRIVATE)
+    # the new root is a tmpfs over /tmp, which pivot_root moves away again
+    mount("tmpfs", "/tmp", "tmpfs", MS_NOSUID | MS_NODEV)
+    os.mkdir("/tmp" + OLD_ROOT)
+    check(libc.syscall(pivot_root, b"/tmp", ("/tmp" + OLD_ROOT).encode()), "pivot_root")
+    os.chdir("/")
+
+    for path, target in symlinks.items():
+        os.symlink(target, path)
+    os.mkdir("/proc")
+    try:
+        mount("proc", "/proc", "proc", MS_NOSUID | MS_NODEV | MS_NOEXEC)
+    except OSError:
+        # a new proc cannot be mounted when parts of the host's are hidden,
+        # like in containers, but the PID namespace still isolates processes
+        bind(OLD_ROOT + "/proc", "/proc", True)
+    os.mkdir("/dev")
+    for device in DEVICES:
+        if os.path.exists(OLD_ROOT + "/dev/" + device):
+            bind(OLD_ROOT + "/dev/" + device, "/dev/" + device, True)
+    for name, target in [("fd", "/proc/self/fd"), ("stdin", "/proc/self/fd/0"),
+                         ("stdout", "/proc/self/fd/1"), ("stderr", "/proc/self/fd/2")]:
+        os.symlink(target, "/dev/" + name)
+    os.mkdir("/dev/shm")
+    mount("tmpfs", "/dev/shm", "tmpfs", MS_NOSUID | MS_NODEV)
+    os.mkdir("/tmp")
+    mount("tmpfs", "/tmp", "tmpfs", MS_NOSUID | MS_NODEV)
+    for path in sorted(binds):
+        bind(OLD_ROOT + path, path, binds[path])
+
+    check(libc.umount2(OLD_ROOT.encode(), MNT_DETACH), OLD_ROOT)
+    os.rmdir(OLD_ROOT)
+    mount(None, "/", None, MS_REMOUNT | MS_RDONLY | MS_NOSUID | MS_NODEV)
+    os.chdir(cwd)
+
+
+def isolate_network():
+    # The new network namespace has nothing but a loopback that is down.
+    # Loopback is brought up, and every other destination is routed to a
+    # prohibit route, so that connecting to it fails with a permission error
+    # rather than with an unreachable network.
+    import errno
+    import fcntl
+    import socket
+    import struct
+
+    with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as s:
+        request = struct.pack("16sH", b"lo", 0)
+        flags = struct.unpack_from("16sH", fcntl.ioctl(s, SIOCGIFFLAGS, request + bytes(22)))[1]
+        fcntl.ioctl(s, SIOCSIFFLAGS, struct.pack("16sH", b"lo", flags | IFF_UP) + bytes(22))
+    with socket.socket(socket.AF_NETLINK, socket.SOCK_RAW, socket.NETLINK_ROUTE) as s:
+        for sequence, family in enumerate([socket.AF_INET, socket.AF_INET6], 1):
+            rtmsg = struct.pack("=BBBBBBBBI", family, 0, 0, 0, RT_TABLE_MAIN, RTPROT_STATIC, RT_SCOPE_UNIVERSE,
+                                RTN_PROHIBIT, 0)
+            s.send(struct.pack("=IHHII", NLMSG_HDRLEN + len(rtmsg), RTM_NEWROUTE,
+                               NLM_F_REQUEST | NLM_F_ACK | NLM_F_EXCL | NLM_F_CREATE, sequence, 0) + rtmsg)
+            error = -struct.unpack_from("=i", s.recv(4096), NLMSG_HDRLEN)[0]
+            # hosts may have IPv6 disabled
+            if error != 0 and not (family == socket.AF_INET6 and error == errno.EAFNOSUPPORT):
+                raise OSError(error, os.strerror(error), "default route")
+
+
+def drop_privileges(user_namespace):
+    # the plugin keeps root privileges only in a nested user namespace, which
+    # owns none of the namespaces of the plugin
+    libc = load_libc()
+    check(libc.unshare(CLONE_NEWUSER), "unshare")
+    for file, content in [("setgroups", "deny"), ("uid_map", "%d 0 1" % user_namespace["uid"]),
+                          ("gid_map", "%d 0 1" % user_namespace["gid"])]:
+        with open("/proc/self/" + file, "w") as f:
+            f.write(content)
+
+
+# Landlock system calls have the same numbers on every architecture.
+SYS_LANDLOCK_CREATE_RULESET = 444
+SYS_LANDLOCK_ADD_RULE = 445
+SYS_LANDLOCK_RESTRICT_SELF = 446
+LANDLOCK_CREATE_RULESET_VERSION = 0x1
+LANDLOCK_RULE_PATH_BENEATH = 1
+PR_SET_NO_NEW_PRIVS = 38
+LANDLOCK_ACCESS_FS_EXECUTE = 1 << 0
+LANDLOCK_ACCESS_FS_WRITE_FILE = 1 << 1
+LANDLOCK_ACCESS_FS_READ_FILE = 1 << 2
+LANDLOCK_ACCESS_FS_READ_DIR = 1 << 3
+LANDLOCK_ACCESS_FS_TRUNCATE = 1 << 14
+LANDLOCK_ACCESS_FS_IOCTL_DEV = 1 << 15
+# the filesystem access rights each Landlock ABI version handles, later
+# versions added none
+LANDLOCK_ACCESS_FS = {1: (1 << 13) - 1, 2: (1 << 14) - 1, 3: (1 << 15) - 1, 4: (1 << 15) - 1, 5: (1 << 16) - 1}
+LANDLOCK_READ_ONLY = LANDLOCK_ACCESS_FS_EXECUTE | LANDLOCK_ACCESS_FS_READ_FILE | LANDLOCK_ACCESS_FS_READ_DIR
+# the access rights that apply to files rather than directories
+LANDLOCK_FILE_ACCESS = (LANDLOCK_ACCESS_FS_EXECUTE | LANDLOCK_ACCESS_FS_WRITE_FILE | LANDLOCK_ACCESS_FS_READ_FILE |
+                        LANDLOCK_ACCESS_FS_TRUNCATE | LANDLOCK_ACCESS_FS_IOCTL_DEV)
+
+
+def restrict_filesystem(landlock):
+    import struct
+
+    libc = load_libc()
+    abi = check(libc.syscall(SYS_LANDLOCK_CREATE_RULESET, None, 0, LANDLOCK_CREATE_RULESET_VERSION),
+                "landlock_create_ruleset")
+    handled = LANDLOCK_ACCESS_FS[min(abi, max(LANDLOCK_ACCESS_FS))]
+    rules = [(path, LANDLOCK_READ_ONLY) for path in SYSTEM_PATHS + [sys.base_prefix, sys.base_exec_prefix]]
+    rules += [(path, LANDLOCK_READ_ONLY) for path in landlock["readOnly"]]
+    rules += [(path, handled) for path in landlock["readWrite"]]
+    rules += [("/dev/" + device, handled) for device in DEVICES]
+
+    ruleset_attr = struct.pack("=Q", handled)
+    ruleset = check(libc.syscall(SYS_LANDLOCK_CREATE_RULESET, ruleset_attr, len(ruleset_attr), 0),
+                    "landlock_create_ruleset")
+    try:
+        for path, access in rules:
+            try:
+                path_fd = os.open(path, os.O_PATH | os.O_CLOEXEC)
+            except FileNotFoundError:
+                continue
+            try:
+                if not os.path.isdir(path):
+                    access &= LANDLOCK_FILE_ACCESS
+                path_beneath_attr = struct.pack("=Qi", access & handled, path_fd)
+                check(libc.syscall(SYS_LANDLOCK_ADD_RULE, ruleset, LANDLOCK_RULE_PATH_BENEATH, path_beneath_attr, 0),
+                      path)
+            finally:
+                os.close(path_fd)
+        # an unprivileged process can only restrict itself without new privileges
+        check(libc.prctl(PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0), "prctl")
+        check(libc.syscall(SYS_LANDLOCK_RESTRICT_SELF, ruleset, 0), "landlock_restrict_self")
+    finally:
+        os.close(ruleset)
+
+
+PR_SET_SECCOMP = 22
+SECCOMP_MODE_FILTER = 2
+SA_SIGINFO = 0x4
+SA_RESETHAND = 0x80000000
+# the offset of si_syscall in the siginfo of SIGSYS, on 64-bit architectures
+SIGINFO_SYSCALL_OFFSET = 24
+# the handler reporting blocked system calls must outlive apply_settings
+sigsys_handler = None
+
+
+def filter_syscalls(seccomp):
+    import ctypes
+    import signal
+
+    global sigsys_handler
+    libc = load_libc()
+
+    # The filter traps the system calls the profile kills, so that the plugin
+    # can report which one it made before it dies of SIGSYS. The filter keeps
+    # the plugin from replacing the handler, which the kernel resets before
+    # running it, and which only makes system calls a profile would have to
+    # allow for anything to run.
+    handler_type = ctypes.CFUNCTYPE(None, ctypes.c_int, ctypes.c_void_p, ctypes.c_void_p)
+
+    def report_blocked_syscall(signum, info, context, write=os.write, kill=libc.kill, getpid=libc.getpid):
+        syscall = ctypes.c_int.from_address(info + SIGINFO_SYSCALL_OFFSET).value
+        write(2, b"seccomp profile blocked system call %d\n" % syscall)
+        # SIGSYS is blocked until the handler returns, and then kills the process
+        kill(getpid(), signum)
+
+    class Sigaction(ctypes.Structure):
+        _fields_ = [("sa_sigaction", handler_type), ("sa_mask", ctypes.c_ubyte * 128),
+                    ("sa_flags", ctypes.c_int), ("sa_restorer", ctypes.c_void_p)]
+
+    class SockFilter(ctypes.Structure):
+        _fields_ = [("code", ctypes.c_ushort), ("jt", ctypes.c_ubyte), ("jf", ctypes.c_ubyte), ("k", ctypes.c_uint)]
+
+    class SockFprog(ctypes.Structure):
+        _fields_ = [("len", ctypes.c_ushort), ("filter", ctypes.POINTER(SockFilter))]
+
+    instructions = seccomp["filter"]
+    program = (SockFilter * len(instructions))(*[
+        SockFilter(insn["code"], insn["jt"], insn["jf"], insn["k"]) for insn in instructions
+    ])
+    prog = SockFprog(len(instructions), program)
+    sigsys_handler = handler_type(report_blocked_syscall)
+    action = Sigaction(sa_sigaction=sigsys_handler, sa_flags=SA_SIGINFO | SA_RESETHAND)
+    check(libc.sigaction(signal.SIGSYS, ctypes.byref(action), None), "sigaction")
+    # an unprivileged process can only install a filter without new privileges
+    check(libc.prctl(PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0), "prctl")
+    check(libc.prctl(PR_SET_SECCOMP, SECCOMP_MODE_FILTER, ctypes.byref(prog), 0, 0), "prctl")
+
+
+def run_init():
+    # The launcher is the init of the PID namespace, which ignores the signals
+    # it has no handler for, and kills the whole namespace when it exits. So
+    # the plugin runs in a child, while the launcher reaps the processes left
+    # behind by the plugin until the plugin exits.
+    import signal
+
+    plugin = os.fork()
+    if plugin == 0:
+        return
+    signal.signal(signal.SIGINT, signal.SIG_IGN)
+    devnull = os.open("/dev/null", os.O_RDWR)
+    os.dup2(devnull, 0)
+    os.dup2(devnull, 1)
+    while True:
+        pid, status = os.wait()
+        if pid == plugin:
+            break
+    # like shells do, a plugin killed by a signal exits with 128 + signal
+    if os.WIFSIGNALED(status):
+        os._exit(128 + os.WTERMSIG(status))
+    os._exit(os.WEXITSTATUS(status))
+
+
+# The audit hook is installed last, so that it only audits the plugin. The
+# python subprocesses of the plugin install it at startup, as their
+# sitecustomize, from the policy the plugin process passes on to them, which
+# also lets them report to the deployer if they inherited the report file
+# descriptor.
+def install_audit_hook(audit):
+    policy = audit["policy"]
+    report = os.fstat(audit["reportFd"])
+    policy["report"] = {"fd": audit["reportFd"], "device": report.st_dev, "inode": report.st_ino}
+    os.environ["ARCAFLOW_AUDIT_POLICY"] = json.dumps(policy)
+    python_path = [audit["path"]]
+    if os.environ.get("PYTHONPATH"):
+        python_path.append(os.environ["PYTHONPATH"])
+    os.environ["PYTHONPATH"] = os.pathsep.join(python_path)
+    spec = importlib.util.spec_from_file_location(
+        "arcaflow_audit_hook", os.path.join(audit["path"], "sitecustomize.py"))
+    spec.loader.exec_module(importlib.util.module_from_spec(spec))
+
+
+# The interpreter does not get PYTHONPATH, which is added to sys.path where
+# the interpreter would have put it, after the working directory and before
+# the site packages of the venv, which load_site adds along with its .pth
+# files and sitecustomize.
+def load_site(python_path):
+    sys.path[0:0] = [os.getcwd()] + [os.path.abspath(entry) for entry in python_path.split(os.pathsep) if entry]
+    import site
+    site.main()
+
+
+settings = json.loads(sys.argv[1])
+# -c puts the working directory first in sys.path, where load_site only puts
+# it once the settings are applied, like "python -m" would
+if sys.path and sys.path[0] == "":
+    del sys.path[0]
+if "pythonPath" in settings:
+    os.environ["PYTHONPATH"] = settings["pythonPath"]
+# the audit hook adds itself to PYTHONPATH for the python subprocesses only
+python_path = os.environ.get("PYTHONPATH", "")
+module = apply_settings(settings)
+load_site(python_path)
+del (settings, apply_settings, load_libc, check, enter_sandbox, isolate_network, drop_privileges, restrict_filesystem,
+     run_init, filter_syscalls, install_audit_hook, load_site, python_path)
+runpy.run_module(module, run_name="__main__", alter_sys=True)
@@ -0,0 +1,72 @@
+package cliwrapper
+
+import (
+	"regexp"
+)
+
+// ProgressStage is a step of pulling a python module.
+type ProgressStage string
+
+const (
+	// ProgressCreatingVenv means the module's virtual environment is being created.
+	ProgressCreatingVenv ProgressStage = "creating virtual environment"
+	// ProgressResolving means pip is collecting the module or one of its dependencies.
+	ProgressResolving ProgressStage = "resolving"
+	// ProgressDownloading means a repository is being cloned, or a package downloaded.
+	ProgressDownloading ProgressStage = "downloading"
+	// ProgressBuilding means a wheel is being built for the module or a dependency.
+	ProgressBuilding ProgressStage = "building"
+	// ProgressInstalling means the collected packages are being installed.
+	ProgressInstalling ProgressStage = "installing"
+	// ProgressInstalled means the module and its dependencies were installed.
+	ProgressInstalled ProgressStage = "installed"
+)
+
+// ProgressEvent describes the progress of pulling a python module.
+type ProgressEvent struct {
+	// Module is the full name of the python module being pulled.
+	Module string
+	// Stage is the step the pull has reached.
+	Stage ProgressStage
+	// Subject is what the stage applies to, such as the package being
+	// downloaded or the wheel being built. It may be empty.
+	Subject string
+}
+
+// ProgressReporter receives progress events while python modules are
+// pulled, so that they can be surfaced to users. It may be called
+// concurrently for different modules.
+type ProgressReporter interface {
+	ReportProgress(event ProgressEvent)
+}
+
+// pipProgress maps lines of pip install's stdout to the progress stage
+// they mark. The first submatch, if any, is the subject of the stage.
+var pipProgress = []struct {
+	stage ProgressStage
+	line  *regexp.Regexp
+}{
+	// direct references read "name@ url", the subject is the name alone
+	{ProgressResolving, regexp.MustCompile(`^\s*Collecting ([^\s@]+)`)},
+	{ProgressDownloading, regexp.MustCompile(`^\s*Cloning (\S+)`)},
+	{ProgressDownloading, regexp.MustCompile(`^\s*Downloading (\S+)`)},
+	{ProgressBuilding, regexp.MustCompile(`^\s*Building wheel for (\S+)`)},
+	{ProgressInstalling, regexp.MustCompile(`^\s*Installing collected packages: (.+)$`)},
+	{ProgressInstalled, regexp.MustCompile(`^\s*Successfully installed (.+)$`)},
+}
+
+// ParsePipProgress returns the progress stage marked by a line of pip
+// install's stdout, and its subject, if the line marks one.
+func ParsePipProgress(line string) (ProgressStage, string, bool) {
+	for _, progress := range pipProgress {
+		if match := progress.line.FindStringSubmatch(line); match != nil {
+			return progress.stage, match[1], true
+		}
+	}
+	return "", "", false
+}
+
+// noopProgressReporter discards progress events when no reporter is set.
+type noopProgressReporter struct{}
+
+func (noopProgressReporter) ReportProgress(_ ProgressEvent) {}
@@ -0,0 +1,196 @@
+package cliwrapper
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.arcalot.io/exex"
+)
+
+var (
+	// ErrModuleSpecInvalid means the module name does not follow the
+	// <module-name>@git+<repo_url>[@<commit_sha>] format.
+	ErrModuleSpecInvalid = errors.New("invalid python module specification")
+	// ErrRepositoryNotFound means the module's git repository does not exist.
+	ErrRepositoryNotFound = errors.New("repository not found")
+	// ErrAuthenticationRequired means the git repository asked for credentials.
+	// Some hosts, like GitHub, also report nonexistent repositories this way.
+	ErrAuthenticationRequired = errors.New("repository requires authentication")
+	// ErrRevisionNotFound means the requested commit does not exist in the
+	// module's git repository.
+	ErrRevisionNotFound = errors.New("revision not found")
+	// ErrDependencyConflict means pip could not find a set of dependency
+	// versions satisfying the requirements of the module.
+	ErrDependencyConflict = errors.New("dependency resolution conflict")
+	// ErrBuildFailed means the module or one of its dependencies failed to build.
+	ErrBuildFailed = errors.New("build failure")
+	// ErrNetworkUnavailable means the repository or the package index could
+	// not be reached. This is the only kind of pull error worth retrying.
+	ErrNetworkUnavailable = errors.New("network unavailable")
+	// ErrInterpreterIncompatible means the module, or one of its
+	// dependencies, does not support the deployer's python version.
+	ErrInterpreterIncompatible = errors.New("python interpreter incompatible")
+)
+
+// PullError is a classified failure to pull a python module. It matches its
+// Kind, one of the Err* errors of this package, with errors.Is, and the
+// underlying command error, if any, with errors.As.
+type PullError struct {
+	// Module is the full name of the python module that failed to be pulled.
+	Module string
+	// Kind is the classified cause of the failure.
+	Kind error
+	// Repository is the git repository of the module, if known.
+	Repository string
+	// Revision is the requested git commit of the module, if any.
+	Revision string
+	// Detail is the line of the pip or git output that explains the failure.
+	Detail string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *PullError) Error() string {
+	msg := fmt.Sprintf("%q: %v", e.Module, e.Kind)
+	if e.Detail != "" {
+		msg += " (" + e.Detail + ")"
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *PullError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// pullFailures maps each kind of pull error to fragments of pip or git
+// stderr output that identify it. They are checked in order, so that a
+// definitive git error wins over the generic pip errors following it.
+var pullFailures = []struct {
+	kind    error
+	markers []string
+}{
+	{ErrAuthenticationRequired, []string{
+		"could not read username",
+		"could not read password",
+		"authentication failed",
+		"terminal prompts disabled",
+		"permission denied (publickey)",
+	}},
+	{ErrRepositoryNotFound, []string{
+		"repository not found",
+		"does not appear to be a git repository",
+		"the requested url returned error: 404",
+	}},
+	{ErrRevisionNotFound, []string{
+		"did not match any file(s) known to git",
+		"not a tree object",
+		"unknown revision",
+		"couldn't find remote ref",
+	}},
+	{ErrNetworkUnavailable, []string{
+		"temporary failure in name resolution",
+		"could not resolve host",
+		"name or service not known",
+		"network is unreachable",
+		"connection timed out",
+		"connection reset",
+		"connection refused",
+		"read timed out",
+		"newconnectionerror",
+		"max retries exceeded",
+		"remote end hung up unexpectedly",
+		"early eof",
+		"502 bad gateway",
+		"503 service unavailable",
+		"504 gateway timeout",
+		"429 too many requests",
+		"error: 502",
+		"error: 503",
+		"error: 504",
+		"error: 429",
+	}},
+	{ErrInterpreterIncompatible, []string{
+		"requires a different python",
+		"requires-python",
+	}},
+	{ErrDependencyConflict, []string{
+		"resolutionimpossible",
+		"conflicting dependencies",
+		"no matching distribution found",
+		"could not find a version that satisfies",
+	}},
+	{ErrBuildFailed, []string{
+		"failed building wheel",
+		"could not build wheels",
+		"failed to build",
+		"metadata-generation-failed",
+	}},
+}
+
+// ClassifyPullError turns an error returned by a pip or git command into a
+// PullError, by looking for known failures in the command's stderr. Errors
+// that cannot be classified are returned unchanged.
+func ClassifyPullError(fullModuleName string, err error) error {
+	var exErr *exex.ExitError
+	if !errors.As(err, &exErr) {
+		return err
+	}
+	for _, failure := range pullFailures {
+		detail, found := findFailure(exErr.Stderr, failure.markers)
+		if !found {
+			continue
+		}
+		pullError := &PullError{
+			Module: fullModuleName,
+			Kind:   failure.kind,
+			Detail: detail,
+			Err:    err,
+		}
+		if pythonModule, err := parseModuleName(fullModuleName); err == nil {
+			pullError.Repository = *pythonModule.Repo
+			if pythonModule.ModuleVersion != nil {
+				pullError.Revision = *pythonModule.ModuleVersion
+			}
+		}
+		return pullError
+	}
+	return err
+}
+
+// findFailure returns the first line of output containing one of the given
+// markers, compared case-insensitively.
+func findFailure(output []byte, markers []string) (string, bool) {
+	for _, line := range strings.Split(string(output), "\n") {
+		lowerLine := strings.ToLower(line)
+		for _, marker := range markers {
+			if strings.Contains(lowerLine, marker) {
+				return strings.TrimSpace(line), true
+			}
+		}
+	}
+	return "", false
+}
+
+// IsTransientPullError reports whether an error returned by PullModule was
+// caused by a condition that is likely to go away on its own, such as a DNS
+// hiccup or an overloaded package index, so that the pull is worth retrying.
+func IsTransientPullError(err error) bool {
+	return errors.Is(err, ErrNetworkUnavailable)
+}
+
+// newModuleSpecError reports a module name that does not follow the
+// supported format.
+func newModuleSpecError(fullModuleName string) error {
+	return &PullError{
+		Module: fullModuleName,
+		Kind:   ErrModuleSpecInvalid,
+		Detail: "wrong module name format, please use <module-name>@git+<repo_url>[@<commit_sha>]",
+	}
+}
@@ -0,0 +1,189 @@
+package cliwrapper
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+
+	"go.flow.arcalot.io/pythondeployer/internal/config"
+	"go.flow.arcalot.io/pythondeployer/internal/seccomp"
+)
+
+// ErrLandlockUnavailable means Landlock is required, but the kernel does not
+// support it, or it is disabled.
+var ErrLandlockUnavailable = errors.New("landlock unavailable")
+
+const (
+	// sysLandlockCreateRuleset is the landlock_create_ruleset system call,
+	// which has the same number on every architecture.
+	sysLandlockCreateRuleset = 444
+	// landlockCreateRulesetVersion makes landlock_create_ruleset return the
+	// Landlock ABI version of the kernel.
+	landlockCreateRulesetVersion = 1
+)
+
+// sandboxSettings are the launcherSettings setting up the sandbox of a
+// plugin, from inside the namespaces the plugin process is started in.
+type sandboxSettings struct {
+	// Binds are the paths of the host visible in the sandbox, in addition to
+	// the system directories and the interpreter.
+	Binds []sandboxBind `json:"binds"`
+}
+
+// sandboxBind is a path of the host bind mounted in the sandbox, at the same
+// path.
+type sandboxBind struct {
+	Path     string `json:"path"`
+	Writable bool   `json:"writable"`
+}
+
+// userNamespaceSettings are the launcherSettings of a plugin process started
+// as root of a new user namespace, which it leaves for a nested one once its
+// namespaces are set up, to give up its privileges.
+type userNamespaceSettings struct {
+	// UID and GID are the ids of the plugin in its namespaces, which are the
+	// ids of the engine.
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+}
+
+// newSandboxSettings returns the settings of the sandbox of a plugin, where
+// the plugin can only write to its plugin directory, and read its venv and
+// secrets.
+func newSandboxSettings(venvPath string, pluginDirAbsPath string, secretsDir string) (*sandboxSettings, error) {
+	// the launcher resolves relative paths from the plugin directory
+	absVenvPath, err := filepath.Abs(venvPath)
+	if err != nil {
+		return nil, err
+	}
+	binds := []sandboxBind{
+		{Path: absVenvPath},
+		{Path: pluginDirAbsPath, Writable: true},
+	}
+	if secretsDir != "" {
+		binds = append(binds, sandboxBind{Path: secretsDir})
+	}
+	return &sandboxSettings{Binds: binds}, nil
+}
+
+// applyNamespaces starts the plugin process as root of a new user namespace,
+// mapped to the engine's user, along with the namespaces of the sandbox when
+// sandboxed, and a new network namespace when its network is private, so
+// that it can set them up without any privileges on the host. When plugins
+// run as another user, given by credential, root of the user namespace is
+// mapped to that user instead, and its groups to the groups of that user.
+func applyNamespaces(
+	procAttr *syscall.SysProcAttr,
+	sandboxed bool,
+	privateNetwork bool,
+	credential *syscall.Credential,
+) {
+	procAttr.Cloneflags = syscall.CLONE_NEWUSER
+	if sandboxed {
+		procAttr.Cloneflags |= syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC
+	}
+	if privateNetwork {
+		procAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	if credential == nil {
+		procAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+		procAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+		// unprivileged processes can only map their group once setgroups is denied
+		procAttr.GidMappingsEnableSetgroups = false
+		return
+	}
+	// the engine is privileged, so it can map any ids, and let the plugin
+	// process set its groups, which it does with the ids of the namespace
+	procAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: int(credential.Uid), Size: 1}}
+	procAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: int(credential.Gid), Size: 1}}
+	procAttr.GidMappingsEnableSetgroups = true
+	procAttr.Credential = &syscall.Credential{Groups: []uint32{}}
+	mapped := []uint32{credential.Gid}
+	for _, group := range credential.Groups {
+		if slices.Contains(mapped, group) {
+			continue
+		}
+		procAttr.GidMappings = append(procAttr.GidMappings,
+			syscall.SysProcIDMap{ContainerID: len(mapped), HostID: int(group), Size: 1})
+		procAttr.Credential.Groups = append(procAttr.Credential.Groups, uint32(len(mapped)))
+		mapped = append(mapped, group)
+	}
+}
+
+// landlockSettings are the launcherSettings restricting the filesystem
+// access of a plugin with Landlock, in addition to the read-only access to
+// the system directories and the interpreter.
+type landlockSettings struct {
+	ReadOnly  []string `json:"readOnly"`
+	ReadWrite []string `json:"readWrite"`
+}
+
+// LandlockABI returns the Landlock ABI version of the kernel, or an error if
+// the kernel does not support Landlock, or it is disabled.
+func LandlockABI() (int, error) {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(abi), nil
+}
+
+// newLandlockSettings returns the Landlock settings of a plugin, which can
+// only read its venv and secrets, and write to its plugin directory. When
+// Landlock is unavailable and not required, it returns nil, and the plugin
+// runs without filesystem restrictions.
+func (p *cliWrapper) newLandlockSettings(
+	fullModuleName string,
+	venvPath string,
+	pluginDirAbsPath string,
+	secretsDir string,
+) (*landlockSettings, error) {
+	if _, err := LandlockABI(); err != nil {
+		if p.config.Sandbox.Landlock.Required {
+			return nil, fmt.Errorf("%w, cannot deploy python module %s (%s)", ErrLandlockUnavailable, fullModuleName, err)
+		}
+		p.logger.Warningf("Landlock is unavailable (%s), python module %s runs without filesystem restrictions",
+			err, fullModuleName)
+		return nil, nil
+	}
+	absVenvPath, err := filepath.Abs(venvPath)
+	if err != nil {
+		return nil, err
+	}
+	settings := &landlockSettings{
+		ReadOnly:  []string{absVenvPath},
+		ReadWrite: []string{pluginDirAbsPath},
+	}
+	if secretsDir != "" {
+		settings.ReadOnly = append(settings.ReadOnly, secretsDir)
+	}
+	return settings, nil
+}
+
+// seccompSettings are the launcherSettings installing the seccomp filter of
+// a plugin, once the plugin process is set up.
+type seccompSettings struct {
+	// Filter is the BPF program compiled from the seccomp profile.
+	Filter []seccomp.Instruction `json:"filter"`
+}
+
+// newSeccompSettings compiles the configured seccomp profile, or the default
+// profile if none is configured.
+func newSeccompSettings(cfg config.Seccomp, fullModuleName string) (*seccompSettings, error) {
+	profile := seccomp.DefaultProfile()
+	if cfg.Profile != "" {
+		var err error
+		profile, err = seccomp.LoadProfile(cfg.Profile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot deploy python module %s (%w)", fullModuleName, err)
+		}
+	}
+	filter, err := profile.Compile()
+	if err != nil {
+		return nil, fmt.Errorf("error compiling the seccomp profile of python module %s (%w)", fullModuleName, err)
+	}
+	return &seccompSettings{Filter: filter}, nil
+}
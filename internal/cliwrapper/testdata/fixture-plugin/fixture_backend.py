@@ -0,0 +1,37 @@
+"""A minimal PEP 517 build backend, so that the fixture plugin can be
+installed without downloading a build backend from a package index."""
+import base64
+import hashlib
+import os
+import zipfile
+
+NAME = "fixture_plugin"
+VERSION = "0.1.0"
+DIST_INFO = f"{NAME}-{VERSION}.dist-info"
+
+
+def _record_line(path, data):
+    digest = base64.urlsafe_b64encode(hashlib.sha256(data).digest()).rstrip(b"=")
+    return f"{path},sha256={digest.decode()},{len(data)}"
+
+
+def build_wheel(wheel_directory, config_settings=None, metadata_directory=None):
+    wheel_name = f"{NAME}-{VERSION}-py3-none-any.whl"
+    files = {}
+    for filename in sorted(os.listdir(NAME)):
+        if filename.endswith(".py"):
+            with open(os.path.join(NAME, filename), "rb") as f:
+                files[f"{NAME}/{filename}"] = f.read()
+    files[f"{DIST_INFO}/METADATA"] = (
+        f"Metadata-Version: 2.1\nName: {NAME}\nVersion: {VERSION}\n"
+    ).encode()
+    files[f"{DIST_INFO}/WHEEL"] = (
+        "Wheel-Version: 1.0\nGenerator: fixture_backend\nRoot-Is-Purelib: true\nTag: py3-none-any\n"
+    ).encode()
+    record = [_record_line(path, data) for path, data in files.items()]
+    record.append(f"{DIST_INFO}/RECORD,,")
+    files[f"{DIST_INFO}/RECORD"] = ("\n".join(record) + "\n").encode()
+    with zipfile.ZipFile(os.path.join(wheel_directory, wheel_name), "w") as wheel:
+        for path, data in files.items():
+            wheel.writestr(path, data)
+    return wheel_name
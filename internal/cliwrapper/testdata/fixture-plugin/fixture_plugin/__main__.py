@@ -0,0 +1,119 @@
+import ctypes
+import json
+import os
+import resource
+import signal
+import socket
+import subprocess
+import sys
+import tempfile
+
+
+def can_read(path):
+    try:
+        with open(path, "rb"):
+            return True
+    except OSError:
+        return False
+
+
+def can_write(directory):
+    try:
+        with tempfile.NamedTemporaryFile(dir=directory):
+            return True
+    except OSError:
+        return False
+
+
+def connect_error(address):
+    host, port = address.rsplit(":", 1)
+    try:
+        socket.create_connection((host, int(port)), timeout=5).close()
+        return ""
+    except OSError as e:
+        return "%s: %s" % (type(e).__name__, e)
+
+
+def loopback_reachable():
+    try:
+        with socket.create_server(("127.0.0.1", 0)) as server:
+            socket.create_connection(server.getsockname(), timeout=5).close()
+        return True
+    except OSError:
+        return False
+
+
+def error_of(probe):
+    try:
+        probe()
+        return ""
+    except OSError as e:
+        return "%s: %s" % (type(e).__name__, e)
+
+
+def child_error(path):
+    # the python subprocesses of the plugin do not inherit the report pipe
+    try:
+        child = subprocess.run([sys.executable, "-c", "open(%r, 'rb').close()" % path], capture_output=True)
+    except OSError as e:
+        return "%s: %s" % (type(e).__name__, e)
+    return child.stderr.decode().strip().rsplit("\n", 1)[-1]
+
+
+def audit_probes(path):
+    with socket.create_server(("127.0.0.1", 0)) as server:
+        address = server.getsockname()
+        return {
+            "subprocess.Popen": error_of(lambda: subprocess.run(["true"], check=True)),
+            "os.system": error_of(lambda: os.system("true")),
+            "socket.connect": error_of(lambda: socket.create_connection(address, timeout=5).close()),
+            "open": error_of(lambda: open(path, "rb").close()),
+            "child": child_error(path),
+        }
+
+
+print("hello from fixture", flush=True)
+if "FIXTURE_PTRACE" in os.environ:
+    # PTRACE_TRACEME, which seccomp profiles usually block, the plugin cannot
+    # survive it by handling SIGSYS
+    signal.signal(signal.SIGSYS, lambda signum, frame: None)
+    ctypes.CDLL(None).ptrace(0, 0, 0, 0)
+if "--atp" in sys.argv:
+    # describe the plugin process, for the tests deploying the fixture
+    print(json.dumps({
+        "argv": sys.argv[1:],
+        "environ": dict(os.environ),
+        "pid": os.getpid(),
+        "sysPath": sys.path,
+        "uid": os.getuid(),
+        "gid": os.getgid(),
+        "groups": sorted(os.getgroups()),
+        "writable": {
+            "cwd": can_write("."),
+            "tmp": can_write("/tmp"),
+            "venv": can_write(sys.prefix),
+        },
+        "visible": {
+            path: os.path.exists(path) for path in os.environ.get("FIXTURE_PROBE_PATHS", "").split(":") if path
+        },
+        "readable": {
+            path: can_read(path) for path in os.environ.get("FIXTURE_PROBE_PATHS", "").split(":") if path
+        },
+        "interfaces": [name for _, name in socket.if_nameindex()],
+        "connectError": connect_error(os.environ["FIXTURE_CONNECT"]) if "FIXTURE_CONNECT" in os.environ else "",
+        "loopback": loopback_reachable(),
+        "audit": audit_probes(os.environ["FIXTURE_AUDIT_OPEN"]) if "FIXTURE_AUDIT_OPEN" in os.environ else {},
+        "interpreter": {
+            "hashRandomization": sys.flags.hash_randomization,
+            "dontWriteBytecode": sys.dont_write_bytecode,
+            "warnOptions": sys.warnoptions,
+            "stdoutEncoding": sys.stdout.encoding,
+        },
+        "rlimits": {
+            name: resource.getrlimit(getattr(resource, name))[0]
+            for name in ["RLIMIT_AS", "RLIMIT_CPU", "RLIMIT_NOFILE", "RLIMIT_NPROC", "RLIMIT_CORE"]
+        },
+    }))
+if "FIXTURE_WAIT" in os.environ:
+    # keep running until the test closes stdin
+    sys.stdin.read()
@@ -0,0 +1,261 @@
+package cliwrapper
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"go.flow.arcalot.io/pythondeployer/internal/config"
+)
+
+// ErrPluginUserPermission means the engine lacks the privileges to run
+// plugins as the configured plugin user.
+var ErrPluginUserPermission = errors.New("permission denied to run plugins as another user")
+
+// pluginUserCapabilities are the capabilities the engine needs to run
+// plugins as another user: switching ids, handing the plugin directory and
+// secrets over, and shredding and removing them once the plugin is done.
+var pluginUserCapabilities = []struct {
+	name string
+	bit  uint
+}{
+	{"CAP_CHOWN", 0},
+	{"CAP_DAC_OVERRIDE", 1},
+	{"CAP_FOWNER", 3},
+	{"CAP_SETGID", 6},
+	{"CAP_SETUID", 7},
+}
+
+// procStatusPath is where the engine reads its capabilities from.
+const procStatusPath = "/proc/self/status"
+
+// pluginCredential returns the credential of the plugin user, or nil if
+// plugins run as the engine's user.
+func pluginCredential(pluginUser config.PluginUser) (*syscall.Credential, error) {
+	if pluginUser.UID == nil {
+		return nil, nil
+	}
+	if pluginUser.GID == nil {
+		return nil, fmt.Errorf("the gid of the plugin user %d is not set", *pluginUser.UID)
+	}
+	credential := &syscall.Credential{
+		Uid:    uint32(*pluginUser.UID),
+		Gid:    uint32(*pluginUser.GID),
+		Groups: []uint32{},
+	}
+	for _, group := range pluginUser.Groups {
+		credential.Groups = append(credential.Groups, uint32(group))
+	}
+	return credential, nil
+}
+
+// checkPluginUserCapabilities returns an ErrPluginUserPermission naming the
+// capabilities the engine lacks to run plugins as the user of credential.
+func checkPluginUserCapabilities(credential *syscall.Credential) error {
+	effective, err := effectiveCapabilities()
+	if err != nil {
+		return fmt.Errorf("%w, cannot read the capabilities of the engine (%w)", ErrPluginUserPermission, err)
+	}
+	var missing []string
+	for _, capability := range pluginUserCapabilities {
+		if effective&(1<<capability.bit) == 0 {
+			missing = append(missing, capability.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w, running plugins as uid %d and gid %d needs the %s capabilities, "+
+			"which the engine (uid %d) lacks",
+			ErrPluginUserPermission, credential.Uid, credential.Gid, strings.Join(missing, ", "), os.Geteuid())
+	}
+	return nil
+}
+
+// effectiveCapabilities returns the effective capabilities of the engine.
+func effectiveCapabilities() (uint64, error) {
+	file, err := os.Open(procStatusPath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, found := strings.CutPrefix(scanner.Text(), "CapEff:"); found {
+			return strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no CapEff in %s", procStatusPath)
+}
+
+// preparePluginUser makes the venv of a plugin readable by the plugin user,
+// and hands the plugin directory and the secrets of the plugin over to the
+// user, after giving it search access to the directories the deployer created
+// above them in workDir, and checking it can run the venv.
+func preparePluginUser(
+	credential *syscall.Credential,
+	workDir string,
+	venvPath string,
+	pluginDirAbsPath string,
+	secretsDir string,
+) error {
+	// the venv may have been pulled by an earlier run, or another process
+	if err := grantVenvAccess(credential, venvPath); err != nil {
+		return err
+	}
+	for _, path := range []string{venvPath, pluginDirAbsPath} {
+		if err := grantSearch(credential, path, workDir); err != nil {
+			return fmt.Errorf("%w, cannot make the directories above %s searchable by uid %d (%w)",
+				ErrPluginUserPermission, path, credential.Uid, err)
+		}
+	}
+	if err := checkVenvAccess(credential, venvPath); err != nil {
+		return err
+	}
+	if err := checkSearchable(credential, pluginDirAbsPath, "plugin directory"); err != nil {
+		return err
+	}
+	for _, dir := range []string{pluginDirAbsPath, secretsDir} {
+		if dir == "" {
+			continue
+		}
+		err := filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(path, int(credential.Uid), int(credential.Gid))
+		})
+		if err != nil {
+			return fmt.Errorf("%w, cannot give %s to uid %d (%w)", ErrPluginUserPermission, dir, credential.Uid, err)
+		}
+	}
+	return nil
+}
+
+// checkSearchable returns an error naming the first directory above path the
+// plugin user cannot search, and so cannot reach path through.
+func checkSearchable(credential *syscall.Credential, path string, description string) error {
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !permitted(credential, info, 1) {
+			stat := info.Sys().(*syscall.Stat_t)
+			return fmt.Errorf("the %s %s is not accessible by uid %d, since directory %s "+
+				"(owner %d, group %d, mode %s) is not searchable by it",
+				description, path, credential.Uid, dir, stat.Uid, stat.Gid, info.Mode().Perm())
+		}
+		if dir == filepath.Dir(dir) {
+			return nil
+		}
+	}
+}
+
+// grantSearch makes the directories above path in workDir searchable by
+// everyone, which lets the plugin user reach path through them without
+// letting anyone list them. The directories above workDir, and workDir
+// itself, are left alone.
+func grantSearch(credential *syscall.Credential, path string, workDir string) error {
+	if !strings.HasPrefix(path, workDir+string(filepath.Separator)) {
+		return nil
+	}
+	for dir := filepath.Dir(path); dir != workDir; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if permitted(credential, info, 1) {
+			continue
+		}
+		if err := os.Chmod(dir, info.Mode().Perm()|0001); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkVenvAccess returns an error if the plugin user cannot reach the venv
+// or run its interpreter. The interpreter of the venv is left alone, it must
+// already be accessible to the plugin user.
+func checkVenvAccess(credential *syscall.Credential, venvPath string) error {
+	absVenvPath, err := filepath.Abs(venvPath)
+	if err != nil {
+		return err
+	}
+	venvPython := filepath.Join(absVenvPath, "bin/python")
+	if err := checkSearchable(credential, venvPython, "venv"); err != nil {
+		return err
+	}
+	// the interpreter of the venv is outside of it
+	interpreter, err := filepath.EvalSymlinks(venvPython)
+	if err != nil {
+		return err
+	}
+	if err := checkSearchable(credential, interpreter, "python interpreter"); err != nil {
+		return err
+	}
+	if info, err := os.Stat(interpreter); err != nil {
+		return err
+	} else if !permitted(credential, info, 1) {
+		return fmt.Errorf("the python interpreter %s is not executable by uid %d (mode %s)",
+			interpreter, credential.Uid, info.Mode().Perm())
+	}
+	return nil
+}
+
+// grantVenvAccess makes the files of a venv readable by the plugin user,
+// giving the group of the plugin user access to the files the user cannot
+// read otherwise.
+func grantVenvAccess(credential *syscall.Credential, venvPath string) error {
+	absVenvPath, err := filepath.Abs(venvPath)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(absVenvPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.Type()&fs.ModeSymlink != 0 {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		// read, and search or execute when the owner can
+		var access fs.FileMode = 4
+		if info.IsDir() || info.Mode()&0100 != 0 {
+			access |= 1
+		}
+		if permitted(credential, info, access) {
+			return nil
+		}
+		if err := os.Lchown(path, -1, int(credential.Gid)); err != nil {
+			return fmt.Errorf("%w, cannot make venv %s readable by gid %d (%w)",
+				ErrPluginUserPermission, absVenvPath, credential.Gid, err)
+		}
+		return os.Chmod(path, info.Mode()|access<<3)
+	})
+}
+
+// permitted tells whether the plugin user has the access bits (4 read, 2
+// write, 1 execute) to a file, according to its mode.
+func permitted(credential *syscall.Credential, info fs.FileInfo, access fs.FileMode) bool {
+	stat := info.Sys().(*syscall.Stat_t)
+	mode := info.Mode().Perm()
+	switch {
+	case stat.Uid == credential.Uid:
+		mode >>= 6
+	case stat.Gid == credential.Gid || slices.Contains(credential.Groups, stat.Gid):
+		mode >>= 3
+	}
+	return mode&access == access
+}
@@ -0,0 +1,169 @@
+package cliwrapper
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Every pull of a python module happens in a pull directory of its own,
+// pull-*, inside the module path, and the venv of the module path is a
+// symbolic link to the venv of the latest successful pull, swapped
+// atomically once the pull is done. Plugins run from the pull directory the
+// link points to when they start, and hold a shared lock on it for as long
+// as they run, so that pulling the module again, from this process or
+// another one sharing the working directory, never replaces a venv in use.
+// The pull directories no longer linked to are removed by the next pull once
+// no plugin holds them anymore.
+
+// pullDirPrefix prefixes the names of the pull directories of a module.
+const pullDirPrefix = "pull-"
+
+// venvLinkName is the name of the link to the venv of a module.
+const venvLinkName = "venv"
+
+// lockDir takes a flock of the kind how on a directory, which is released
+// when the returned directory is closed.
+func lockDir(dir string, how int) (*os.File, error) {
+	lock, err := os.Open(dir) //nolint:gosec // a directory of the working directory
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), how); err != nil {
+		_ = lock.Close()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// newPullDir creates a pull directory in modulePath, locked against its
+// removal by the pulls of other processes until the returned lock is closed.
+func newPullDir(modulePath string) (string, *os.File, error) {
+	if err := os.MkdirAll(modulePath, 0750); err != nil {
+		return "", nil, err
+	}
+	for {
+		pullDir, err := os.MkdirTemp(modulePath, pullDirPrefix)
+		if err != nil {
+			return "", nil, err
+		}
+		if err := os.Chmod(pullDir, 0750); err != nil {
+			return "", nil, err
+		}
+		lock, err := lockDir(pullDir, syscall.LOCK_SH)
+		if err != nil {
+			return "", nil, err
+		}
+		// another pull may have taken the new directory for a stale one
+		// before it was locked
+		if sameDir(lock, pullDir) {
+			return pullDir, lock, nil
+		}
+		_ = lock.Close()
+	}
+}
+
+// publishVenv makes the venv of pullDir the venv of modulePath, and removes
+// the pull directories no plugin runs from anymore.
+func publishVenv(modulePath string, pullDir string) error {
+	linkPath := filepath.Join(modulePath, venvLinkName)
+	if info, err := os.Lstat(linkPath); err == nil && info.IsDir() {
+		// a venv pulled before venvs were linked to
+		if err := os.RemoveAll(linkPath); err != nil {
+			return err
+		}
+	}
+	tempLink := linkPath + ".tmp-" + filepath.Base(pullDir)
+	if err := os.Symlink(filepath.Join(filepath.Base(pullDir), venvLinkName), tempLink); err != nil {
+		return err
+	}
+	if err := os.Rename(tempLink, linkPath); err != nil {
+		_ = os.Remove(tempLink)
+		return err
+	}
+	return removeStalePullDirs(modulePath)
+}
+
+// removeStalePullDirs removes the pull directories of modulePath that are
+// neither linked to nor locked by a plugin or a pull in progress.
+func removeStalePullDirs(modulePath string) error {
+	linkPath := filepath.Join(modulePath, venvLinkName)
+	entries, err := os.ReadDir(modulePath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), pullDirPrefix) {
+			continue
+		}
+		pullDir := filepath.Join(modulePath, entry.Name())
+		lock, err := lockDir(pullDir, syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != nil {
+			// still in use, or already removed
+			continue
+		}
+		// the pull of another process may have linked to it since, the link
+		// no longer changes to or from it while it is locked
+		target, err := os.Readlink(linkPath)
+		if err == nil && filepath.Dir(target) == entry.Name() {
+			_ = lock.Close()
+			continue
+		}
+		err = os.RemoveAll(pullDir)
+		_ = lock.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockVenv returns the venv modulePath currently links to, and a shared lock
+// on its pull directory, which keeps the venv from being removed until the
+// lock is closed. Venvs pulled before venvs were linked to are not locked,
+// and the lock is nil.
+func lockVenv(modulePath string) (string, *os.File, error) {
+	linkPath := filepath.Join(modulePath, venvLinkName)
+	for {
+		info, err := os.Lstat(linkPath)
+		if err != nil {
+			return "", nil, err
+		}
+		if info.IsDir() {
+			return linkPath, nil, nil
+		}
+		target, err := os.Readlink(linkPath)
+		if err != nil {
+			return "", nil, err
+		}
+		venvPath := filepath.Join(modulePath, target)
+		pullDir := filepath.Dir(venvPath)
+		lock, err := lockDir(pullDir, syscall.LOCK_SH)
+		if err != nil && !os.IsNotExist(err) {
+			return "", nil, fmt.Errorf("error locking venv %s (%w)", venvPath, err)
+		}
+		current, linkErr := os.Readlink(linkPath)
+		if err == nil && linkErr == nil && current == target && sameDir(lock, pullDir) {
+			return venvPath, lock, nil
+		}
+		if lock != nil {
+			_ = lock.Close()
+		}
+		if err != nil && linkErr == nil && current == target {
+			return "", nil, fmt.Errorf("the venv %s linked to by %s is missing (%w)", venvPath, linkPath, err)
+		}
+		// a pull replaced the venv in the meantime
+	}
+}
+
+// sameDir tells whether the open directory dir is still found at path.
+func sameDir(dir *os.File, path string) bool {
+	openInfo, err := dir.Stat()
+	if err != nil {
+		return false
+	}
+	pathInfo, err := os.Stat(path)
+	return err == nil && os.SameFile(openInfo, pathInfo)
+}
@@ -1,10 +1,313 @@
 package config
 
+import (
+	"regexp"
+	"time"
+)
+
 type Config struct {
 	PythonPath       string           `json:"pythonPath"`
 	WorkDir          string           `json:"workdir"`
 	PythonSemVer     string           `json:"pythonSemver"`
 	ModulePullPolicy ModulePullPolicy `json:"modulePullPolicy"`
+	PullRetry        PullRetry        `json:"pullRetry"`
+	PullEnvironment  PullEnvironment  `json:"pullEnvironment"`
+	GitCredentials   GitCredentials   `json:"gitCredentials"`
+	SourceRewrites   []SourceRewrite  `json:"sourceRewrites"`
+	// GitMirror keeps bare mirrors of module repositories in the working
+	// directory, and installs modules from a local checkout of them.
+	GitMirror bool `json:"gitMirror"`
+	// WheelCache keeps the wheels built for modules pinned to a commit in the
+	// working directory, along with pip's cache, so that later pulls of the
+	// same commit install them without git or building anything.
+	WheelCache     bool           `json:"wheelCache"`
+	PluginShutdown PluginShutdown `json:"pluginShutdown"`
+	// StderrTailSize is the number of bytes kept from the end of the stderr
+	// of each plugin, to report errors.
+	StderrTailSize int64 `json:"stderrTailSize"`
+	// PrefetchConcurrency is the number of modules prefetched at once.
+	PrefetchConcurrency int64 `json:"prefetchConcurrency"`
+	// ResourceLimits are the rlimits of every plugin process.
+	ResourceLimits ResourceLimits `json:"resourceLimits"`
+	// Modules holds the settings of individual python modules, by module
+	// name, which take precedence over the settings of the deployer.
+	Modules map[string]ModuleSettings `json:"modules"`
+	Cgroup  Cgroup                    `json:"cgroup"`
+	// ResourceReport writes the resource usage of every plugin to the
+	// resource-usage.json file of its plugin directory once it exits.
+	ResourceReport    bool              `json:"resourceReport"`
+	PluginEnvironment PluginEnvironment `json:"pluginEnvironment"`
+	// Secrets maps the names of the secrets given to every plugin to the
+	// files on the host holding them.
+	Secrets map[string]string `json:"secrets"`
+	Sandbox Sandbox           `json:"sandbox"`
+	// Network is the network access of every plugin. When empty, plugins
+	// use the network of the host, unless the sandbox has a private network.
+	Network    Network    `json:"network"`
+	PluginUser PluginUser `json:"pluginUser"`
+	AuditHook  AuditHook  `json:"auditHook"`
+}
+
+// AuditHook installs a python audit hook (PEP 578) in the interpreters of
+// plugins, which reports the audited events of the plugins to the deployer,
+// and blocks the categories of events the policy blocks. Audit hooks are no
+// security boundary, native code and plugins tampering with the interpreter
+// get around them.
+type AuditHook struct {
+	Enabled bool `json:"enabled"`
+	// Events are the actions taken on the audited event categories. When
+	// none is set, every category is logged.
+	Events AuditEvents `json:"events"`
+	// Report writes the audited events of every plugin to the
+	// audit-report.json file of its plugin directory once it exits.
+	Report bool `json:"report"`
+}
+
+// AuditEvents are the actions taken on every category of audited events,
+// the categories left unset are not audited.
+type AuditEvents struct {
+	Subprocess AuditAction `json:"subprocess.Popen"`
+	System     AuditAction `json:"os.system"`
+	Connect    AuditAction `json:"socket.connect"`
+	Open       AuditAction `json:"open"`
+}
+
+// Actions maps the categories that are set to their action.
+func (e AuditEvents) Actions() map[AuditCategory]AuditAction {
+	actions := map[AuditCategory]AuditAction{}
+	for category, action := range map[AuditCategory]AuditAction{
+		AuditSubprocess: e.Subprocess,
+		AuditSystem:     e.System,
+		AuditConnect:    e.Connect,
+		AuditOpen:       e.Open,
+	} {
+		if action != "" {
+			actions[category] = action
+		}
+	}
+	return actions
+}
+
+// AuditCategory is a category of audited events.
+type AuditCategory string
+
+const (
+	// AuditSubprocess are the subprocesses started by plugins, with
+	// subprocess, os.exec*, os.posix_spawn* or os.spawn*.
+	AuditSubprocess AuditCategory = "subprocess.Popen"
+	// AuditSystem are the shell commands run by plugins with os.system.
+	AuditSystem AuditCategory = "os.system"
+	// AuditConnect are the connections of the sockets of plugins.
+	AuditConnect AuditCategory = "socket.connect"
+	// AuditOpen are the files plugins open outside of their plugin
+	// directory, except for reading their interpreter, venv and secrets.
+	AuditOpen AuditCategory = "open"
+)
+
+// AuditCategories are all the categories of audited events.
+var AuditCategories = []AuditCategory{AuditSubprocess, AuditSystem, AuditConnect, AuditOpen}
+
+// AuditAction is what the audit hook does with an audited event.
+type AuditAction string
+
+const (
+	// AuditActionLog reports the event and lets it happen.
+	AuditActionLog AuditAction = "log"
+	// AuditActionBlock reports the event and makes it fail with a
+	// PermissionError.
+	AuditActionBlock AuditAction = "block"
+)
+
+// PluginUser runs plugins as another user than the engine's, which needs the
+// engine to be privileged. Plugins run as the engine's user when UID is
+// unset.
+type PluginUser struct {
+	UID *int64 `json:"uid"`
+	// GID is the primary group of plugins, set along with UID.
+	GID *int64 `json:"gid"`
+	// Groups are the supplementary groups of plugins, which have none
+	// otherwise.
+	Groups []int64 `json:"groups"`
+}
+
+// Sandbox runs every plugin process in new user, mount, PID and IPC
+// namespaces, where it only sees the system directories, its interpreter
+// and venv read-only, and its plugin directory and a private /tmp writable.
+type Sandbox struct {
+	Enabled bool `json:"enabled"`
+	// PrivateNetwork also runs plugins in a new network namespace, with
+	// nothing but loopback, like NetworkNone.
+	PrivateNetwork bool `json:"privateNetwork"`
+	// Landlock restricts the filesystem access of plugins, with or without
+	// namespaces.
+	Landlock Landlock `json:"landlock"`
+	// Seccomp filters the system calls of plugins, with or without
+	// namespaces.
+	Seccomp Seccomp `json:"seccomp"`
+}
+
+// Landlock restricts plugins to reading the system directories, their
+// interpreter and their venv, and to writing to their plugin directory.
+type Landlock struct {
+	Enabled bool `json:"enabled"`
+	// Required fails deploying plugins on kernels without Landlock, instead
+	// of running them without filesystem restrictions.
+	Required bool `json:"required"`
+}
+
+// Seccomp filters the system calls of plugins with a seccomp profile, in the
+// JSON format of Docker and OCI runtimes.
+type Seccomp struct {
+	Enabled bool `json:"enabled"`
+	// Profile is the path of the seccomp profile. When empty, plugins run
+	// with the default profile, which allows what CPython and its usual
+	// extensions need, but blocks system calls that can escape or tamper with
+	// the host, like ptrace, mount, bpf or kernel module loading.
+	Profile string `json:"profile"`
+}
+
+// PluginEnvironment controls the environment of plugin processes, which
+// start from a clean environment instead of inheriting the engine's, so that
+// the secrets of the engine do not leak into plugins.
+type PluginEnvironment struct {
+	// Inherit lists the variables passed on from the engine's environment.
+	// Entries ending in "*" match a prefix.
+	Inherit []string `json:"inherit"`
+	// Variables are set explicitly, replacing inherited variables.
+	Variables map[string]string `json:"variables"`
+}
+
+// Cgroup places every plugin process in a cgroup v2 of its own, to limit
+// and account its memory and CPU usage along with its subprocesses.
+type Cgroup struct {
+	// Enabled creates the plugin cgroups. When cgroup v2 delegation is
+	// unavailable, plugins run without a cgroup of their own.
+	Enabled bool `json:"enabled"`
+	// Parent is the delegated cgroup holding the plugin cgroups, relative
+	// to the cgroup v2 mount point, which Enabled requires.
+	Parent string `json:"parent"`
+	// MemoryMax is the memory.max of each plugin cgroup, in bytes.
+	MemoryMax *int64 `json:"memoryMax"`
+	// CPUMax is the number of CPUs each plugin cgroup can use, see cpu.max.
+	CPUMax *float64 `json:"cpuMax"`
+	// PidsMax is the pids.max of each plugin cgroup.
+	PidsMax *int64 `json:"pidsMax"`
+}
+
+// ModuleSettings are the settings of the plugins of a single python module.
+type ModuleSettings struct {
+	ResourceLimits ResourceLimits `json:"resourceLimits"`
+	// Environment are variables set for the plugin processes of the module,
+	// replacing the variables of the deployer's plugin environment.
+	Environment map[string]string `json:"environment"`
+	// Secrets are secrets given to the plugin processes of the module, in
+	// addition to the secrets of the deployer.
+	Secrets map[string]string `json:"secrets"`
+	// Network is the network access of the plugin processes of the module,
+	// replacing the network access of the deployer's plugins.
+	Network Network `json:"network"`
+}
+
+// ResourceLimits are the rlimits applied to a plugin process, and inherited
+// by its subprocesses. The limits left unset are inherited from the engine.
+type ResourceLimits struct {
+	// AddressSpace is the maximum size of the virtual memory of the
+	// process, in bytes.
+	AddressSpace *int64 `json:"addressSpace"`
+	// CPUTime is the maximum CPU time of the process, rounded up to seconds.
+	CPUTime *time.Duration `json:"cpuTime"`
+	// OpenFiles is the maximum number of file descriptors of the process.
+	OpenFiles *int64 `json:"openFiles"`
+	// Processes is the maximum number of processes of the user running the
+	// process, which includes the processes outside of the plugin.
+	Processes *int64 `json:"processes"`
+	// CoreSize is the maximum size of the core dumps of the process, in bytes.
+	CoreSize *int64 `json:"coreSize"`
+}
+
+// Merge returns the limits l, overridden by the limits set in overrides.
+func (l ResourceLimits) Merge(overrides ResourceLimits) ResourceLimits {
+	if overrides.AddressSpace != nil {
+		l.AddressSpace = overrides.AddressSpace
+	}
+	if overrides.CPUTime != nil {
+		l.CPUTime = overrides.CPUTime
+	}
+	if overrides.OpenFiles != nil {
+		l.OpenFiles = overrides.OpenFiles
+	}
+	if overrides.Processes != nil {
+		l.Processes = overrides.Processes
+	}
+	if overrides.CoreSize != nil {
+		l.CoreSize = overrides.CoreSize
+	}
+	return l
+}
+
+// PluginShutdown describes how a plugin process is stopped when its plugin
+// is closed. The process is first asked to exit by closing its stdin, then
+// sent SIGTERM, and finally SIGKILL.
+type PluginShutdown struct {
+	// StdinGracePeriod is how long the process has to exit on its own after
+	// its stdin is closed, before it is sent SIGTERM.
+	StdinGracePeriod time.Duration `json:"stdinGracePeriod"`
+	// TerminateGracePeriod is how long the process has to exit after SIGTERM,
+	// before it is sent SIGKILL.
+	TerminateGracePeriod time.Duration `json:"terminateGracePeriod"`
+}
+
+// PullRetry describes how often and how fast a module pull is retried after
+// a transient failure, such as a DNS hiccup or an overloaded package index.
+type PullRetry struct {
+	// MaxAttempts is the total number of pull attempts, including the first.
+	MaxAttempts int64 `json:"maxAttempts"`
+	// InitialBackoff is the wait time before the first retry, it is doubled
+	// for every subsequent retry.
+	InitialBackoff time.Duration `json:"initialBackoff"`
+	// MaxBackoff caps the wait time between two attempts.
+	MaxBackoff time.Duration `json:"maxBackoff"`
+}
+
+// PullEnvironment controls the environment of the pip and git subprocesses
+// pulling a python module.
+type PullEnvironment struct {
+	// Isolated stops the pull subprocesses from inheriting the whole
+	// environment of the engine, only the variables in Inherit are passed on.
+	Isolated bool `json:"isolated"`
+	// Inherit lists the variables passed on from the engine's environment
+	// when Isolated is set. Entries ending in "*" match a prefix.
+	Inherit []string `json:"inherit"`
+	// Variables are set explicitly, replacing inherited variables.
+	Variables map[string]string `json:"variables"`
+}
+
+// GitCredentials are used by git to authenticate to private repositories
+// while pulling a python module. They are only referenced by path, and only
+// exposed to the pull subprocesses.
+type GitCredentials struct {
+	// TokenFiles maps a git host, such as github.com, to a file holding an
+	// access token for https repositories on that host.
+	TokenFiles map[string]string `json:"tokenFiles"`
+	// Helper is a git credential helper, as in git's credential.helper.
+	Helper string `json:"helper"`
+	// SSHKeyFile is the private key used for git+ssh:// repositories.
+	SSHKeyFile string `json:"sshKeyFile"`
+	// SSHKnownHostsFile is the known_hosts file used to verify the hosts of
+	// git+ssh:// repositories.
+	SSHKnownHostsFile string `json:"sshKnownHostsFile"`
+}
+
+// SourceRewrite redirects the git repository of python modules, for example
+// to an internal mirror. Either Prefix or Regex is set.
+type SourceRewrite struct {
+	// Prefix is replaced with Replacement in repository URLs starting with it.
+	Prefix string `json:"prefix"`
+	// Regex is replaced with Replacement, which may refer to its capture
+	// groups, in repository URLs matching it.
+	Regex *regexp.Regexp `json:"regex"`
+	// Replacement is what the matched part of the repository URL becomes.
+	Replacement string `json:"replacement"`
 }
 
 type ModulePullPolicy string
@@ -15,3 +318,57 @@ const (
 	// ModulePullPolicyIfNotPresent means the image will be pulled if the module is not present locally
 	ModulePullPolicyIfNotPresent ModulePullPolicy = "IfNotPresent"
 )
+
+// Network is the network access of plugins.
+type Network string
+
+const (
+	// NetworkHost means plugins use the network of the host.
+	NetworkHost Network = "host"
+	// NetworkNone means plugins run in an empty network namespace, where they
+	// can only reach loopback, and connecting anywhere else fails with a
+	// permission error.
+	NetworkNone Network = "none"
+)
+
+// DefaultPullEnvironmentInherit are the variables an isolated pull inherits
+// by default, so that git can be found and proxies and certificate bundles
+// keep working.
+var DefaultPullEnvironmentInherit = []string{
+	"PATH",
+	"HOME",
+	"HTTP_PROXY",
+	"HTTPS_PROXY",
+	"NO_PROXY",
+	"http_proxy",
+	"https_proxy",
+	"no_proxy",
+	"PIP_*",
+	"GIT_SSL_CAINFO",
+	"GIT_SSL_CAPATH",
+	"SSL_CERT_FILE",
+	"SSL_CERT_DIR",
+	"REQUESTS_CA_BUNDLE",
+}
+
+// DefaultPluginEnvironmentInherit are the variables plugins inherit by
+// default, so that tools, the locale, proxies and certificate bundles keep
+// working.
+var DefaultPluginEnvironmentInherit = []string{
+	"PATH",
+	"HOME",
+	"USER",
+	"LANG",
+	"LC_*",
+	"TZ",
+	"TMPDIR",
+	"HTTP_PROXY",
+	"HTTPS_PROXY",
+	"NO_PROXY",
+	"http_proxy",
+	"https_proxy",
+	"no_proxy",
+	"SSL_CERT_FILE",
+	"SSL_CERT_DIR",
+	"REQUESTS_CA_BUNDLE",
+}
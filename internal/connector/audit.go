@@ -0,0 +1,101 @@
+package connector
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"go.flow.arcalot.io/pythondeployer/internal/cliwrapper"
+	"go.flow.arcalot.io/pythondeployer/internal/config"
+	"go.flow.arcalot.io/pythondeployer/internal/util"
+)
+
+// AuditReportFile is the name of the file in the plugin directory the
+// audited events of the plugin are written to, when enabled.
+const AuditReportFile = "audit-report.json"
+
+// AuditReport are the events reported by the audit hook of a plugin, along
+// with the events its python subprocesses reported, if they could.
+type AuditReport struct {
+	// Module is the full name of the python module the plugin ran.
+	Module string `json:"module"`
+	// Events are the audited events, in the order they were reported.
+	Events []cliwrapper.AuditEvent `json:"events"`
+	// Blocked is the number of events the audit policy blocked.
+	Blocked int `json:"blocked"`
+}
+
+// drainAudit reads the events reported by the audit hook of the plugin
+// while it runs, logs them, and keeps them for the audit report. Plugins
+// without an audit hook report nothing.
+func (p *CliPlugin) drainAudit() {
+	p.auditDrained = make(chan struct{})
+	if p.audit == nil {
+		close(p.auditDrained)
+		return
+	}
+	pid := p.deployCommand.Process.Pid
+	go func() {
+		defer close(p.auditDrained)
+		scanner := bufio.NewScanner(p.audit)
+		for scanner.Scan() {
+			var event cliwrapper.AuditEvent
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				p.logger.Warningf("invalid audit event of plugin process with pid %d (%s)", pid, err)
+				continue
+			}
+			if event.Action == config.AuditActionBlock {
+				p.logger.Warningf("audit policy blocked %s (%s) in process %d of plugin process with pid %d",
+					event.Event, event.Detail, event.PID, pid)
+			} else {
+				p.logger.Infof("audited %s (%s) in process %d of plugin process with pid %d",
+					event.Event, event.Detail, event.PID, pid)
+			}
+			p.auditMutex.Lock()
+			p.auditEvents = append(p.auditEvents, event)
+			p.auditMutex.Unlock()
+		}
+		if err := scanner.Err(); err != nil {
+			p.logger.Warningf("error reading the audit events of plugin process with pid %d (%s)", pid, err)
+		}
+	}()
+}
+
+// AuditReport returns the events reported by the audit hook of the plugin so
+// far, or nil if the plugin has no audit hook.
+func (p *CliPlugin) AuditReport() *AuditReport {
+	if p.audit == nil {
+		return nil
+	}
+	p.auditMutex.Lock()
+	defer p.auditMutex.Unlock()
+	report := &AuditReport{
+		Module: p.containerImage,
+		Events: append([]cliwrapper.AuditEvent{}, p.auditEvents...),
+	}
+	for _, event := range report.Events {
+		if event.Action == config.AuditActionBlock {
+			report.Blocked++
+		}
+	}
+	return report
+}
+
+// reportAuditEvents logs the number of audited events of the stopped plugin
+// process, and writes them to the plugin directory if enabled.
+func (p *CliPlugin) reportAuditEvents() {
+	report := p.AuditReport()
+	if report == nil {
+		return
+	}
+	p.logger.Infof("plugin process with pid %d had %d audited events, %d blocked",
+		p.deployCommand.Process.Pid, len(report.Events), report.Blocked)
+	if !p.auditReport {
+		return
+	}
+	reportPath := filepath.Join(p.pluginDir, AuditReportFile)
+	if err := os.WriteFile(reportPath, []byte(util.JSONEncode(report)), 0600); err != nil {
+		p.logger.Warningf("error writing the audit report %s (%s)", reportPath, err)
+	}
+}
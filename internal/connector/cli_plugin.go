@@ -1,26 +1,200 @@
 package connector
 
 import (
+	"context"
+	"errors"
 	"go.arcalot.io/exex"
 	"go.arcalot.io/log/v2"
+	"go.flow.arcalot.io/pythondeployer/internal/cgroup"
+	"go.flow.arcalot.io/pythondeployer/internal/cliwrapper"
+	"go.flow.arcalot.io/pythondeployer/internal/config"
+	"go.flow.arcalot.io/pythondeployer/internal/util"
 	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type CliPlugin struct {
 	deployCommand  *exex.Cmd
 	containerImage string
 	logger         log.Logger
-	stdin          io.WriteCloser
-	stdout         io.ReadCloser
-	stderr         io.ReadCloser
+	shutdown       config.PluginShutdown
+	limits         config.ResourceLimits
+	// cgroup is the plugin's own cgroup, nil if it has none, and cgroupStats
+	// its resource usage, read when the plugin is stopped
+	cgroup      *cgroup.Cgroup
+	cgroupStats *cgroup.Stats
+	// pluginDir is the working directory of the plugin process, which gets
+	// the resource usage report if resourceReport is set
+	pluginDir      string
+	resourceReport bool
+	// secretsDir holds the secrets of the plugin, shredded once it stopped,
+	// or is empty if the plugin has no secrets
+	secretsDir string
+	// sandboxed is set when the plugin runs under the init of a sandbox,
+	// which reports the signal that killed the plugin as 128 + signal
+	sandboxed     bool
+	started       time.Time
+	exitedAt      time.Time
+	resourceUsage *ResourceUsage
+	stdin         io.WriteCloser
+	stdout        io.ReadCloser
+	stderr        io.ReadCloser
+	// stderrTail keeps the end of the plugin's stderr, which is drained
+	// while the plugin runs, and stderrDrained is closed once it reached EOF
+	stderrTail    *util.TailBuffer
+	stderrDrained chan struct{}
+	// audit reports the events of the audit hook of the plugin, nil if it
+	// has none, which are kept in auditEvents, and written to the plugin
+	// directory if auditReport is set. auditDrained is closed once it
+	// reached EOF.
+	audit        io.ReadCloser
+	auditReport  bool
+	auditMutex   sync.Mutex
+	auditEvents  []cliwrapper.AuditEvent
+	auditDrained chan struct{}
+	// exited is closed once the plugin process has exited and was reaped
+	exited  chan struct{}
+	waitErr error
+	// crashed is set when the plugin process exited with a failure before
+	// it was asked to stop, and exitErr then describes the failure
+	stopping    atomic.Bool
+	crashed     bool
+	oomKilled   bool
+	exitState   *os.ProcessState
+	exitErrOnce sync.Once
+	exitErr     error
+	// stopOnce makes sure the plugin process is only stopped once, even
+	// when its context is cancelled while it is being closed
+	stopOnce  sync.Once
+	stopStage string
+	stopErr   error
 }
 
+// monitor reaps the plugin process as soon as it exits, and stops it when
+// ctx is cancelled before the plugin is closed.
+func (p *CliPlugin) monitor(ctx context.Context) {
+	p.exited = make(chan struct{})
+	go func() {
+		p.exitState, p.waitErr = p.deployCommand.Process.Wait()
+		p.exitedAt = time.Now()
+		if p.waitErr == nil && !p.exitState.Success() && !p.stopping.Load() {
+			p.crashed = true
+			if p.cgroup != nil {
+				stats, err := p.cgroup.Stats()
+				p.oomKilled = err == nil && stats.OOMKills > 0
+			}
+			p.logger.Errorf("plugin process with pid %d exited unexpectedly (%s)",
+				p.deployCommand.Process.Pid, p.exitState)
+		}
+		close(p.exited)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.logger.Infof("context of plugin process with pid %d cancelled, stopping it",
+				p.deployCommand.Process.Pid)
+			_ = p.stopProcess()
+		case <-p.exited:
+		}
+	}()
+}
+
+// drainStderr reads the stderr of the plugin process while it runs, so that
+// the plugin never blocks on a full pipe, forwards every line to the logger,
+// and keeps the last tailSize bytes for error reporting.
+func (p *CliPlugin) drainStderr(tailSize int) {
+	p.stderrTail = util.NewTailBuffer(tailSize)
+	p.stderrDrained = make(chan struct{})
+	lines := &util.LineWriter{OnLine: func(line string) {
+		p.logger.Debugf("python plugin module stderr: %s", line)
+	}}
+	go func() {
+		defer close(p.stderrDrained)
+		_, err := io.Copy(io.MultiWriter(p.stderrTail, lines), p.stderr)
+		if err != nil && !errors.Is(err, os.ErrClosed) {
+			p.logger.Warningf("error reading stderr of plugin process with pid %d (%s)",
+				p.deployCommand.Process.Pid, err)
+		}
+		lines.Flush()
+	}()
+}
+
+// StderrTail returns the last bytes the plugin process wrote to its stderr,
+// up to the configured stderr tail size.
+func (p *CliPlugin) StderrTail() string {
+	return p.stderrTail.String()
+}
+
+// exitError returns a PluginExitError if the plugin process crashed, or
+// nil if it is still running, or was stopped by the deployer. The pipes of a
+// crashed process break just before it can be reaped, so it is given a
+// moment to exit.
+func (p *CliPlugin) exitError() error {
+	select {
+	case <-p.exited:
+	case <-time.After(time.Second):
+		return nil
+	}
+	if !p.crashed {
+		return nil
+	}
+	p.exitErrOnce.Do(func() {
+		// give the drain the chance to read the last words of the process
+		select {
+		case <-p.stderrDrained:
+		case <-time.After(time.Second):
+		}
+		exitErr := &PluginExitError{
+			Module:     p.containerImage,
+			PID:        p.exitState.Pid(),
+			ExitCode:   p.exitState.ExitCode(),
+			StderrTail: p.StderrTail(),
+		}
+		if status, ok := p.exitState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			exitErr.Signal = status.Signal()
+		} else if p.sandboxed && exitErr.ExitCode > 128 && exitErr.ExitCode < 128+65 {
+			exitErr.Signal = syscall.Signal(exitErr.ExitCode - 128)
+		}
+		cpuTime := p.exitState.UserTime() + p.exitState.SystemTime()
+		if p.oomKilled {
+			exitErr.Reason = "OOM killed, its cgroup exceeded memory.max"
+		} else if reason := blockedSyscall(exitErr.Signal, exitErr.StderrTail); reason != "" {
+			exitErr.Reason = reason
+		} else {
+			exitErr.Reason = limitViolation(p.limits, exitErr.Signal, cpuTime, exitErr.StderrTail)
+		}
+		p.exitErr = exitErr
+	})
+	return p.exitErr
+}
+
+// Write writes to the stdin of the plugin process. If the process crashed,
+// the write fails with a PluginExitError.
 func (p *CliPlugin) Write(b []byte) (n int, err error) {
-	return p.stdin.Write(b)
+	n, err = p.stdin.Write(b)
+	if err != nil {
+		if exitErr := p.exitError(); exitErr != nil {
+			return n, exitErr
+		}
+	}
+	return n, err
 }
 
+// Read reads from the stdout of the plugin process. If the process crashed,
+// reading fails with a PluginExitError once all its output was read.
 func (p *CliPlugin) Read(b []byte) (n int, err error) {
-	return p.stdout.Read(b)
+	n, err = p.stdout.Read(b)
+	if err != nil {
+		if exitErr := p.exitError(); exitErr != nil {
+			return n, exitErr
+		}
+	}
+	return n, err
 }
 
 func (p *CliPlugin) Close() error {
@@ -28,7 +202,8 @@ func (p *CliPlugin) Close() error {
 		return err
 	}
 
-	if err := p.stdin.Close(); err != nil {
+	// stdin was already closed to shut the plugin process down
+	if err := p.stdin.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
 		p.logger.Warningf("failed to close stdin pipe")
 	} else {
 		p.logger.Debugf("stdin pipe successfully closed")
@@ -38,11 +213,22 @@ func (p *CliPlugin) Close() error {
 	} else {
 		p.logger.Debugf("stdout pipe successfully closed")
 	}
-	if err := p.stderr.Close(); err != nil {
+	// stderr is closed by KillAndClean when a leftover process holds it open
+	if err := p.stderr.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
 		p.logger.Warningf("failed to close stderr pipe")
 	} else {
 		p.logger.Debugf("stderr pipe successfully closed")
 	}
+	if p.audit != nil {
+		if err := p.audit.Close(); err != nil {
+			p.logger.Warningf("failed to close audit pipe")
+		} else {
+			p.logger.Debugf("audit pipe successfully closed")
+		}
+	}
+	if p.crashed {
+		return p.exitError()
+	}
 	return nil
 }
 
@@ -50,21 +236,159 @@ func (p *CliPlugin) ID() string {
 	return p.containerImage
 }
 
+// KillAndClean stops the plugin process, giving it a chance to exit on its
+// own first: its stdin is closed, which ends the ATP session, then it is sent
+// SIGTERM, and only when both grace periods have passed is it killed. Every
+// signal goes to the plugin's whole process group, so that the subprocesses
+// started by the plugin are stopped along with it.
 func (p *CliPlugin) KillAndClean() error {
-	p.logger.Infof("killing config process with pid %d", p.deployCommand.Process.Pid)
+	if err := p.stopProcess(); err != nil {
+		return err
+	}
+	// the whole process group is gone, so nothing holds stderr open anymore,
+	// unless a process escaped both the process group and the cgroup
+	select {
+	case <-p.stderrDrained:
+	case <-time.After(time.Second):
+		p.logger.Warningf("stderr of plugin process with pid %d is still open after it stopped, closing it",
+			p.deployCommand.Process.Pid)
+		_ = p.stderr.Close()
+		<-p.stderrDrained
+	}
+	return nil
+}
 
-	// even if this error was non-nil, we would not handle it differently
-	_ = p.deployCommand.Process.Kill()
+// stopProcess stops the plugin process the first time it is called, and
+// waits for the first call to finish on later calls.
+func (p *CliPlugin) stopProcess() error {
+	p.stopOnce.Do(func() {
+		p.stopping.Store(true)
+		pid := p.deployCommand.Process.Pid
+		p.stopStage, p.stopErr = p.stop()
+		if p.stopErr == nil {
+			p.logger.Infof("plugin process with pid %d exited after %s", pid, p.stopStage)
+		}
+		// the processes the plugin left behind are not worth waiting for
+		if err := p.signal(syscall.SIGKILL); err == nil {
+			p.logger.Debugf("killed the remaining processes of plugin process group %d", pid)
+		}
+		p.releaseCgroup()
+		p.reportResourceUsage()
+		// the processes that could still report audited events are gone,
+		// unless they escaped both the process group and the cgroup
+		select {
+		case <-p.auditDrained:
+		case <-time.After(time.Second):
+		}
+		p.reportAuditEvents()
+		p.shredSecrets()
+	})
+	return p.stopErr
+}
 
-	_, err := p.deployCommand.Process.Wait()
+// releaseCgroup kills whatever is left in the plugin's cgroup, including
+// the processes that left its process group, records and logs the resource
+// usage of the cgroup, and removes it.
+func (p *CliPlugin) releaseCgroup() {
+	if p.cgroup == nil {
+		return
+	}
+	pid := p.deployCommand.Process.Pid
+	if err := p.cgroup.Kill(); err != nil {
+		p.logger.Debugf("error killing the cgroup of plugin process with pid %d (%s)", pid, err)
+	}
+	stats, err := p.cgroup.Stats()
 	if err != nil {
-		return err
+		p.logger.Warningf("error reading the resource usage of the cgroup of plugin process with pid %d (%s)",
+			pid, err)
+	} else {
+		p.cgroupStats = &stats
+		p.logger.Infof("cgroup of plugin process with pid %d: peak memory %d bytes, CPU time %s, %d OOM kills",
+			pid, stats.MemoryPeak, stats.CPUUsage, stats.OOMKills)
+	}
+	if err := p.cgroup.Remove(); err != nil {
+		p.logger.Warningf("%s", err)
 	}
+}
 
-	slurp, err := io.ReadAll(p.stderr)
-	if err != nil {
-		return err
+// reportResourceUsage records and logs the resource usage of the exited
+// plugin process, and writes it to the plugin directory if enabled.
+func (p *CliPlugin) reportResourceUsage() {
+	if p.exitState == nil {
+		return
 	}
-	p.logger.Debugf("python plugin module stderr: %s", slurp)
-	return nil
+	usage := newResourceUsage(p.containerImage, p.exitState, p.exitedAt.Sub(p.started))
+	p.resourceUsage = usage
+	p.logger.Infof(
+		"plugin process with pid %d used: max RSS %d bytes, user CPU %s, system CPU %s, "+
+			"block I/O %d in / %d out, context switches %d voluntary / %d involuntary, wall clock %s",
+		p.exitState.Pid(), usage.MaxRSS, usage.UserCPU, usage.SystemCPU, usage.BlockInput, usage.BlockOutput,
+		usage.VoluntaryContextSwitches, usage.InvoluntaryContextSwitches, usage.WallClock)
+	if !p.resourceReport {
+		return
+	}
+	reportPath := filepath.Join(p.pluginDir, ResourceUsageReportFile)
+	if err := os.WriteFile(reportPath, []byte(util.JSONEncode(usage)), 0600); err != nil {
+		p.logger.Warningf("error writing the resource usage report %s (%s)", reportPath, err)
+	}
+}
+
+// shredSecrets shreds the secrets of the stopped plugin process.
+func (p *CliPlugin) shredSecrets() {
+	if p.secretsDir == "" {
+		return
+	}
+	if err := shredSecrets(p.secretsDir); err != nil {
+		p.logger.Errorf("error shredding the secrets of plugin process with pid %d in %s (%s)",
+			p.deployCommand.Process.Pid, p.secretsDir, err)
+	}
+}
+
+// ResourceUsage returns the resource usage of the plugin process, collected
+// when the plugin was stopped, or nil if the plugin is running.
+func (p *CliPlugin) ResourceUsage() *ResourceUsage {
+	return p.resourceUsage
+}
+
+// CgroupStats returns the resource usage of the plugin's cgroup, read when
+// the plugin was stopped, or nil if the plugin had no cgroup or is running.
+func (p *CliPlugin) CgroupStats() *cgroup.Stats {
+	return p.cgroupStats
+}
+
+// stop runs the shutdown stages until the plugin process exits, and returns
+// the stage that made it exit.
+func (p *CliPlugin) stop() (string, error) {
+	pid := p.deployCommand.Process.Pid
+	p.logger.Debugf("closing stdin of plugin process with pid %d", pid)
+	if err := p.stdin.Close(); err != nil {
+		p.logger.Warningf("failed to close stdin pipe of plugin process with pid %d (%s)", pid, err)
+	}
+	select {
+	case <-p.exited:
+		return "its stdin was closed", p.waitErr
+	case <-time.After(p.shutdown.StdinGracePeriod):
+	}
+
+	p.logger.Debugf("plugin process with pid %d is still running after %s, sending SIGTERM",
+		pid, p.shutdown.StdinGracePeriod)
+	// even if this error was non-nil, we would not handle it differently
+	_ = p.signal(syscall.SIGTERM)
+	select {
+	case <-p.exited:
+		return "SIGTERM", p.waitErr
+	case <-time.After(p.shutdown.TerminateGracePeriod):
+	}
+
+	p.logger.Warningf("plugin process with pid %d is still running after %s, sending SIGKILL",
+		pid, p.shutdown.TerminateGracePeriod)
+	_ = p.signal(syscall.SIGKILL)
+	<-p.exited
+	return "SIGKILL", p.waitErr
+}
+
+// signal sends a signal to every process in the process group of the plugin
+// process, which is the group leader.
+func (p *CliPlugin) signal(sig syscall.Signal) error {
+	return syscall.Kill(-p.deployCommand.Process.Pid, sig)
 }
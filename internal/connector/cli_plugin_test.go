@@ -0,0 +1,676 @@
+package connector_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.arcalot.io/assert"
+	"go.arcalot.io/exex"
+	"go.arcalot.io/log/v2"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"go.flow.arcalot.io/pythondeployer/internal/cgroup"
+	"go.flow.arcalot.io/pythondeployer/internal/cliwrapper"
+	"go.flow.arcalot.io/pythondeployer/internal/config"
+	"go.flow.arcalot.io/pythondeployer/internal/connector"
+	"go.flow.arcalot.io/pythondeployer/internal/seccomp"
+)
+
+// scriptCliStub deploys a python script instead of a python module, so that
+// the behavior of the plugin process is under the test's control.
+type scriptCliStub struct {
+	pythonCliStub
+	pythonPath string
+	script     string
+	// audit gives the script the audit report pipe, as file descriptor 3
+	audit bool
+}
+
+func (p *scriptCliStub) Deploy(
+	_ string,
+	pluginDirAbsPath string,
+	pluginCgroup *cgroup.Cgroup,
+	secretsDir string,
+) (io.WriteCloser, io.ReadCloser, io.ReadCloser, io.ReadCloser, *exex.Cmd, error) {
+	deployCommand := exex.Command(p.pythonPath, "-c", p.script)
+	deployCommand.Dir = pluginDirAbsPath
+	deployCommand.Env = append(os.Environ(), cliwrapper.SecretsDirVariable+"="+secretsDir)
+	deployCommand.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if pluginCgroup != nil {
+		cgroupDir, err := pluginCgroup.Open()
+		if err != nil {
+			return nil, nil, nil, nil, nil, err
+		}
+		defer func() {
+			_ = cgroupDir.Close()
+		}()
+		deployCommand.SysProcAttr.UseCgroupFD = true
+		deployCommand.SysProcAttr.CgroupFD = int(cgroupDir.Fd())
+	}
+	stdin, err := deployCommand.StdinPipe()
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	stdout, err := deployCommand.StdoutPipe()
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	stderr, err := deployCommand.StderrPipe()
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	if !p.audit {
+		return stdin, stdout, stderr, nil, deployCommand, deployCommand.Start()
+	}
+	audit, auditWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	defer func() {
+		_ = auditWriter.Close()
+	}()
+	deployCommand.ExtraFiles = []*os.File{auditWriter}
+	return stdin, stdout, stderr, audit, deployCommand, deployCommand.Start()
+}
+
+// scriptModule is the module name the scripts are deployed as.
+const scriptModule = "script-plugin@git+https://github.com/arcalot/script-plugin"
+
+// DeployScript deploys a python script as a plugin, and returns the plugin
+// along with its plugin directory.
+func DeployScript(t *testing.T, cfg *config.Config, script string) (*connector.CliPlugin, string) {
+	return DeployScriptWithContext(context.Background(), t, cfg, script)
+}
+
+// DeployScriptWithContext deploys a python script as a plugin with the given
+// deploy context.
+func DeployScriptWithContext(
+	ctx context.Context,
+	t *testing.T,
+	cfg *config.Config,
+	script string,
+) (*connector.CliPlugin, string) {
+	return deployScript(ctx, t, cfg, script, nil)
+}
+
+// DeployScriptInCgroup deploys a python script as a plugin running in a
+// cgroup of its own, created in parent.
+func DeployScriptInCgroup(
+	t *testing.T,
+	cfg *config.Config,
+	script string,
+	parent *cgroup.Parent,
+) (*connector.CliPlugin, string) {
+	return deployScript(context.Background(), t, cfg, script, parent)
+}
+
+func deployScript(
+	ctx context.Context,
+	t *testing.T,
+	cfg *config.Config,
+	script string,
+	cgroups *cgroup.Parent,
+) (*connector.CliPlugin, string) {
+	pythonPath, err := GetPythonPath()
+	assert.NoError(t, err)
+	connectorDir := t.TempDir()
+	testPythonCli := &scriptCliStub{
+		pythonCliStub: pythonCliStub{PyModExists: true},
+		pythonPath:    pythonPath,
+		script:        script,
+		audit:         cfg.AuditHook.Enabled,
+	}
+	connector_ := connector.NewConnector(
+		cfg, log.NewTestLogger(t), connectorDir, testPythonCli, connector.NewPullCoordinator(), cgroups)
+	plugin, err := connector_.Deploy(ctx, scriptModule)
+	assert.NoError(t, err)
+	pluginDirs, err := filepath.Glob(filepath.Join(connectorDir, "*"))
+	assert.NoError(t, err)
+	assert.Equals(t, len(pluginDirs), 1)
+	return plugin.(*connector.CliPlugin), pluginDirs[0]
+}
+
+// WaitForFile waits for a plugin script to create a file, to know that it
+// reached a given point.
+func WaitForFile(t *testing.T, path string) {
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", path)
+}
+
+func TestCliPlugin_CloseShutdownStages(t *testing.T) {
+	const gracePeriod = 500 * time.Millisecond
+	testCases := map[string]struct {
+		script         string
+		expectedMarker string
+		minDuration    time.Duration
+	}{
+		"exits_on_stdin_eof": {
+			`
+import sys
+open("ready", "w").close()
+try:
+    sys.stdin.read()
+finally:
+    open("eof", "w").close()
+`,
+			"eof",
+			0,
+		},
+		"exits_on_sigterm": {
+			`
+import signal, sys, time
+def terminate(signum, frame):
+    open("sigterm", "w").close()
+    sys.exit(0)
+signal.signal(signal.SIGTERM, terminate)
+open("ready", "w").close()
+while True:
+    time.sleep(1)
+`,
+			"sigterm",
+			gracePeriod,
+		},
+		"ignores_sigterm": {
+			`
+import signal, time
+signal.signal(signal.SIGTERM, signal.SIG_IGN)
+open("ready", "w").close()
+while True:
+    time.sleep(1)
+`,
+			"",
+			2 * gracePeriod,
+		},
+	}
+	for name, tc := range testCases {
+		localTc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			cfg := &config.Config{
+				PluginShutdown: config.PluginShutdown{
+					StdinGracePeriod:     gracePeriod,
+					TerminateGracePeriod: gracePeriod,
+				},
+			}
+			plugin, pluginDir := DeployScript(t, cfg, localTc.script)
+			WaitForFile(t, filepath.Join(pluginDir, "ready"))
+
+			start := time.Now()
+			assert.NoError(t, plugin.Close())
+			duration := time.Since(start)
+			assert.Equals(t, duration >= localTc.minDuration, true)
+			assert.Equals(t, duration < localTc.minDuration+gracePeriod, true)
+			if localTc.expectedMarker != "" {
+				_, err := os.Stat(filepath.Join(pluginDir, localTc.expectedMarker))
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// grandchildScript starts a subprocess that outlives the plugin process, and
+// stores its pid in the grandchild file.
+const grandchildScript = `
+import subprocess, sys
+child = subprocess.Popen([sys.executable, "-c", "import time; time.sleep(60)"])
+with open("grandchild.tmp", "w") as f:
+    f.write(str(child.pid))
+import os
+os.rename("grandchild.tmp", "grandchild")
+sys.stdin.read()
+`
+
+// ReadGrandchildPid returns the pid of the subprocess started by
+// grandchildScript.
+func ReadGrandchildPid(t *testing.T, pluginDir string) int {
+	WaitForFile(t, filepath.Join(pluginDir, "grandchild"))
+	pidBytes, err := os.ReadFile(filepath.Join(pluginDir, "grandchild"))
+	assert.NoError(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidBytes)))
+	assert.NoError(t, err)
+	return pid
+}
+
+// WaitForProcessGone waits for a process to be gone, which includes it
+// having been reaped by its parent, the init process in this case.
+func WaitForProcessGone(t *testing.T, pid int) {
+	for i := 0; i < 100; i++ {
+		if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("process %d is still running", pid)
+}
+
+func TestCliPlugin_CloseKillsProcessTree(t *testing.T) {
+	plugin, pluginDir := DeployScript(t, &config.Config{}, grandchildScript)
+	grandchildPid := ReadGrandchildPid(t, pluginDir)
+	assert.NoError(t, syscall.Kill(grandchildPid, 0))
+
+	assert.NoError(t, plugin.Close())
+	WaitForProcessGone(t, grandchildPid)
+}
+
+func TestCliPlugin_ContextCancelKillsProcessTree(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	plugin, pluginDir := DeployScriptWithContext(ctx, t, &config.Config{}, grandchildScript)
+	grandchildPid := ReadGrandchildPid(t, pluginDir)
+
+	cancel()
+	WaitForProcessGone(t, grandchildPid)
+	assert.NoError(t, plugin.Close())
+}
+
+func TestCliPlugin_StderrDrained(t *testing.T) {
+	// far more than fits in a pipe buffer
+	script := `
+import sys
+for i in range(20000):
+    sys.stderr.write("line %05d of stderr output\n" % i)
+sys.stderr.flush()
+open("done", "w").close()
+sys.stdin.read()
+`
+	plugin, pluginDir := DeployScript(t, &config.Config{StderrTailSize: 56}, script)
+	WaitForFile(t, filepath.Join(pluginDir, "done"))
+	assert.NoError(t, plugin.Close())
+	assert.Equals(t, plugin.StderrTail(), "line 19998 of stderr output\nline 19999 of stderr output\n")
+}
+
+func TestCliPlugin_StderrHeldOpen(t *testing.T) {
+	// a process that escaped the process group of the plugin, and which no
+	// cgroup kills, keeps the stderr of the plugin open
+	script := `
+import subprocess, sys
+escaped = subprocess.Popen(["sleep", "60"], start_new_session=True)
+with open("escaped.pid", "w") as f:
+    f.write(str(escaped.pid))
+sys.stdin.read()
+`
+	plugin, pluginDir := DeployScript(t, &config.Config{}, script)
+	pidPath := filepath.Join(pluginDir, "escaped.pid")
+	WaitForFile(t, pidPath)
+	pid, err := os.ReadFile(pidPath)
+	assert.NoError(t, err)
+	escapedPid, err := strconv.Atoi(string(pid))
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		_ = syscall.Kill(escapedPid, syscall.SIGKILL)
+	})
+
+	closed := make(chan error)
+	go func() {
+		closed <- plugin.Close()
+	}()
+	select {
+	case err := <-closed:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("closing the plugin waited for the stderr held open by process %d", escapedPid)
+	}
+}
+
+func TestCliPlugin_CrashExitError(t *testing.T) {
+	testCases := map[string]struct {
+		script           string
+		expectedExitCode int
+		expectedSignal   syscall.Signal
+	}{
+		"exit_code": {
+			`
+import sys
+sys.stderr.write("ImportError: no module named boom\n")
+sys.exit(3)
+`,
+			3,
+			0,
+		},
+		"signal": {
+			`
+import os, signal, sys
+sys.stderr.write("ImportError: no module named boom\n")
+sys.stderr.flush()
+os.kill(os.getpid(), signal.SIGSEGV)
+`,
+			-1,
+			syscall.SIGSEGV,
+		},
+	}
+	for name, tc := range testCases {
+		localTc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			plugin, _ := DeployScript(t, &config.Config{StderrTailSize: 1024}, localTc.script)
+
+			_, err := io.ReadAll(plugin)
+			var exitErr *connector.PluginExitError
+			assert.Equals(t, errors.As(err, &exitErr), true)
+			assert.Equals(t, exitErr.Module, scriptModule)
+			assert.Equals(t, exitErr.ExitCode, localTc.expectedExitCode)
+			assert.Equals(t, exitErr.Signal, localTc.expectedSignal)
+			assert.Equals(t, exitErr.StderrTail, "ImportError: no module named boom\n")
+			assert.Contains(t, exitErr.Error(), "ImportError: no module named boom")
+
+			_, err = plugin.Write([]byte("{}"))
+			assert.Equals(t, errors.As(err, &exitErr), true)
+			err = plugin.Close()
+			assert.Equals(t, errors.As(err, &exitErr), true)
+		})
+	}
+}
+
+func TestCliPlugin_SuccessfulExitIsNotAnError(t *testing.T) {
+	plugin, _ := DeployScript(t, &config.Config{}, `print("done")`)
+	output, err := io.ReadAll(plugin)
+	assert.NoError(t, err)
+	assert.Equals(t, string(output), "done\n")
+	assert.NoError(t, plugin.Close())
+}
+
+func TestCliPlugin_ResourceLimitViolation(t *testing.T) {
+	testCases := map[string]struct {
+		script         string
+		limits         config.ResourceLimits
+		expectedReason string
+	}{
+		"open_files": {
+			`
+import resource
+resource.setrlimit(resource.RLIMIT_NOFILE, (16, 16))
+files = [open("/dev/null") for _ in range(32)]
+`,
+			config.ResourceLimits{OpenFiles: schema.PointerTo(int64(16))},
+			"open files limit of 16 exceeded",
+		},
+		"cpu_time": {
+			`
+import resource
+resource.setrlimit(resource.RLIMIT_CPU, (1, 2))
+while True:
+    pass
+`,
+			config.ResourceLimits{CPUTime: schema.PointerTo(time.Second)},
+			"CPU time limit of 1s exceeded",
+		},
+		"cpu_time_killed": {
+			`
+import resource, signal
+signal.signal(signal.SIGXCPU, signal.SIG_IGN)
+resource.setrlimit(resource.RLIMIT_CPU, (1, 2))
+while True:
+    pass
+`,
+			config.ResourceLimits{CPUTime: schema.PointerTo(time.Second)},
+			"CPU time limit of 1s exceeded",
+		},
+		"no_limit": {
+			`
+raise OSError(24, "Too many open files")
+`,
+			config.ResourceLimits{},
+			"",
+		},
+	}
+	for name, tc := range testCases {
+		localTc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			cfg := &config.Config{
+				StderrTailSize: 1024,
+				Modules: map[string]config.ModuleSettings{
+					"script-plugin": {ResourceLimits: localTc.limits},
+				},
+			}
+			plugin, _ := DeployScript(t, cfg, localTc.script)
+			_, err := io.ReadAll(plugin)
+			var exitErr *connector.PluginExitError
+			assert.Equals(t, errors.As(err, &exitErr), true)
+			assert.Equals(t, exitErr.Reason, localTc.expectedReason)
+			assert.NoError(t, plugin.KillAndClean())
+		})
+	}
+}
+
+func TestCliPlugin_SeccompBlockedSyscall(t *testing.T) {
+	ptrace, supported := seccomp.SyscallNumber("ptrace")
+	if !supported {
+		t.Skipf("seccomp profiles are not supported on %s", runtime.GOARCH)
+	}
+	testCases := map[string]struct {
+		report         string
+		expectedReason string
+	}{
+		"reported": {
+			fmt.Sprintf("seccomp profile blocked system call %d", ptrace),
+			"system call ptrace blocked by the seccomp profile",
+		},
+		"not_reported": {
+			"",
+			"a system call was blocked by the seccomp profile",
+		},
+	}
+	for name, tc := range testCases {
+		localTc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			// what the launcher does when the seccomp profile traps a system call
+			script := fmt.Sprintf(`
+import os, signal, sys
+sys.stderr.write(%q)
+sys.stderr.flush()
+os.kill(os.getpid(), signal.SIGSYS)
+`, localTc.report+"\n")
+			plugin, _ := DeployScript(t, &config.Config{StderrTailSize: 1024}, script)
+			_, err := io.ReadAll(plugin)
+			var exitErr *connector.PluginExitError
+			assert.Equals(t, errors.As(err, &exitErr), true)
+			assert.Equals(t, exitErr.Signal, syscall.SIGSYS)
+			assert.Equals(t, exitErr.Reason, localTc.expectedReason)
+			assert.NoError(t, plugin.KillAndClean())
+		})
+	}
+}
+
+func TestCliPlugin_ResourceUsage(t *testing.T) {
+	script := `
+import sys
+data = bytearray(64 * 1024 * 1024)
+for i in range(0, len(data), 4096):
+    data[i] = 1
+open("ready", "w").close()
+sys.stdin.read()
+`
+	plugin, pluginDir := DeployScript(t, &config.Config{ResourceReport: true}, script)
+	WaitForFile(t, filepath.Join(pluginDir, "ready"))
+	assert.Nil(t, plugin.ResourceUsage())
+	assert.NoError(t, plugin.Close())
+
+	usage := plugin.ResourceUsage()
+	assert.NotNil(t, usage)
+	assert.Equals(t, usage.Module, scriptModule)
+	assert.Equals(t, usage.MaxRSS >= 64*1024*1024, true)
+	assert.Equals(t, usage.UserCPU+usage.SystemCPU > 0, true)
+	assert.Equals(t, usage.WallClock > 0, true)
+
+	reportJSON, err := os.ReadFile(filepath.Join(pluginDir, connector.ResourceUsageReportFile))
+	assert.NoError(t, err)
+	var report connector.ResourceUsage
+	assert.NoError(t, json.Unmarshal(reportJSON, &report))
+	assert.Equals(t, report, *usage)
+}
+
+// CreateTestCgroupParent creates a child of the cgroup of the test process
+// to hold the cgroups of the plugins of the test, so that the cgroup of the
+// test process, which holds processes, is left alone. The test is skipped
+// when the controllers are not available to the child.
+func CreateTestCgroupParent(t *testing.T) *cgroup.Parent {
+	const mountPoint = "/sys/fs/cgroup"
+	cgroups, err := os.ReadFile("/proc/self/cgroup")
+	assert.NoError(t, err)
+	ownCgroup, found := "", false
+	for _, line := range strings.Split(string(cgroups), "\n") {
+		if ownCgroup, found = strings.CutPrefix(line, "0::"); found {
+			break
+		}
+	}
+	if _, err := os.Stat(filepath.Join(mountPoint, "cgroup.controllers")); !found || err != nil {
+		t.Skipf("cgroup v2 is not mounted on %s", mountPoint)
+	}
+	parentPath, err := os.MkdirTemp(filepath.Join(mountPoint, ownCgroup), "arcaflow-test-")
+	if err != nil {
+		t.Skipf("cannot create a child of cgroup %s (%s)", ownCgroup, err)
+	}
+	t.Cleanup(func() {
+		assert.NoError(t, syscall.Rmdir(parentPath))
+	})
+	parent, err := cgroup.NewParent(strings.TrimPrefix(parentPath, mountPoint))
+	if errors.Is(err, cgroup.ErrUnavailable) {
+		t.Skipf("cgroup v2 delegation is unavailable on this host (%s)", err)
+	}
+	assert.NoError(t, err)
+	return parent
+}
+
+func TestCliPlugin_OOMKilled(t *testing.T) {
+	parent := CreateTestCgroupParent(t)
+	cfg := &config.Config{
+		StderrTailSize: 1024,
+		Cgroup: config.Cgroup{
+			Enabled:   true,
+			MemoryMax: schema.PointerTo(int64(32 << 20)),
+		},
+	}
+	// far more than memory.max, with every page written
+	script := `
+memory = b"x" * (256 << 20)
+`
+	plugin, _ := DeployScriptInCgroup(t, cfg, script, parent)
+	_, err := io.ReadAll(plugin)
+	var exitErr *connector.PluginExitError
+	assert.Equals(t, errors.As(err, &exitErr), true)
+	assert.Equals(t, exitErr.Signal, syscall.SIGKILL)
+	assert.Equals(t, exitErr.Reason, "OOM killed, its cgroup exceeded memory.max")
+	assert.NoError(t, plugin.KillAndClean())
+	assert.Equals(t, plugin.CgroupStats().OOMKills > 0, true)
+}
+
+func TestCliPlugin_AuditReport(t *testing.T) {
+	// what the audit hook reports, with an invalid line in between
+	script := `
+import os, sys
+os.write(3, b'{"pid": 7, "category": "os.system", "event": "os.system", "action": "log", "detail": "true"}\n')
+os.write(3, b'not json\n')
+os.write(3, b'{"pid": 8, "category": "open", "event": "open", "action": "block", "detail": "/etc/shadow"}\n')
+open("ready", "w").close()
+sys.stdin.read()
+`
+	cfg := &config.Config{AuditHook: config.AuditHook{Enabled: true, Report: true}}
+	plugin, pluginDir := DeployScript(t, cfg, script)
+	WaitForFile(t, filepath.Join(pluginDir, "ready"))
+	assert.NoError(t, plugin.Close())
+
+	expected := connector.AuditReport{
+		Module: scriptModule,
+		Events: []cliwrapper.AuditEvent{
+			{PID: 7, Category: config.AuditSystem, Event: "os.system", Action: config.AuditActionLog, Detail: "true"},
+			{PID: 8, Category: config.AuditOpen, Event: "open", Action: config.AuditActionBlock, Detail: "/etc/shadow"},
+		},
+		Blocked: 1,
+	}
+	assert.Equals(t, *plugin.AuditReport(), expected)
+	reportJSON, err := os.ReadFile(filepath.Join(pluginDir, connector.AuditReportFile))
+	assert.NoError(t, err)
+	var report connector.AuditReport
+	assert.NoError(t, json.Unmarshal(reportJSON, &report))
+	assert.Equals(t, report, expected)
+
+	// plugins without an audit hook have no report
+	plugin, pluginDir = DeployScript(t, &config.Config{}, "import sys; sys.stdin.read()")
+	assert.NoError(t, plugin.Close())
+	assert.Nil(t, plugin.AuditReport())
+	_, err = os.Stat(filepath.Join(pluginDir, connector.AuditReportFile))
+	assert.Equals(t, os.IsNotExist(err), true)
+}
+
+func TestCliPlugin_Secrets(t *testing.T) {
+	hostDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(hostDir, "api-key"), []byte("s3cr3t"), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(hostDir, "token"), []byte("t0k3n"), 0600))
+	cfg := &config.Config{
+		Secrets: map[string]string{"api-key": filepath.Join(hostDir, "api-key")},
+		Modules: map[string]config.ModuleSettings{
+			"script-plugin": {Secrets: map[string]string{"token": filepath.Join(hostDir, "token")}},
+		},
+	}
+	plugin, pluginDir := DeployScript(t, cfg, `
+import json, os, stat, sys
+secrets_dir = os.environ["ARCAFLOW_SECRETS_DIR"]
+secrets = {}
+for name in os.listdir(secrets_dir):
+    path = os.path.join(secrets_dir, name)
+    with open(path) as secret:
+        secrets[name] = {"value": secret.read(), "mode": stat.S_IMODE(os.stat(path).st_mode)}
+with open("secrets.json.tmp", "w") as report:
+    json.dump({"dir": secrets_dir, "secrets": secrets}, report)
+os.rename("secrets.json.tmp", "secrets.json")
+sys.stdin.read()
+`)
+	WaitForFile(t, filepath.Join(pluginDir, "secrets.json"))
+	assert.NoError(t, plugin.Close())
+
+	reportJSON, err := os.ReadFile(filepath.Join(pluginDir, "secrets.json"))
+	assert.NoError(t, err)
+	var report struct {
+		Dir     string `json:"dir"`
+		Secrets map[string]struct {
+			Value string      `json:"value"`
+			Mode  os.FileMode `json:"mode"`
+		} `json:"secrets"`
+	}
+	assert.NoError(t, json.Unmarshal(reportJSON, &report))
+	assert.Equals(t, len(report.Secrets), 2)
+	assert.Equals(t, report.Secrets["api-key"].Value, "s3cr3t")
+	assert.Equals(t, report.Secrets["api-key"].Mode, os.FileMode(0400))
+	assert.Equals(t, report.Secrets["token"].Value, "t0k3n")
+	// the secrets are shredded when the plugin is closed
+	_, err = os.Stat(report.Dir)
+	assert.Equals(t, errors.Is(err, os.ErrNotExist), true)
+	// the files on the host are left alone
+	_, err = os.Stat(filepath.Join(hostDir, "api-key"))
+	assert.NoError(t, err)
+}
+
+func TestCliPlugin_SecretMissing(t *testing.T) {
+	pythonPath, err := GetPythonPath()
+	assert.NoError(t, err)
+	cfg := &config.Config{
+		Secrets: map[string]string{"api-key": filepath.Join(t.TempDir(), "missing")},
+	}
+	testPythonCli := &scriptCliStub{
+		pythonCliStub: pythonCliStub{PyModExists: true},
+		pythonPath:    pythonPath,
+		script:        "",
+	}
+	connector_ := connector.NewConnector(
+		cfg, log.NewTestLogger(t), t.TempDir(), testPythonCli, connector.NewPullCoordinator(), nil)
+	_, err = connector_.Deploy(context.Background(), scriptModule)
+	assert.Error(t, err)
+	assert.Equals(t, strings.Contains(err.Error(), "error injecting secret api-key"), true)
+}
@@ -2,37 +2,49 @@ package connector
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"go.arcalot.io/log/v2"
 	"go.flow.arcalot.io/deployer"
+	"go.flow.arcalot.io/pythondeployer/internal/cgroup"
 	"go.flow.arcalot.io/pythondeployer/internal/cliwrapper"
 	"go.flow.arcalot.io/pythondeployer/internal/config"
+	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
+	"time"
 )
 
 type Connector struct {
 	// the working directory for this connector to persist filesystem
 	// side-effects (i.e. install a python module)
 	connectorDir string
-	// the set of python modules this connector has seen installed
-	// into its connector directory
-	modules   map[string]struct{}
+	// the python modules pulled by any connector of the same factory
+	pulls *PullCoordinator
+	// the parent of the plugin cgroups, nil when plugins get no cgroup
+	cgroups   *cgroup.Parent
 	pythonCli cliwrapper.CliWrapper
 	config    *config.Config
 	logger    log.Logger
-	lock      sync.Mutex
 }
 
-func NewConnector(config *config.Config, logger log.Logger, connectorDir string, pythonCli cliwrapper.CliWrapper) Connector {
+func NewConnector(
+	config *config.Config,
+	logger log.Logger,
+	connectorDir string,
+	pythonCli cliwrapper.CliWrapper,
+	pulls *PullCoordinator,
+	cgroups *cgroup.Parent,
+) Connector {
 	return Connector{
 		config:       config,
 		logger:       logger,
 		connectorDir: connectorDir,
 		pythonCli:    pythonCli,
-		lock:         sync.Mutex{},
-		modules:      make(map[string]struct{}),
+		pulls:        pulls,
+		cgroups:      cgroups,
 	}
 }
 
@@ -42,36 +54,74 @@ func (c *Connector) Deploy(ctx context.Context, image string) (deployer.Plugin,
 		return nil, err
 	}
 
+	moduleSettings, err := cliwrapper.ModuleSettings(c.config, image)
+	if err != nil {
+		return nil, err
+	}
+
 	pluginDirAbspath, err := c.CreatePluginDir("")
 	if err != nil {
 		return nil, err
 	}
 
-	stdin, stdout, stderr, deployCommand, err := c.pythonCli.Deploy(image, *pluginDirAbspath)
+	secretsDir, err := injectSecrets(moduleSettings.Secrets, *pluginDirAbspath)
+	if err != nil {
+		return nil, err
+	}
+
+	pluginCgroup := c.createCgroup(*pluginDirAbspath)
+	stdin, stdout, stderr, audit, deployCommand, err := c.pythonCli.Deploy(
+		image, *pluginDirAbspath, pluginCgroup, secretsDir)
 	if err != nil {
+		if pluginCgroup != nil {
+			_ = pluginCgroup.Remove()
+		}
+		if secretsDir != "" {
+			_ = shredSecrets(secretsDir)
+		}
 		return nil, err
 	}
 
-	cliPlugin := CliPlugin{
+	cliPlugin := &CliPlugin{
 		containerImage: image,
 		stdin:          stdin,
 		stdout:         stdout,
 		stderr:         stderr,
+		audit:          audit,
+		auditReport:    c.config.AuditHook.Report,
 		deployCommand:  deployCommand,
 		logger:         c.logger,
+		shutdown:       c.config.PluginShutdown,
+		limits:         moduleSettings.ResourceLimits,
+		cgroup:         pluginCgroup,
+		pluginDir:      *pluginDirAbspath,
+		secretsDir:     secretsDir,
+		sandboxed:      c.config.Sandbox.Enabled,
+		resourceReport: c.config.ResourceReport,
+		started:        time.Now(),
 	}
+	cliPlugin.drainStderr(int(c.config.StderrTailSize))
+	cliPlugin.drainAudit()
+	cliPlugin.monitor(ctx)
 
-	return &cliPlugin, nil
+	return cliPlugin, nil
 }
 
 // PullMod synchronizes the creation of Python virtual environments for Python
 // module plugins, during the concurrent instantiation of Python cli plugins,
-// so that this connector will only pull a module once if it is not present
-func (c *Connector) PullMod(_ context.Context, fullModuleName string, pythonCli cliwrapper.CliWrapper) error {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	_, cachedPath := c.modules[fullModuleName]
-	if !cachedPath {
+// so that a module is only pulled once per process if it is not present, even
+// when it is requested by several connectors, as long as they pull it with
+// the same settings
+func (c *Connector) PullMod(ctx context.Context, fullModuleName string, pythonCli cliwrapper.CliWrapper) error {
+	modulePath, err := pythonCli.GetModulePath(fullModuleName)
+	if err != nil {
+		return fmt.Errorf("error looking for python module (%w)", err)
+	}
+	settings, err := cliwrapper.PullSettings(c.config)
+	if err != nil {
+		return fmt.Errorf("error digesting the pull settings of python module %s (%w)", fullModuleName, err)
+	}
+	cached, err := c.pulls.Pull(ctx, *modulePath, settings, func(ctx context.Context) error {
 		modulePresent, err := pythonCli.ModuleExists(fullModuleName)
 		if err != nil {
 			return fmt.Errorf("error looking for python module (%w)", err)
@@ -80,14 +130,121 @@ func (c *Connector) PullMod(_ context.Context, fullModuleName string, pythonCli
 			// file is not present, or our pull policy is Always, so let's go
 			c.logger.Debugf("pull policy: %s", c.config.ModulePullPolicy)
 			c.logger.Debugf("pulling module: %s", fullModuleName)
-			if err := pythonCli.PullModule(fullModuleName); err != nil {
-				return err
+			return c.pullWithRetries(ctx, fullModuleName, pythonCli)
+		}
+		return nil
+	})
+	if cached {
+		c.logger.Debugf("module %s was already pulled by this process", fullModuleName)
+	}
+	return err
+}
+
+// defaultPrefetchConcurrency is the number of modules prefetched at once
+// when the configuration does not set it.
+const defaultPrefetchConcurrency = 4
+
+// Prefetch pulls a list of python modules in parallel, so that deploying
+// them later does not pay the installation cost, for example to warm every
+// plugin of a workflow before it starts. At most PrefetchConcurrency modules
+// are pulled at once. Modules that are already present are only pulled again
+// with the Always pull policy. The progress of every pull is sent to the
+// factory's progress reporter, and each finished module is logged. Cancelling
+// ctx skips the modules not pulled yet. The returned error joins the errors
+// of all modules that failed or were skipped.
+func (c *Connector) Prefetch(ctx context.Context, modules []string) error {
+	modules = slices.Compact(slices.Sorted(slices.Values(modules)))
+	concurrency := c.config.PrefetchConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultPrefetchConcurrency
+	}
+	c.logger.Infof("prefetching %d python modules, %d at once", len(modules), concurrency)
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		finished int
+		errs     []error
+	)
+	slots := make(chan struct{}, concurrency)
+	for _, module := range modules {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// the modules still waiting for a slot are skipped once ctx is
+			// cancelled
+			var err error
+			select {
+			case slots <- struct{}{}:
+				if err = ctx.Err(); err == nil {
+					err = c.PullMod(ctx, module, c.pythonCli)
+				}
+				<-slots
+			case <-ctx.Done():
+				err = ctx.Err()
 			}
+			lock.Lock()
+			defer lock.Unlock()
+			finished++
+			if err != nil {
+				c.logger.Errorf("error prefetching python module %s (%d of %d finished) (%s)",
+					module, finished, len(modules), err)
+				errs = append(errs, fmt.Errorf("error prefetching python module %s (%w)", module, err))
+				return
+			}
+			c.logger.Infof("prefetched python module %s (%d of %d finished)", module, finished, len(modules))
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// pullWithRetries pulls a python module, and retries the pull with an
+// exponential backoff for as long as it fails with a transient error and the
+// configured number of attempts has not been reached.
+func (c *Connector) pullWithRetries(ctx context.Context, fullModuleName string, pythonCli cliwrapper.CliWrapper) error {
+	retry := c.config.PullRetry
+	backoff := retry.InitialBackoff
+	for attempt := int64(1); ; attempt++ {
+		c.logger.Debugf("pulling module %s (attempt %d of %d)", fullModuleName, attempt, retry.MaxAttempts)
+		err := pythonCli.PullModule(fullModuleName)
+		if err == nil {
+			return nil
 		}
-		// remember we found the module if someone asks again later
-		c.modules[fullModuleName] = struct{}{}
+		if attempt >= retry.MaxAttempts || !cliwrapper.IsTransientPullError(err) {
+			return err
+		}
+		// sleep somewhere between half and the full backoff, so that
+		// concurrent pulls do not hit the package index in lockstep
+		wait := backoff/2 + time.Duration(rand.Int64N(int64(backoff/2)+1)) //nolint:gosec // not for a security credential
+		c.logger.Warningf(
+			"transient error pulling module %s (attempt %d of %d), retrying in %s (%s)",
+			fullModuleName, attempt, retry.MaxAttempts, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return fmt.Errorf("pulling module %s cancelled while waiting to retry (%w)", fullModuleName, err)
+		}
+		// a maximum below the initial backoff does not shorten the waits
+		backoff = max(retry.InitialBackoff, min(2*backoff, retry.MaxBackoff))
+	}
+}
+
+// createCgroup creates the cgroup of the plugin using pluginDir, or returns
+// nil if plugins get no cgroup, or it could not be created.
+func (c *Connector) createCgroup(pluginDir string) *cgroup.Cgroup {
+	if c.cgroups == nil {
+		return nil
+	}
+	pluginCgroup, err := c.cgroups.Create("plugin-"+filepath.Base(pluginDir), cgroup.Limits{
+		MemoryMax: c.config.Cgroup.MemoryMax,
+		CPUMax:    c.config.Cgroup.CPUMax,
+		PidsMax:   c.config.Cgroup.PidsMax,
+	})
+	if err != nil {
+		c.logger.Warningf("running plugin without a cgroup of its own (%s)", err)
+		return nil
 	}
-	return nil
+	return pluginCgroup
 }
 
 func (c *Connector) CreatePluginDir(pluginDir string) (*string, error) {
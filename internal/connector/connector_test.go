@@ -3,13 +3,18 @@ package connector_test
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"go.arcalot.io/assert"
 	"go.arcalot.io/exex"
@@ -18,6 +23,8 @@ import (
 	"go.flow.arcalot.io/pluginsdk/atp"
 	"go.flow.arcalot.io/pluginsdk/schema"
 	pythondeployer "go.flow.arcalot.io/pythondeployer"
+	"go.flow.arcalot.io/pythondeployer/internal/cgroup"
+	"go.flow.arcalot.io/pythondeployer/internal/cliwrapper"
 	"go.flow.arcalot.io/pythondeployer/internal/config"
 	"go.flow.arcalot.io/pythondeployer/internal/connector"
 )
@@ -235,6 +242,151 @@ func GetConnector(t *testing.T, configJSON string, workdir *string) (deployer.Co
 	return connector_, unserializedConfig
 }
 
+// Test the connectors of every factory, like those of later runs of the
+// engine, share the modules directory of their python version.
+func TestFactory_ModulesDir(t *testing.T) {
+	workdir := CreateWorkdir(t)
+	t.Cleanup(func() {
+		assert.NoError(t, os.RemoveAll(workdir))
+	})
+	cfg := &config.Config{WorkDir: workdir, PythonSemVer: "3.9.0"}
+	for _, factory := range []deployer.ConnectorFactory[*config.Config]{
+		pythondeployer.NewFactory(), pythondeployer.NewFactory(),
+	} {
+		_, err := factory.Create(cfg, log.NewTestLogger(t))
+		assert.NoError(t, err)
+	}
+	modulesDirs, err := filepath.Glob(filepath.Join(workdir, "modules_*"))
+	assert.NoError(t, err)
+	assert.Equals(t, modulesDirs, []string{filepath.Join(workdir, "modules_3-9-0")})
+}
+
+// Test a factory refuses to create connectors with cgroups enabled but no
+// delegated parent cgroup, since the engine's own cgroup cannot be one.
+func TestFactory_CgroupParentRequired(t *testing.T) {
+	workdir := CreateWorkdir(t)
+	t.Cleanup(func() {
+		assert.NoError(t, os.RemoveAll(workdir))
+	})
+	cfg := &config.Config{WorkDir: workdir, PythonSemVer: "3.9.0", Cgroup: config.Cgroup{Enabled: true}}
+	_, err := pythondeployer.NewFactory().Create(cfg, log.NewTestLogger(t))
+	assert.Equals(t, errors.Is(err, pythondeployer.ErrCgroupParentRequired), true)
+	entries, err := os.ReadDir(workdir)
+	assert.NoError(t, err)
+	assert.Equals(t, len(entries), 0)
+}
+
+// Test the configuration schema only accepts secret names that name a file
+// in the secrets directory, for the deployer and for a module.
+func TestFactory_SecretNames(t *testing.T) {
+	deployerSchema := pythondeployer.NewFactory().ConfigurationSchema()
+	testCases := map[string]bool{
+		"api-key":       true,
+		"api_key.txt":   true,
+		".api-key":      true,
+		"...key":        true,
+		".":             false,
+		"..":            false,
+		"...":           false,
+		"api/key":       false,
+		"../etc/passwd": false,
+		"":              false,
+	}
+	for name, valid := range testCases {
+		localName, localValid := name, valid
+		t.Run(name, func(t *testing.T) {
+			secrets := map[string]any{localName: "/etc/arcaflow/secrets/api-key"}
+			for _, serializedConfig := range []map[string]any{
+				{"secrets": secrets},
+				{"modules": map[string]any{"fixture-plugin": map[string]any{"secrets": secrets}}},
+			} {
+				_, err := deployerSchema.UnserializeType(serializedConfig)
+				if localValid {
+					assert.NoError(t, err)
+				} else {
+					assert.Error(t, err)
+				}
+			}
+		})
+	}
+}
+
+// CreateFixtureRepo creates a git repository holding the fixture plugin
+// of the cliwrapper tests, which can be installed by pip without network
+// access, and returns its path and commit SHA.
+func CreateFixtureRepo(t *testing.T) (string, string) {
+	repoDir := filepath.Join(t.TempDir(), "fixture-plugin.git")
+	assert.NoError(t, os.CopyFS(repoDir, os.DirFS("../cliwrapper/testdata/fixture-plugin")))
+	git := func(args ...string) string {
+		cmd := exex.Command("git", append([]string{
+			"-c", "user.name=arcaflow", "-c", "user.email=arcaflow@example.com"}, args...)...)
+		cmd.Dir = repoDir
+		output, err := cmd.Output()
+		assert.NoError(t, err)
+		return strings.TrimSpace(string(output))
+	}
+	git("init", "--quiet")
+	git("add", "--all")
+	git("commit", "--quiet", "--message", "fixture plugin")
+	return repoDir, git("rev-parse", "HEAD")
+}
+
+// Test the connectors of a factory run plugins as the plugin user, which
+// can reach the venv and the plugin directory through the directories the
+// factory created, and read the venv on every deployment, without any
+// other preparation than a working directory it can search.
+func TestFactory_PluginUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skipf("running plugins as another user needs root")
+	}
+	// the interpreter must be accessible to the plugin user, unlike one in
+	// the home directory of root
+	if _, err := os.Stat("/usr/bin/python3"); err != nil {
+		t.Skipf("no system python interpreter (%s)", err)
+	}
+	t.Setenv("PATH", "/usr/bin:"+os.Getenv("PATH"))
+	repoDir, commit := CreateFixtureRepo(t)
+	workdir := CreateWorkdir(t)
+	t.Cleanup(func() {
+		assert.NoError(t, os.RemoveAll(workdir))
+	})
+	assert.NoError(t, os.Chmod(workdir, 0751))
+	connector_, _ := GetConnector(t, fmt.Sprintf(`{
+		"pluginUser": {"uid": 4242, "gid": 4243, "groups": []},
+		"sourceRewrites": [{"prefix": "https://github.com/arcalot/", "replacement": "file://localhost%s/"}]
+	}`, filepath.Dir(repoDir)), &workdir)
+	moduleName := "fixture-plugin@git+https://github.com/arcalot/" + filepath.Base(repoDir) + "@" + commit
+
+	deploy := func() {
+		plugin, err := connector_.Deploy(context.Background(), moduleName)
+		assert.NoError(t, err)
+		output, err := io.ReadAll(plugin)
+		assert.NoError(t, err)
+		assert.NoError(t, plugin.Close())
+		greeting, processJSON, found := strings.Cut(string(output), "\n")
+		assert.Equals(t, found, true)
+		assert.Equals(t, greeting, "hello from fixture")
+		var process struct {
+			UID int `json:"uid"`
+		}
+		assert.NoError(t, json.Unmarshal([]byte(processJSON), &process))
+		assert.Equals(t, process.UID, 4242)
+	}
+	deploy()
+
+	// a file of the venv the plugin user can no longer read, like those of
+	// a venv pulled by an earlier run without a plugin user
+	activatePaths, err := filepath.Glob(filepath.Join(workdir, "modules_*", "fixture-plugin_*", "venv", "bin", "activate"))
+	assert.NoError(t, err)
+	assert.Equals(t, len(activatePaths), 1)
+	assert.NoError(t, os.Chown(activatePaths[0], 0, 0))
+	assert.NoError(t, os.Chmod(activatePaths[0], 0600))
+	deploy()
+	info, err := os.Stat(activatePaths[0])
+	assert.NoError(t, err)
+	assert.Equals(t, info.Mode().Perm(), os.FileMode(0640))
+}
+
 func TestConnector_PullMod(t *testing.T) {
 	logger := log.NewTestLogger(t)
 
@@ -288,35 +440,339 @@ func TestConnector_PullMod(t *testing.T) {
 				&cfg,
 				logger,
 				"",
-				testPythonCli)
+				testPythonCli,
+				connector.NewPullCoordinator(), nil)
 			err := connector_.PullMod(
 				context.Background(), "", testPythonCli)
 			assert.NoError(t, err)
-			assert.Equals(t, testPythonCli.PyModPulled, localTc.expected_result)
+			assert.Equals(t, testPythonCli.PyModPulled.Load(), localTc.expected_result)
 		})
 	}
 }
 
+// This test ensures that connectors created by the same factory
+// share their module pulls, so that a module requested by many
+// connectors is only pulled once.
+func TestConnector_PullModSharedAcrossConnectors(t *testing.T) {
+	logger := log.NewTestLogger(t)
+	cfg := config.Config{
+		ModulePullPolicy: config.ModulePullPolicyAlways,
+	}
+	testPythonCli := &pythonCliStub{
+		PullPolicy: config.ModulePullPolicyAlways,
+	}
+	pulls := connector.NewPullCoordinator()
+
+	const n_connectors = 4
+	wg := sync.WaitGroup{}
+	wg.Add(n_connectors)
+	for j := 0; j < n_connectors; j++ {
+		connector_ := connector.NewConnector(
+			&cfg, logger, "", testPythonCli, pulls, nil)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, connector_.PullMod(
+				context.Background(), "module", testPythonCli))
+		}()
+	}
+	wg.Wait()
+	assert.Equals(t, testPythonCli.PullCount.Load(), int64(1))
+
+	// a connector created later observes the module as cached
+	connector_ := connector.NewConnector(
+		&cfg, logger, "", testPythonCli, pulls, nil)
+	assert.NoError(t, connector_.PullMod(
+		context.Background(), "module", testPythonCli))
+	assert.Equals(t, testPythonCli.PullCount.Load(), int64(1))
+}
+
+// This test ensures that connectors pulling a module with other
+// settings than the ones it is pulled with by the process fail,
+// rather than share a venv pulled with other settings.
+func TestConnector_PullModSettingsMismatch(t *testing.T) {
+	logger := log.NewTestLogger(t)
+	testPythonCli := &pythonCliStub{PullPolicy: config.ModulePullPolicyAlways}
+	pulls := connector.NewPullCoordinator()
+	cfg := config.Config{ModulePullPolicy: config.ModulePullPolicyAlways}
+	rewrittenCfg := cfg
+	rewrittenCfg.SourceRewrites = []config.SourceRewrite{{
+		Prefix:      "https://github.com/",
+		Replacement: "https://mirror.example.com/",
+	}}
+
+	first := connector.NewConnector(&cfg, logger, "", testPythonCli, pulls, nil)
+	assert.NoError(t, first.PullMod(context.Background(), "module", testPythonCli))
+	second := connector.NewConnector(&rewrittenCfg, logger, "", testPythonCli, pulls, nil)
+	err := second.PullMod(context.Background(), "module", testPythonCli)
+	assert.Equals(t, errors.Is(err, connector.ErrPullSettingsMismatch), true)
+	assert.Equals(t, testPythonCli.PullCount.Load(), int64(1))
+}
+
+// This test ensures that a caller cancelling its wait for a module
+// pull does not cancel the pull for the other callers waiting for
+// it, and that the pull is only cancelled once all of them gave up.
+func TestPullCoordinator_Cancel(t *testing.T) {
+	pulls := connector.NewPullCoordinator()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	pullErrs := make(chan error, 2)
+	pull := func(ctx context.Context) error {
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		pullErrs <- ctx.Err()
+		return ctx.Err()
+	}
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, err := pulls.Pull(firstCtx, "module", "", pull)
+		firstErr <- err
+	}()
+	<-started
+	secondErr := make(chan error)
+	go func() {
+		_, err := pulls.Pull(context.Background(), "module", "", pull)
+		secondErr <- err
+	}()
+	// let the second caller wait for the pull of the first one
+	time.Sleep(50 * time.Millisecond)
+	cancelFirst()
+	assert.Equals(t, errors.Is(<-firstErr, context.Canceled), true)
+	close(release)
+	assert.NoError(t, <-secondErr)
+	assert.NoError(t, <-pullErrs)
+
+	// the pull is cancelled once its only caller gave up, and the next
+	// call pulls again
+	onlyCtx, cancelOnly := context.WithCancel(context.Background())
+	onlyErr := make(chan error)
+	go func() {
+		_, err := pulls.Pull(onlyCtx, "other-module", "", func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			pullErrs <- ctx.Err()
+			return ctx.Err()
+		})
+		onlyErr <- err
+	}()
+	<-started
+	cancelOnly()
+	assert.Equals(t, errors.Is(<-onlyErr, context.Canceled), true)
+	assert.Equals(t, errors.Is(<-pullErrs, context.Canceled), true)
+	cached, err := pulls.Pull(context.Background(), "other-module", "", func(_ context.Context) error {
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equals(t, cached, false)
+}
+
+// This test ensures that a module pull failing with a transient
+// error is retried until it succeeds, while a permanent error
+// fails immediately.
+func TestConnector_PullModRetries(t *testing.T) {
+	logger := log.NewTestLogger(t)
+	cfg := config.Config{
+		ModulePullPolicy: config.ModulePullPolicyAlways,
+		PullRetry: config.PullRetry{
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     2 * time.Millisecond,
+		},
+	}
+	transientErr := cliwrapper.ClassifyPullError("module",
+		&exex.ExitError{Stderr: []byte("Could not resolve host: github.com")})
+	permanentErr := cliwrapper.ClassifyPullError("module",
+		&exex.ExitError{Stderr: []byte("remote: Repository not found.")})
+
+	testCases := map[string]struct {
+		pullErrors    []error
+		expectedPulls int64
+		expectedErr   error
+	}{
+		"transient_then_success": {
+			[]error{transientErr, transientErr},
+			3,
+			nil,
+		},
+		"transient_exhausted": {
+			[]error{transientErr, transientErr, transientErr, transientErr},
+			3,
+			transientErr,
+		},
+		"permanent": {
+			[]error{permanentErr},
+			1,
+			permanentErr,
+		},
+	}
+	for name, tc := range testCases {
+		localTc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			testPythonCli := &pythonCliStub{
+				PullPolicy: config.ModulePullPolicyAlways,
+				PullErrors: localTc.pullErrors,
+			}
+			connector_ := connector.NewConnector(
+				&cfg, logger, "", testPythonCli, connector.NewPullCoordinator(), nil)
+			err := connector_.PullMod(context.Background(), "module", testPythonCli)
+			assert.Equals(t, testPythonCli.PullCount.Load(), localTc.expectedPulls)
+			if localTc.expectedErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.Equals(t, errors.Is(err, localTc.expectedErr), true)
+			}
+		})
+	}
+}
+
+// This test ensures that the waits between retries never drop
+// below the initial backoff, even with a lower maximum backoff.
+func TestConnector_PullModRetriesBackoff(t *testing.T) {
+	const initialBackoff = 100 * time.Millisecond
+	cfg := config.Config{
+		ModulePullPolicy: config.ModulePullPolicyAlways,
+		PullRetry:        config.PullRetry{MaxAttempts: 4, InitialBackoff: initialBackoff},
+	}
+	transientErr := cliwrapper.ClassifyPullError("module",
+		&exex.ExitError{Stderr: []byte("Could not resolve host: github.com")})
+	testPythonCli := &pythonCliStub{
+		PullPolicy: config.ModulePullPolicyAlways,
+		PullErrors: []error{transientErr, transientErr, transientErr},
+	}
+	connector_ := connector.NewConnector(
+		&cfg, log.NewTestLogger(t), "", testPythonCli, connector.NewPullCoordinator(), nil)
+	start := time.Now()
+	assert.NoError(t, connector_.PullMod(context.Background(), "module", testPythonCli))
+	assert.Equals(t, testPythonCli.PullCount.Load(), int64(4))
+	// every wait is at least half of the initial backoff
+	assert.Equals(t, time.Since(start) >= 3*initialBackoff/2, true)
+}
+
+func TestConnector_Prefetch(t *testing.T) {
+	logger := log.NewTestLogger(t)
+	cfg := config.Config{
+		ModulePullPolicy: config.ModulePullPolicyIfNotPresent,
+		PullRetry:        config.PullRetry{MaxAttempts: 1},
+	}
+	permanentErr := cliwrapper.ClassifyPullError("broken",
+		&exex.ExitError{Stderr: []byte("remote: Repository not found.")})
+	testPythonCli := &pythonCliStub{
+		PullPolicy:   config.ModulePullPolicyIfNotPresent,
+		ModuleErrors: map[string]error{"broken": permanentErr},
+	}
+	connector_ := connector.NewConnector(
+		&cfg, logger, "", testPythonCli, connector.NewPullCoordinator(), nil)
+
+	err := connector_.Prefetch(context.Background(), []string{"first", "second", "first", "broken"})
+	assert.Equals(t, errors.Is(err, permanentErr), true)
+	assert.Contains(t, err.Error(), "broken")
+	// duplicates are only pulled once
+	assert.Equals(t, testPythonCli.PullCount.Load(), int64(3))
+
+	// the modules that were prefetched are not pulled again when deployed
+	assert.NoError(t, connector_.PullMod(context.Background(), "first", testPythonCli))
+	assert.Equals(t, testPythonCli.PullCount.Load(), int64(3))
+}
+
+// slowPullCliStub records how many modules are pulled at once.
+type slowPullCliStub struct {
+	pythonCliStub
+	pulling    atomic.Int64
+	maxPulling atomic.Int64
+}
+
+func (p *slowPullCliStub) PullModule(_ string) error {
+	pulling := p.pulling.Add(1)
+	defer p.pulling.Add(-1)
+	for {
+		maxPulling := p.maxPulling.Load()
+		if pulling <= maxPulling || p.maxPulling.CompareAndSwap(maxPulling, pulling) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	p.PullCount.Add(1)
+	return nil
+}
+
+func TestConnector_PrefetchConcurrency(t *testing.T) {
+	cfg := config.Config{
+		ModulePullPolicy:    config.ModulePullPolicyAlways,
+		PrefetchConcurrency: 2,
+	}
+	testPythonCli := &slowPullCliStub{pythonCliStub: pythonCliStub{PullPolicy: config.ModulePullPolicyAlways}}
+	connector_ := connector.NewConnector(
+		&cfg, log.NewTestLogger(t), "", testPythonCli, connector.NewPullCoordinator(), nil)
+
+	modules := []string{"first", "second", "third", "fourth", "fifth", "sixth"}
+	assert.NoError(t, connector_.Prefetch(context.Background(), modules))
+	assert.Equals(t, testPythonCli.PullCount.Load(), int64(len(modules)))
+	assert.Equals(t, testPythonCli.maxPulling.Load(), int64(2))
+}
+
+// This test ensures that cancelling a prefetch skips the modules
+// still waiting to be pulled.
+func TestConnector_PrefetchCancel(t *testing.T) {
+	cfg := config.Config{
+		ModulePullPolicy:    config.ModulePullPolicyAlways,
+		PrefetchConcurrency: 1,
+	}
+	testPythonCli := &slowPullCliStub{pythonCliStub: pythonCliStub{PullPolicy: config.ModulePullPolicyAlways}}
+	connector_ := connector.NewConnector(
+		&cfg, log.NewTestLogger(t), "", testPythonCli, connector.NewPullCoordinator(), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	modules := []string{"first", "second", "third", "fourth", "fifth", "sixth"}
+	err := connector_.Prefetch(ctx, modules)
+	assert.Equals(t, errors.Is(err, context.DeadlineExceeded), true)
+	// let the pull in progress when the prefetch was cancelled finish
+	time.Sleep(50 * time.Millisecond)
+	assert.Equals(t, testPythonCli.PullCount.Load() < int64(len(modules)), true)
+}
+
 type pythonCliStub struct {
 	PyModExists bool
-	PyModPulled bool
+	PyModPulled atomic.Bool
+	PullCount   atomic.Int64
 	PullPolicy  config.ModulePullPolicy
+	// PullErrors are returned by consecutive calls to PullModule
+	PullErrors []error
+	// ModuleErrors are returned by every call to PullModule for a module
+	ModuleErrors map[string]error
 }
 
 func (p *pythonCliStub) PullModule(fullModuleName string) error {
+	pullCount := p.PullCount.Add(1)
+	if err, found := p.ModuleErrors[fullModuleName]; found {
+		return err
+	}
+	if pullCount <= int64(len(p.PullErrors)) {
+		return p.PullErrors[pullCount-1]
+	}
 	moduleExists, _ := p.ModuleExists("")
 	if !*moduleExists || p.PullPolicy == config.ModulePullPolicyAlways {
-		p.PyModPulled = true
+		p.PyModPulled.Store(true)
 	}
 	return nil
 }
 
-func (p *pythonCliStub) Deploy(fullModuleName string, pluginDirAbsPath string) (io.WriteCloser, io.ReadCloser, io.ReadCloser, *exex.Cmd, error) {
-	return nil, nil, nil, nil, nil
+func (p *pythonCliStub) Deploy(
+	fullModuleName string,
+	pluginDirAbsPath string,
+	_ *cgroup.Cgroup,
+	_ string,
+) (io.WriteCloser, io.ReadCloser, io.ReadCloser, io.ReadCloser, *exex.Cmd, error) {
+	return nil, nil, nil, nil, nil, nil
 }
 
-func (p *pythonCliStub) GetModulePath(_ string) (*string, error) {
-	return nil, nil
+func (p *pythonCliStub) GetModulePath(fullModuleName string) (*string, error) {
+	return &fullModuleName, nil
 }
 
 func (p *pythonCliStub) ModuleExists(_ string) (*bool, error) {
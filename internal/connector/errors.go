@@ -0,0 +1,96 @@
+package connector
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.flow.arcalot.io/pythondeployer/internal/config"
+	"go.flow.arcalot.io/pythondeployer/internal/seccomp"
+)
+
+// PluginExitError reports a plugin process that exited on its own with a
+// failure, for example because of an import error, a segfault, or the OOM
+// killer, while its plugin was still in use.
+type PluginExitError struct {
+	// Module is the full name of the python module the plugin runs.
+	Module string
+	// PID is the process ID the plugin process had.
+	PID int
+	// ExitCode is the exit code of the plugin process, or -1 if it was
+	// terminated by a signal.
+	ExitCode int
+	// Signal is the signal that terminated the plugin process, if any.
+	Signal syscall.Signal
+	// StderrTail is the end of what the plugin process wrote to its stderr.
+	StderrTail string
+	// Reason explains which resource limit the plugin process most likely
+	// exceeded, or which system call its seccomp profile blocked, if any.
+	Reason string
+}
+
+func (e *PluginExitError) Error() string {
+	status := fmt.Sprintf("exit code %d", e.ExitCode)
+	if e.Signal != 0 {
+		status = fmt.Sprintf("signal %d (%s)", e.Signal, e.Signal)
+	}
+	msg := fmt.Sprintf("python plugin %s (pid %d) exited unexpectedly with %s", e.Module, e.PID, status)
+	if e.Reason != "" {
+		msg += " (" + e.Reason + ")"
+	}
+	if e.StderrTail != "" {
+		msg += ", end of its stderr:\n" + e.StderrTail
+	}
+	return msg
+}
+
+// limitViolation returns which of the resource limits of a plugin process
+// made it exit, judging from its exit signal, the CPU time it used, and its
+// last words on stderr, or an empty string if none of them did.
+func limitViolation(
+	limits config.ResourceLimits,
+	signal syscall.Signal,
+	cpuTime time.Duration,
+	stderrTail string,
+) string {
+	switch {
+	case limits.CPUTime != nil &&
+		(signal == syscall.SIGXCPU || (signal == syscall.SIGKILL && cpuTime >= *limits.CPUTime)):
+		return fmt.Sprintf("CPU time limit of %s exceeded", *limits.CPUTime)
+	case limits.AddressSpace != nil &&
+		(strings.Contains(stderrTail, "MemoryError") || strings.Contains(stderrTail, "Cannot allocate memory")):
+		return fmt.Sprintf("address space limit of %d bytes exceeded", *limits.AddressSpace)
+	case limits.OpenFiles != nil && strings.Contains(stderrTail, "Too many open files"):
+		return fmt.Sprintf("open files limit of %d exceeded", *limits.OpenFiles)
+	case limits.Processes != nil &&
+		(strings.Contains(stderrTail, "Resource temporarily unavailable") ||
+			strings.Contains(stderrTail, "can't start new thread")):
+		return fmt.Sprintf("processes limit of %d exceeded", *limits.Processes)
+	}
+	return ""
+}
+
+// blockedSyscallRegex matches the report of the launcher when the seccomp
+// profile of a plugin blocks one of its system calls.
+var blockedSyscallRegex = regexp.MustCompile(`seccomp profile blocked system call (\d+)`)
+
+// blockedSyscall returns which system call the seccomp profile of a plugin
+// process blocked, from the report of the launcher on stderr, or an empty
+// string if the process did not die of SIGSYS.
+func blockedSyscall(signal syscall.Signal, stderrTail string) string {
+	if signal != syscall.SIGSYS {
+		return ""
+	}
+	matches := blockedSyscallRegex.FindAllStringSubmatch(stderrTail, -1)
+	if len(matches) == 0 {
+		return "a system call was blocked by the seccomp profile"
+	}
+	number, err := strconv.ParseUint(matches[len(matches)-1][1], 10, 32)
+	if err != nil {
+		return "a system call was blocked by the seccomp profile"
+	}
+	return fmt.Sprintf("system call %s blocked by the seccomp profile", seccomp.SyscallName(uint32(number)))
+}
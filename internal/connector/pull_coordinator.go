@@ -0,0 +1,124 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrPullSettingsMismatch means a python module was requested with other
+// pull settings than the ones it is pulled with by this process, which would
+// share a single venv.
+var ErrPullSettingsMismatch = errors.New("python module pulled with other settings")
+
+// PullCoordinator deduplicates python module pulls across every connector
+// created by the same factory, so that a module is only installed once per
+// process no matter how many connectors request it.
+type PullCoordinator struct {
+	lock  sync.Mutex
+	pulls map[string]*modulePull
+}
+
+// modulePull tracks a single, possibly still running, module pull.
+type modulePull struct {
+	done chan struct{}
+	err  error
+	// settings digests the settings the module is pulled with
+	settings string
+	// waiters is the number of callers waiting for the pull to finish,
+	// the pull is cancelled when all of them gave up
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func NewPullCoordinator() *PullCoordinator {
+	return &PullCoordinator{
+		pulls: make(map[string]*modulePull),
+	}
+}
+
+// Pull calls pull for the module stored at modulePath, unless a pull for the
+// same module path has already succeeded or is still in progress, in which
+// case it waits for the result of that pull instead. The pull runs detached
+// from the context of the caller that started it: cancelling ctx only stops
+// the wait of the caller, and the pull is only cancelled once every caller
+// waiting for it gave up. A failed or cancelled pull is forgotten, so that a
+// later call can try again. Requesting a module pulled with other settings,
+// as digested by settings, fails with ErrPullSettingsMismatch. The returned
+// boolean is true when the module had already been pulled by a previous
+// call.
+func (p *PullCoordinator) Pull(
+	ctx context.Context,
+	modulePath string,
+	settings string,
+	pull func(ctx context.Context) error,
+) (bool, error) {
+	p.lock.Lock()
+	current, found := p.pulls[modulePath]
+	if found && current.settings != settings {
+		p.lock.Unlock()
+		return false, fmt.Errorf("%w, the python module at %s is pulled with other settings by "+
+			"another deployer of this process", ErrPullSettingsMismatch, modulePath)
+	}
+	if !found {
+		pullCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		current = &modulePull{done: make(chan struct{}), settings: settings, cancel: cancel}
+		p.pulls[modulePath] = current
+		go p.run(pullCtx, modulePath, current, pull)
+	}
+	select {
+	case <-current.done:
+		p.lock.Unlock()
+		if current.err != nil {
+			return false, current.err
+		}
+		return found, nil
+	default:
+	}
+	current.waiters++
+	p.lock.Unlock()
+
+	select {
+	case <-current.done:
+		p.lock.Lock()
+		current.waiters--
+		p.lock.Unlock()
+		if current.err != nil {
+			return false, current.err
+		}
+		return found, nil
+	case <-ctx.Done():
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		current.waiters--
+		select {
+		case <-current.done:
+			// the pull finished meanwhile
+			return false, ctx.Err()
+		default:
+		}
+		if current.waiters == 0 {
+			current.cancel()
+			// later calls start a new pull rather than wait for the
+			// cancelled one
+			if p.pulls[modulePath] == current {
+				delete(p.pulls, modulePath)
+			}
+		}
+		return false, ctx.Err()
+	}
+}
+
+// run runs a pull, and forgets it if it fails.
+func (p *PullCoordinator) run(ctx context.Context, modulePath string, current *modulePull, pull func(context.Context) error) {
+	err := pull(ctx)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	current.err = err
+	current.cancel()
+	if err != nil && p.pulls[modulePath] == current {
+		delete(p.pulls, modulePath)
+	}
+	close(current.done)
+}
@@ -0,0 +1,54 @@
+package connector
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// ResourceUsageReportFile is the name of the file in the plugin directory
+// the resource usage of the plugin is written to, when enabled.
+const ResourceUsageReportFile = "resource-usage.json"
+
+// ResourceUsage is the resource usage of a plugin process and of the
+// subprocesses it waited for, collected once the process exited.
+type ResourceUsage struct {
+	// Module is the full name of the python module the plugin ran.
+	Module string `json:"module"`
+	// MaxRSS is the peak resident set size, in bytes.
+	MaxRSS int64 `json:"maxRssBytes"`
+	// UserCPU is the CPU time spent in user mode.
+	UserCPU time.Duration `json:"userCpuNanoseconds"`
+	// SystemCPU is the CPU time spent in kernel mode.
+	SystemCPU time.Duration `json:"systemCpuNanoseconds"`
+	// BlockInput is the number of block input operations.
+	BlockInput int64 `json:"blockInputOperations"`
+	// BlockOutput is the number of block output operations.
+	BlockOutput int64 `json:"blockOutputOperations"`
+	// VoluntaryContextSwitches mostly counts waits for I/O.
+	VoluntaryContextSwitches int64 `json:"voluntaryContextSwitches"`
+	// InvoluntaryContextSwitches mostly counts preemptions.
+	InvoluntaryContextSwitches int64 `json:"involuntaryContextSwitches"`
+	// WallClock is the time between the start and the exit of the process.
+	WallClock time.Duration `json:"wallClockNanoseconds"`
+}
+
+// newResourceUsage reads the resource usage out of the state of an exited
+// plugin process.
+func newResourceUsage(module string, state *os.ProcessState, wallClock time.Duration) *ResourceUsage {
+	usage := &ResourceUsage{
+		Module:    module,
+		UserCPU:   state.UserTime(),
+		SystemCPU: state.SystemTime(),
+		WallClock: wallClock,
+	}
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// Linux reports the max RSS in kilobytes
+		usage.MaxRSS = rusage.Maxrss * 1024
+		usage.BlockInput = rusage.Inblock
+		usage.BlockOutput = rusage.Oublock
+		usage.VoluntaryContextSwitches = rusage.Nvcsw
+		usage.InvoluntaryContextSwitches = rusage.Nivcsw
+	}
+	return usage
+}
@@ -0,0 +1,113 @@
+package connector
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// tmpfsMagic is the filesystem type of tmpfs, as reported by statfs.
+const tmpfsMagic = 0x01021994
+
+// secretsTmpfs is where the secrets of plugins are kept in memory, when it
+// is a tmpfs.
+var secretsTmpfs = "/dev/shm"
+
+// injectSecrets copies the secrets of a plugin, which map their names to the
+// files on the host holding them, to a directory only readable by the user
+// running the plugin, with a file per secret. The directory is created on a
+// tmpfs when one is available, so that the secrets never reach the disk, and
+// in the plugin directory otherwise. It returns the directory, or an empty
+// string when there are no secrets.
+func injectSecrets(secrets map[string]string, pluginDir string) (string, error) {
+	if len(secrets) == 0 {
+		return "", nil
+	}
+	secretsDir, err := createSecretsDir(pluginDir)
+	if err != nil {
+		return "", fmt.Errorf("error creating the secrets directory of plugin %s (%w)", pluginDir, err)
+	}
+	for name, hostPath := range secrets {
+		if err := injectSecret(filepath.Join(secretsDir, name), hostPath); err != nil {
+			_ = shredSecrets(secretsDir)
+			return "", fmt.Errorf("error injecting secret %s from %s (%w)", name, hostPath, err)
+		}
+	}
+	// the plugin must not replace its secrets, nor add files to the directory
+	if err := os.Chmod(secretsDir, 0500); err != nil {
+		_ = shredSecrets(secretsDir)
+		return "", err
+	}
+	return secretsDir, nil
+}
+
+// createSecretsDir creates the secrets directory of a plugin.
+func createSecretsDir(pluginDir string) (string, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(secretsTmpfs, &stat); err == nil && stat.Type == tmpfsMagic {
+		secretsDir, err := os.MkdirTemp(secretsTmpfs, "arcaflow-secrets-")
+		if err == nil {
+			return secretsDir, nil
+		}
+	}
+	secretsDir := filepath.Join(pluginDir, "secrets")
+	return secretsDir, os.Mkdir(secretsDir, 0700)
+}
+
+// injectSecret copies a secret file to path, readable by its owner only.
+func injectSecret(path string, hostPath string) error {
+	content, err := os.ReadFile(filepath.Clean(hostPath))
+	if err != nil {
+		return err
+	}
+	defer clear(content)
+	return os.WriteFile(path, content, 0400)
+}
+
+// shredSecrets overwrites every secret in secretsDir with zeros before
+// removing the directory, so that the secrets cannot be recovered from the
+// disk when the directory is not on a tmpfs.
+func shredSecrets(secretsDir string) error {
+	if err := os.Chmod(secretsDir, 0700); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	entries, err := os.ReadDir(secretsDir)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, entry := range entries {
+		if err := shredFile(filepath.Join(secretsDir, entry.Name())); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := os.RemoveAll(secretsDir); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// shredFile overwrites a regular file with zeros and syncs it.
+func shredFile(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Clean(path), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(make([]byte, info.Size()))
+	if err == nil {
+		err = file.Sync()
+	}
+	return errors.Join(err, file.Close())
+}
@@ -0,0 +1,158 @@
+package gitmirror
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"go.arcalot.io/exex"
+	"go.arcalot.io/log/v2"
+)
+
+// ErrRevisionNotFound means the requested revision is not in the repository,
+// even after fetching its latest objects.
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// Mirrors manages bare git mirrors of python module repositories, so that
+// a repository is only cloned once, and later pulls only fetch new objects,
+// or nothing at all when the requested commit is already mirrored.
+type Mirrors struct {
+	dir    string
+	logger log.Logger
+}
+
+// New creates a mirror manager storing its mirrors in dir. Several managers,
+// even from different processes, can safely share the same directory.
+func New(dir string, logger log.Logger) *Mirrors {
+	return &Mirrors{
+		dir:    dir,
+		logger: logger,
+	}
+}
+
+// MirrorPath returns the path of the bare mirror of a repository.
+func (m *Mirrors) MirrorPath(repo string) string {
+	hash := sha256.Sum256([]byte(repo))
+	return filepath.Join(m.dir, hex.EncodeToString(hash[:12])+".git")
+}
+
+// Checkout checks out a revision of a repository into targetDir, which must
+// not exist yet, and returns the SHA of the checked out commit. The mirror of
+// the repository is created or updated as needed. When revision is empty the
+// repository's default branch is checked out, falling back to the mirrored
+// one if the repository cannot be reached. The git commands run with env,
+// which is where credentials and proxies come from. The submodules of the
+// revision are checked out too, from their own repositories, since they are
+// not mirrored.
+func (m *Mirrors) Checkout(repo string, revision string, targetDir string, env []string) (string, error) {
+	if err := os.MkdirAll(m.dir, 0750); err != nil {
+		return "", fmt.Errorf("error creating git mirror directory (%w)", err)
+	}
+	mirrorPath := m.MirrorPath(repo)
+	unlock, err := lockFile(mirrorPath + ".lock")
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if err := m.update(repo, revision, mirrorPath, env); err != nil {
+		return "", err
+	}
+	if revision == "" {
+		revision = "HEAD"
+	}
+	commit, err := git(env, mirrorPath, "rev-parse", "--verify", "--quiet", revision+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("%w: %s of %s", ErrRevisionNotFound, revision, repo)
+	}
+
+	// the checkout borrows the objects of the mirror, instead of copying them
+	if _, err := git(env, "", "clone", "--quiet", "--shared", "--no-checkout", mirrorPath, targetDir); err != nil {
+		return "", exex.CommandError(err, fmt.Sprintf("error cloning git mirror of %s", repo))
+	}
+	if _, err := git(env, targetDir, "checkout", "--quiet", "--detach", commit); err != nil {
+		return "", exex.CommandError(err, fmt.Sprintf("error checking out %s of %s", commit, repo))
+	}
+	// relative submodule URLs are relative to the repository, not its mirror
+	if _, err := git(env, targetDir, "remote", "set-url", "origin", repo); err != nil {
+		return "", exex.CommandError(err, fmt.Sprintf("error setting the origin of the checkout of %s", repo))
+	}
+	if _, err := git(env, targetDir, "submodule", "update", "--quiet", "--init", "--recursive"); err != nil {
+		return "", exex.CommandError(err, fmt.Sprintf("error checking out the submodules of %s of %s", commit, repo))
+	}
+	return commit, nil
+}
+
+// update creates the mirror of a repository, or fetches the objects it is
+// missing, unless the requested revision is already mirrored.
+func (m *Mirrors) update(repo string, revision string, mirrorPath string, env []string) error {
+	if _, err := os.Stat(mirrorPath); os.IsNotExist(err) {
+		m.logger.Infof("creating git mirror of %s in %s", repo, mirrorPath)
+		// clone next to the final location, so that an interrupted clone
+		// never leaves an incomplete mirror behind
+		tempPath := mirrorPath + ".tmp"
+		if err := os.RemoveAll(tempPath); err != nil {
+			return err
+		}
+		if _, err := git(env, "", "clone", "--quiet", "--mirror", repo, tempPath); err != nil {
+			return exex.CommandError(err, fmt.Sprintf("error mirroring git repository %s", repo))
+		}
+		return os.Rename(tempPath, mirrorPath)
+	}
+
+	if revision != "" {
+		if _, err := git(env, mirrorPath, "cat-file", "-e", revision+"^{commit}"); err == nil {
+			m.logger.Debugf("revision %s of %s is already mirrored", revision, repo)
+			return nil
+		}
+	}
+	m.logger.Debugf("fetching new objects of %s into its git mirror", repo)
+	_, err := git(env, mirrorPath, "fetch", "--quiet", "--prune", "origin")
+	if err == nil {
+		return nil
+	}
+	if revision == "" {
+		m.logger.Warningf("error fetching %s, using the default branch of its git mirror instead (%s)",
+			repo, exex.CommandError(err, "git fetch failed"))
+		return nil
+	}
+	return exex.CommandError(err, fmt.Sprintf("error fetching git repository %s", repo))
+}
+
+// git runs a git command in dir, or the current directory if dir is empty,
+// and returns its trimmed stdout.
+func git(env []string, dir string, args ...string) (string, error) {
+	cmd := exex.Command("git", args...)
+	cmd.Env = env
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	return strings.TrimSpace(string(output)), err
+}
+
+// lockFile takes an exclusive lock on path, creating it if needed, and
+// returns the function releasing it.
+func lockFile(path string) (func(), error) {
+	file, err := os.OpenFile(filepath.Clean(path), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening git mirror lock (%w)", err)
+	}
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+		if !errors.Is(err, syscall.EINTR) {
+			break
+		}
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("error locking git mirror (%w)", err)
+	}
+	return func() {
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		_ = file.Close()
+	}, nil
+}
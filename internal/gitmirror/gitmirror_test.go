@@ -0,0 +1,108 @@
+package gitmirror_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.arcalot.io/assert"
+	"go.arcalot.io/exex"
+	"go.arcalot.io/log/v2"
+	"go.flow.arcalot.io/pythondeployer/internal/gitmirror"
+)
+
+// Test the mirror of a repository is created on the first checkout,
+// only fetched from when a commit is missing, and still serves the
+// mirrored commits once the repository is gone.
+func TestMirrors_Checkout(t *testing.T) {
+	tempdir := t.TempDir()
+	repoDir := filepath.Join(tempdir, "plugin")
+	assert.NoError(t, os.MkdirAll(repoDir, 0750))
+	git(t, repoDir, "init", "--quiet")
+	firstCommit := commitFile(t, repoDir, "first")
+
+	mirrors := gitmirror.New(filepath.Join(tempdir, "mirrors"), log.NewTestLogger(t))
+	repo := "file://" + repoDir
+
+	commit, err := mirrors.Checkout(repo, firstCommit, filepath.Join(tempdir, "checkout1"), nil)
+	assert.NoError(t, err)
+	assert.Equals(t, commit, firstCommit)
+	assertCheckout(t, filepath.Join(tempdir, "checkout1"), "first")
+	_, err = os.Stat(mirrors.MirrorPath(repo))
+	assert.NoError(t, err)
+
+	// a new commit is fetched into the existing mirror
+	secondCommit := commitFile(t, repoDir, "second")
+	commit, err = mirrors.Checkout(repo, secondCommit[:10], filepath.Join(tempdir, "checkout2"), nil)
+	assert.NoError(t, err)
+	assert.Equals(t, commit, secondCommit)
+	assertCheckout(t, filepath.Join(tempdir, "checkout2"), "second")
+
+	// an unknown revision is reported as such
+	_, err = mirrors.Checkout(repo, "0123456789abcdef", filepath.Join(tempdir, "checkout3"), nil)
+	assert.Equals(t, errors.Is(err, gitmirror.ErrRevisionNotFound), true)
+
+	// mirrored commits, and the mirrored default branch, remain available
+	// when the repository cannot be reached
+	assert.NoError(t, os.RemoveAll(repoDir))
+	commit, err = mirrors.Checkout(repo, firstCommit, filepath.Join(tempdir, "checkout4"), nil)
+	assert.NoError(t, err)
+	assert.Equals(t, commit, firstCommit)
+	assertCheckout(t, filepath.Join(tempdir, "checkout4"), "first")
+	commit, err = mirrors.Checkout(repo, "", filepath.Join(tempdir, "checkout5"), nil)
+	assert.NoError(t, err)
+	assert.Equals(t, commit, secondCommit)
+}
+
+// Test the submodules of a revision are checked out along with it, with
+// relative submodule URLs resolved against the repository.
+func TestMirrors_CheckoutSubmodules(t *testing.T) {
+	tempdir := t.TempDir()
+	// git only clones local submodules when allowed to
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "protocol.file.allow")
+	t.Setenv("GIT_CONFIG_VALUE_0", "always")
+	for _, name := range []string{"plugin", "library", "nested"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(tempdir, name), 0750))
+		git(t, filepath.Join(tempdir, name), "init", "--quiet")
+		commitFile(t, filepath.Join(tempdir, name), name)
+	}
+	git(t, filepath.Join(tempdir, "library"), "submodule", "--quiet", "add", "../nested", "nested")
+	git(t, filepath.Join(tempdir, "library"), "commit", "--quiet", "--message", "nested")
+	repoDir := filepath.Join(tempdir, "plugin")
+	git(t, repoDir, "submodule", "--quiet", "add", "../library", "library")
+	git(t, repoDir, "commit", "--quiet", "--message", "library")
+	commit := git(t, repoDir, "rev-parse", "HEAD")
+
+	mirrors := gitmirror.New(filepath.Join(tempdir, "mirrors"), log.NewTestLogger(t))
+	checkoutDir := filepath.Join(tempdir, "checkout")
+	_, err := mirrors.Checkout("file://"+repoDir, commit, checkoutDir, nil)
+	assert.NoError(t, err)
+	assertCheckout(t, checkoutDir, "plugin")
+	assertCheckout(t, filepath.Join(checkoutDir, "library"), "library")
+	assertCheckout(t, filepath.Join(checkoutDir, "library/nested"), "nested")
+}
+
+func commitFile(t *testing.T, repoDir string, content string) string {
+	assert.NoError(t, os.WriteFile(filepath.Join(repoDir, "content.txt"), []byte(content), 0600))
+	git(t, repoDir, "add", "--all")
+	git(t, repoDir, "commit", "--quiet", "--message", content)
+	return git(t, repoDir, "rev-parse", "HEAD")
+}
+
+func assertCheckout(t *testing.T, checkoutDir string, content string) {
+	data, err := os.ReadFile(filepath.Join(checkoutDir, "content.txt")) //nolint:gosec // test file
+	assert.NoError(t, err)
+	assert.Equals(t, string(data), content)
+}
+
+func git(t *testing.T, dir string, args ...string) string {
+	cmd := exex.Command("git", append([]string{
+		"-c", "user.name=arcaflow", "-c", "user.email=arcaflow@example.com"}, args...)...)
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	assert.NoError(t, err)
+	return strings.TrimSpace(string(output))
+}
@@ -15,9 +15,20 @@ func NewPythonModule(fullModuleName string) PythonModule {
 	return PythonModule{fullModuleName: fullModuleName}
 }
 
+// FullModuleName returns the module name the structure was created from.
+func (p *PythonModule) FullModuleName() string {
+	return p.fullModuleName
+}
+
+// PipPackageName returns the requirement pip installs the module from, which
+// reflects any change made to Repo after parsing.
 func (p *PythonModule) PipPackageName() (*string, error) {
-	if p.ModuleName == nil {
+	if p.ModuleName == nil || p.Repo == nil {
 		return nil, errors.New("PythonModule structure not initialized")
 	}
-	return &p.fullModuleName, nil
+	pipPackageName := *p.ModuleName + "@git+" + *p.Repo
+	if p.ModuleVersion != nil {
+		pipPackageName += "@" + *p.ModuleVersion
+	}
+	return &pipPackageName, nil
 }
@@ -0,0 +1,50 @@
+//go:build ignore
+
+// mksyscalls generates the system call table of an architecture from the
+// zsysnum file of golang.org/x/sys/unix.
+//
+//	go run mksyscalls.go <golang.org/x/sys/unix directory> <GOARCH>
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var sysnum = regexp.MustCompile(`^\s*SYS_([A-Z0-9_]+)\s*=\s*(\d+)`)
+
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Fprintln(os.Stderr, "usage: go run mksyscalls.go <golang.org/x/sys/unix directory> <GOARCH>")
+		os.Exit(2)
+	}
+	goarch := os.Args[2]
+	source, err := os.Open(filepath.Join(os.Args[1], "zsysnum_linux_"+goarch+".go"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer func() {
+		_ = source.Close()
+	}()
+	output := &strings.Builder{}
+	fmt.Fprintf(output, "// Code generated by \"go run mksyscalls.go golang.org/x/sys/unix %s\"; DO NOT EDIT.\n\n", goarch)
+	fmt.Fprintf(output, "package seccomp\n\n")
+	fmt.Fprintf(output, "// syscalls maps the names of the system calls of %s to their numbers.\n", goarch)
+	fmt.Fprintf(output, "var syscalls = map[string]uint32{\n")
+	scanner := bufio.NewScanner(source)
+	for scanner.Scan() {
+		if match := sysnum.FindStringSubmatch(scanner.Text()); match != nil {
+			fmt.Fprintf(output, "\t%q: %s,\n", strings.ToLower(match[1]), match[2])
+		}
+	}
+	fmt.Fprintf(output, "}\n")
+	if err := os.WriteFile("syscalls_"+goarch+".go", []byte(output.String()), 0600); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
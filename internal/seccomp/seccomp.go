@@ -0,0 +1,463 @@
+package seccomp
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The syscalls tables are generated from golang.org/x/sys/unix, see
+// mksyscalls.go.
+
+// defaultProfile is the seccomp profile of plugins when no profile is
+// configured.
+//
+//go:embed default.json
+var defaultProfile []byte
+
+// Action is the action of a seccomp profile on a system call.
+type Action string
+
+// The actions of seccomp profiles. The kill process and trap actions both
+// trap the system call, so that the launcher reports which one it was before
+// the plugin process dies of SIGSYS. The kill and kill thread actions, which
+// would only kill the thread making the system call, are not supported.
+const (
+	ActAllow       Action = "SCMP_ACT_ALLOW"
+	ActErrno       Action = "SCMP_ACT_ERRNO"
+	ActKill        Action = "SCMP_ACT_KILL"
+	ActKillThread  Action = "SCMP_ACT_KILL_THREAD"
+	ActKillProcess Action = "SCMP_ACT_KILL_PROCESS"
+	ActTrap        Action = "SCMP_ACT_TRAP"
+	ActTrace       Action = "SCMP_ACT_TRACE"
+	ActLog         Action = "SCMP_ACT_LOG"
+)
+
+// Profile is a seccomp profile in the JSON format of Docker and the OCI
+// runtime specification.
+type Profile struct {
+	DefaultAction   Action    `json:"defaultAction"`
+	DefaultErrnoRet *uint32   `json:"defaultErrnoRet"`
+	Architectures   []string  `json:"architectures"`
+	Syscalls        []Syscall `json:"syscalls"`
+}
+
+// Syscall is a rule of a seccomp profile, applying an action to system calls
+// whose arguments match all of Args.
+type Syscall struct {
+	Names    []string `json:"names"`
+	Action   Action   `json:"action"`
+	ErrnoRet *uint32  `json:"errnoRet"`
+	Args     []Arg    `json:"args"`
+	Includes Filter   `json:"includes"`
+	Excludes Filter   `json:"excludes"`
+}
+
+// Filter selects the hosts a rule applies to.
+type Filter struct {
+	Arches    []string `json:"arches"`
+	Caps      []string `json:"caps"`
+	MinKernel string   `json:"minKernel"`
+}
+
+// Arg compares an argument of a system call with Value, or, for
+// SCMP_CMP_MASKED_EQ, compares the argument masked with Value to ValueTwo.
+type Arg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo"`
+	Op       string `json:"op"`
+}
+
+// Instruction is a classic BPF instruction, see struct sock_filter.
+type Instruction struct {
+	Code uint16 `json:"code"`
+	Jt   uint8  `json:"jt"`
+	Jf   uint8  `json:"jf"`
+	K    uint32 `json:"k"`
+}
+
+// LoadProfile reads a seccomp profile from a JSON file.
+func LoadProfile(path string) (*Profile, error) {
+	content, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("error reading seccomp profile %s (%w)", path, err)
+	}
+	profile := &Profile{}
+	if err := json.Unmarshal(content, profile); err != nil {
+		return nil, fmt.Errorf("error decoding seccomp profile %s (%w)", path, err)
+	}
+	return profile, nil
+}
+
+// DefaultProfile returns the default seccomp profile of CPython plugins,
+// which allows everything but the system calls a plugin has no business
+// making, like ptrace, mount, kexec_load, bpf and raw IP or packet sockets.
+func DefaultProfile() *Profile {
+	profile := &Profile{}
+	if err := json.Unmarshal(defaultProfile, profile); err != nil {
+		panic(fmt.Errorf("invalid default seccomp profile (%w)", err))
+	}
+	return profile
+}
+
+// SyscallName returns the name of a system call of the current architecture,
+// or its number if it is unknown.
+func SyscallName(number uint32) string {
+	for name, nr := range syscalls {
+		if nr == number {
+			return name
+		}
+	}
+	return strconv.FormatUint(uint64(number), 10)
+}
+
+// SyscallNumber returns the number of a system call of the current
+// architecture.
+func SyscallNumber(name string) (uint32, bool) {
+	number, found := syscalls[name]
+	return number, found
+}
+
+// architecture describes how seccomp identifies an architecture.
+type architecture struct {
+	// name is the name of the architecture in seccomp profiles.
+	name string
+	// auditArch is the AUDIT_ARCH value of the architecture.
+	auditArch uint32
+	// syscallBit is set in the number of the system calls of an alternative
+	// ABI of the architecture, which share its AUDIT_ARCH value.
+	syscallBit uint32
+}
+
+var architectures = map[string]architecture{
+	"amd64": {name: "SCMP_ARCH_X86_64", auditArch: 0xc000003e, syscallBit: 0x40000000},
+	"arm64": {name: "SCMP_ARCH_AARCH64", auditArch: 0xc00000b7},
+}
+
+// seccomp_data offsets, the argument values are 64 bits little-endian
+const (
+	offsetNr   = 0
+	offsetArch = 4
+	offsetArgs = 16
+)
+
+// classic BPF opcodes
+const (
+	bpfLdAbs = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfJeq   = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJgt   = 0x25 // BPF_JMP | BPF_JGT | BPF_K
+	bpfJge   = 0x35 // BPF_JMP | BPF_JGE | BPF_K
+	bpfAnd   = 0x54 // BPF_ALU | BPF_AND | BPF_K
+	bpfRet   = 0x06 // BPF_RET | BPF_K
+)
+
+// SECCOMP_RET values
+const (
+	retKillProcess = 0x80000000
+	retTrap        = 0x00030000
+	retErrno       = 0x00050000
+	retTrace       = 0x7ff00000
+	retLog         = 0x7ffc0000
+	retAllow       = 0x7fff0000
+)
+
+// sigsys is the number of SIGSYS on the supported architectures.
+const sigsys = 31
+
+// maxInstructions is the maximum length of a BPF program.
+const maxInstructions = 4096
+
+// Compile compiles the profile to the BPF program of a seccomp filter for
+// the current architecture. System calls of other architectures, and of the
+// alternative ABIs of the current one, kill the process. Installing a
+// handler of SIGSYS pretends to succeed without replacing the one of the
+// launcher, which reports the trapped system calls. Rules for system calls
+// the architecture does not have are skipped, and so are the rules which
+// only apply to processes with capabilities, since plugins have none.
+func (p *Profile) Compile() ([]Instruction, error) {
+	arch, supported := architectures[runtime.GOARCH]
+	if !supported {
+		return nil, fmt.Errorf("seccomp profiles are not supported on %s", runtime.GOARCH)
+	}
+	if len(p.Architectures) > 0 && !slices.Contains(p.Architectures, arch.name) {
+		return nil, fmt.Errorf("the seccomp profile does not support %s", arch.name)
+	}
+	defaultRet, err := p.DefaultAction.ret(p.DefaultErrnoRet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default action of seccomp profile (%w)", err)
+	}
+	kernel, err := kernelVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	program := []Instruction{
+		{Code: bpfLdAbs, K: offsetArch},
+		{Code: bpfJeq, Jt: 1, K: arch.auditArch},
+		{Code: bpfRet, K: retKillProcess},
+	}
+	if arch.syscallBit != 0 {
+		program = append(program,
+			Instruction{Code: bpfLdAbs, K: offsetNr},
+			Instruction{Code: bpfJge, Jf: 1, K: arch.syscallBit},
+			Instruction{Code: bpfRet, K: retKillProcess},
+		)
+	}
+	if number, found := syscalls["rt_sigaction"]; found {
+		// rt_sigaction(SIGSYS, act, ...) with a non-null act returns 0; the
+		// runtimes of the programs plugins run, like Go's, fail when they
+		// cannot install their handler, but their SIGSYS handling is reset
+		// by execve anyway
+		program = append(program,
+			Instruction{Code: bpfLdAbs, K: offsetNr},
+			Instruction{Code: bpfJeq, Jf: 7, K: number},
+			Instruction{Code: bpfLdAbs, K: offsetArgs},
+			Instruction{Code: bpfJeq, Jf: 5, K: sigsys},
+			Instruction{Code: bpfLdAbs, K: offsetArgs + 8},
+			Instruction{Code: bpfJeq, Jf: 2, K: 0},
+			Instruction{Code: bpfLdAbs, K: offsetArgs + 12},
+			Instruction{Code: bpfJeq, Jt: 1, K: 0},
+			Instruction{Code: bpfRet, K: retErrno},
+		)
+	}
+	for _, rule := range p.Syscalls {
+		if !rule.applies(arch.name, kernel) {
+			continue
+		}
+		ret, err := rule.Action.ret(rule.ErrnoRet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid action of seccomp rule for %s (%w)", strings.Join(rule.Names, ", "), err)
+		}
+		argChecks, err := compileArgs(rule.Args)
+		if err != nil {
+			return nil, fmt.Errorf("invalid arguments of seccomp rule for %s (%w)", strings.Join(rule.Names, ", "), err)
+		}
+		names := append([]string{}, rule.Names...)
+		sort.Strings(names)
+		for _, name := range names {
+			number, found := syscalls[name]
+			if !found {
+				continue
+			}
+			// a failed check skips to the rule of the next system call
+			program = append(program,
+				Instruction{Code: bpfLdAbs, K: offsetNr},
+				Instruction{Code: bpfJeq, Jf: uint8(len(argChecks) + 1), K: number},
+			)
+			program = append(program, argChecks...)
+			program = append(program, Instruction{Code: bpfRet, K: ret})
+		}
+	}
+	program = append(program, Instruction{Code: bpfRet, K: defaultRet})
+	if len(program) > maxInstructions {
+		return nil, fmt.Errorf("the seccomp profile compiles to %d BPF instructions, more than the %d allowed",
+			len(program), maxInstructions)
+	}
+	return program, nil
+}
+
+// ret returns the SECCOMP_RET value of an action.
+func (a Action) ret(errnoRet *uint32) (uint32, error) {
+	switch a {
+	case ActAllow:
+		return retAllow, nil
+	case ActErrno:
+		errno := uint32(syscall.EPERM)
+		if errnoRet != nil {
+			errno = *errnoRet
+		}
+		return retErrno | (errno & 0xffff), nil
+	case ActKillProcess, ActTrap:
+		// the launcher reports the system call, then kills the process
+		return retTrap, nil
+	case ActKill, ActKillThread:
+		// killing a thread would leave the plugin process half dead
+		return 0, fmt.Errorf("action %q only kills a thread, use %q instead", a, ActKillProcess)
+	case ActTrace:
+		// without a tracer, the system call fails with ENOSYS
+		return retTrace, nil
+	case ActLog:
+		return retLog, nil
+	}
+	return 0, fmt.Errorf("unsupported action %q", a)
+}
+
+// applies tells if a rule applies to plugin processes on this host.
+func (s Syscall) applies(arch string, kernel [2]int) bool {
+	if len(s.Includes.Arches) > 0 && !slices.Contains(s.Includes.Arches, arch) {
+		return false
+	}
+	if len(s.Includes.Caps) > 0 || slices.Contains(s.Excludes.Arches, arch) {
+		return false
+	}
+	if s.Includes.MinKernel != "" {
+		minKernel, err := parseKernelVersion(s.Includes.MinKernel)
+		if err != nil || kernel[0] < minKernel[0] || (kernel[0] == minKernel[0] && kernel[1] < minKernel[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// The jump targets of the instructions checking an argument, resolved once
+// the length of the checks is known.
+const (
+	jumpNext = iota
+	jumpPass
+	jumpFail
+)
+
+// compileArgs compiles the argument checks of a rule, which skip the return
+// of the rule when an argument does not match.
+func compileArgs(args []Arg) ([]Instruction, error) {
+	var program []Instruction
+	var targets [][2]int
+	var ends []int
+	for _, arg := range args {
+		if arg.Index > 5 {
+			return nil, fmt.Errorf("invalid argument index %d", arg.Index)
+		}
+		checks, checkTargets, err := compileArg(arg)
+		if err != nil {
+			return nil, err
+		}
+		program = append(program, checks...)
+		targets = append(targets, checkTargets...)
+		for range checks {
+			ends = append(ends, len(program))
+		}
+	}
+	for i := range program {
+		for j, target := range targets[i] {
+			offset := 0
+			switch target {
+			case jumpPass:
+				offset = ends[i] - (i + 1)
+			case jumpFail:
+				// past the end of the checks, and the return of the rule
+				offset = len(program) + 1 - (i + 1)
+			}
+			if offset > 255 {
+				return nil, fmt.Errorf("too many argument checks")
+			}
+			if j == 0 {
+				program[i].Jt = uint8(offset)
+			} else {
+				program[i].Jf = uint8(offset)
+			}
+		}
+	}
+	return program, nil
+}
+
+// compileArg compiles the check of a 64 bits argument, as a comparison of
+// its high 32 bits, then its low 32 bits.
+func compileArg(arg Arg) ([]Instruction, [][2]int, error) {
+	low := uint32(offsetArgs + 8*arg.Index)
+	high := low + 4
+	value := arg.Value
+	switch arg.Op {
+	case "SCMP_CMP_EQ":
+		return []Instruction{
+			{Code: bpfLdAbs, K: high},
+			{Code: bpfJeq, K: uint32(value >> 32)},
+			{Code: bpfLdAbs, K: low},
+			{Code: bpfJeq, K: uint32(value)},
+		}, [][2]int{
+			{}, {jumpNext, jumpFail}, {}, {jumpPass, jumpFail},
+		}, nil
+	case "SCMP_CMP_NE":
+		return []Instruction{
+			{Code: bpfLdAbs, K: high},
+			{Code: bpfJeq, K: uint32(value >> 32)},
+			{Code: bpfLdAbs, K: low},
+			{Code: bpfJeq, K: uint32(value)},
+		}, [][2]int{
+			{}, {jumpNext, jumpPass}, {}, {jumpFail, jumpPass},
+		}, nil
+	case "SCMP_CMP_MASKED_EQ":
+		return []Instruction{
+			{Code: bpfLdAbs, K: high},
+			{Code: bpfAnd, K: uint32(value >> 32)},
+			{Code: bpfJeq, K: uint32(arg.ValueTwo >> 32)},
+			{Code: bpfLdAbs, K: low},
+			{Code: bpfAnd, K: uint32(value)},
+			{Code: bpfJeq, K: uint32(arg.ValueTwo)},
+		}, [][2]int{
+			{}, {}, {jumpNext, jumpFail}, {}, {}, {jumpPass, jumpFail},
+		}, nil
+	case "SCMP_CMP_GT", "SCMP_CMP_GE":
+		lowJump := uint16(bpfJgt)
+		if arg.Op == "SCMP_CMP_GE" {
+			lowJump = bpfJge
+		}
+		return []Instruction{
+			{Code: bpfLdAbs, K: high},
+			{Code: bpfJgt, K: uint32(value >> 32)},
+			{Code: bpfJeq, K: uint32(value >> 32)},
+			{Code: bpfLdAbs, K: low},
+			{Code: lowJump, K: uint32(value)},
+		}, [][2]int{
+			{}, {jumpPass, jumpNext}, {jumpNext, jumpFail}, {}, {jumpPass, jumpFail},
+		}, nil
+	case "SCMP_CMP_LT", "SCMP_CMP_LE":
+		// an argument lower than or equal to the value is not greater than it
+		lowJump := uint16(bpfJge)
+		if arg.Op == "SCMP_CMP_LE" {
+			lowJump = bpfJgt
+		}
+		return []Instruction{
+			{Code: bpfLdAbs, K: high},
+			{Code: bpfJgt, K: uint32(value >> 32)},
+			{Code: bpfJeq, K: uint32(value >> 32)},
+			{Code: bpfLdAbs, K: low},
+			{Code: lowJump, K: uint32(value)},
+		}, [][2]int{
+			{}, {jumpFail, jumpNext}, {jumpNext, jumpPass}, {}, {jumpFail, jumpPass},
+		}, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported operator %q", arg.Op)
+}
+
+// kernelVersion returns the major and minor version of the running kernel.
+func kernelVersion() ([2]int, error) {
+	var uname syscall.Utsname
+	if err := syscall.Uname(&uname); err != nil {
+		return [2]int{}, fmt.Errorf("error reading the kernel version (%w)", err)
+	}
+	release := make([]byte, 0, len(uname.Release))
+	for _, c := range uname.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	return parseKernelVersion(string(release))
+}
+
+// parseKernelVersion parses the major and minor version of a kernel release.
+func parseKernelVersion(release string) ([2]int, error) {
+	var version [2]int
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return version, fmt.Errorf("invalid kernel version %q", release)
+	}
+	for i := range version {
+		digits := strings.TrimRightFunc(parts[i], func(r rune) bool { return r < '0' || r > '9' })
+		number, err := strconv.Atoi(digits)
+		if err != nil {
+			return version, fmt.Errorf("invalid kernel version %q", release)
+		}
+		version[i] = number
+	}
+	return version, nil
+}
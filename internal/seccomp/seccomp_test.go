@@ -0,0 +1,180 @@
+package seccomp_test
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"go.arcalot.io/assert"
+	"go.flow.arcalot.io/pythondeployer/internal/seccomp"
+)
+
+const (
+	retKillProcess = 0x80000000
+	retTrap        = 0x00030000
+	retErrno       = 0x00050000
+	retAllow       = 0x7fff0000
+)
+
+// auditArches are the AUDIT_ARCH values of the supported architectures.
+var auditArches = map[string]uint32{"amd64": 0xc000003e, "arm64": 0xc00000b7}
+
+// Run interprets a seccomp BPF program for a system call of the current
+// architecture, and returns the SECCOMP_RET value it results in.
+func Run(t *testing.T, program []seccomp.Instruction, arch uint32, name string, args ...uint64) uint32 {
+	nr, found := seccomp.SyscallNumber(name)
+	assert.Equals(t, found, true)
+	data := map[uint32]uint32{0: nr, 4: arch}
+	for i, arg := range args {
+		data[uint32(16+8*i)] = uint32(arg)
+		data[uint32(16+8*i+4)] = uint32(arg >> 32)
+	}
+	var a uint32
+	for pc := 0; pc < len(program); pc++ {
+		insn := program[pc]
+		switch insn.Code {
+		case 0x20:
+			a = data[insn.K]
+		case 0x54:
+			a &= insn.K
+		case 0x06:
+			return insn.K
+		case 0x15, 0x25, 0x35:
+			matched := (insn.Code == 0x15 && a == insn.K) ||
+				(insn.Code == 0x25 && a > insn.K) ||
+				(insn.Code == 0x35 && a >= insn.K)
+			if matched {
+				pc += int(insn.Jt)
+			} else {
+				pc += int(insn.Jf)
+			}
+		default:
+			t.Fatalf("unexpected BPF instruction %+v", insn)
+		}
+	}
+	t.Fatalf("BPF program did not return")
+	return 0
+}
+
+func TestDefaultProfile(t *testing.T) {
+	arch, supported := auditArches[runtime.GOARCH]
+	if !supported {
+		t.Skipf("seccomp profiles are not supported on %s", runtime.GOARCH)
+	}
+	program, err := seccomp.DefaultProfile().Compile()
+	assert.NoError(t, err)
+
+	assert.Equals(t, Run(t, program, arch, "read"), uint32(retAllow))
+	assert.Equals(t, Run(t, program, arch, "ptrace"), uint32(retTrap))
+	assert.Equals(t, Run(t, program, arch, "bpf"), uint32(retTrap))
+	assert.Equals(t, Run(t, program, arch, "unshare"), uint32(retErrno|1))
+	// AF_INET, SOCK_STREAM | SOCK_CLOEXEC
+	assert.Equals(t, Run(t, program, arch, "socket", 2, 1|0x80000), uint32(retAllow))
+	// AF_INET, SOCK_RAW | SOCK_NONBLOCK
+	assert.Equals(t, Run(t, program, arch, "socket", 2, 3|0x800), uint32(retErrno|1))
+	// AF_INET6, SOCK_RAW
+	assert.Equals(t, Run(t, program, arch, "socket", 10, 3), uint32(retErrno|1))
+	// AF_NETLINK, SOCK_RAW, which glibc uses to list network interfaces
+	assert.Equals(t, Run(t, program, arch, "socket", 16, 3), uint32(retAllow))
+	// AF_PACKET
+	assert.Equals(t, Run(t, program, arch, "socket", 17, 2), uint32(retErrno|1))
+	// system calls of other architectures
+	assert.Equals(t, Run(t, program, 0x40000003, "read"), uint32(retKillProcess))
+}
+
+func TestProfile_Compile(t *testing.T) {
+	arch, supported := auditArches[runtime.GOARCH]
+	if !supported {
+		t.Skipf("seccomp profiles are not supported on %s", runtime.GOARCH)
+	}
+	profilePath := filepath.Join(t.TempDir(), "profile.json")
+	assert.NoError(t, os.WriteFile(profilePath, []byte(`{
+		"defaultAction": "SCMP_ACT_ERRNO",
+		"defaultErrnoRet": 38,
+		"syscalls": [
+			{"names": ["read", "write", "no_such_syscall"], "action": "SCMP_ACT_ALLOW"},
+			{"names": ["personality"], "action": "SCMP_ACT_ALLOW", "args": [
+				{"index": 0, "value": 8, "op": "SCMP_CMP_EQ"}
+			]},
+			{"names": ["setpriority"], "action": "SCMP_ACT_ALLOW", "args": [
+				{"index": 1, "value": 10, "op": "SCMP_CMP_GE"},
+				{"index": 1, "value": 4294967300, "op": "SCMP_CMP_LT"}
+			]},
+			{"names": ["kill"], "action": "SCMP_ACT_ERRNO", "args": [
+				{"index": 1, "value": 0, "op": "SCMP_CMP_NE"}
+			]},
+			{"names": ["kill"], "action": "SCMP_ACT_ALLOW"},
+			{"names": ["reboot"], "action": "SCMP_ACT_ALLOW", "includes": {"caps": ["CAP_SYS_BOOT"]}},
+			{"names": ["ptrace"], "action": "SCMP_ACT_ALLOW", "includes": {"minKernel": "99.0"}},
+			{"names": ["getppid"], "action": "SCMP_ACT_TRAP"},
+			{"names": ["tgkill"], "action": "SCMP_ACT_KILL_PROCESS"},
+			{"names": ["rt_sigaction"], "action": "SCMP_ACT_ALLOW"}
+		]
+	}`), 0600))
+	profile, err := seccomp.LoadProfile(profilePath)
+	assert.NoError(t, err)
+	program, err := profile.Compile()
+	assert.NoError(t, err)
+
+	testCases := map[string]struct {
+		name     string
+		args     []uint64
+		expected uint32
+	}{
+		"allowed":              {"write", nil, retAllow},
+		"default":              {"getpid", nil, retErrno | 38},
+		"eq_matched":           {"personality", []uint64{8}, retAllow},
+		"eq_not_matched":       {"personality", []uint64{8 | 1<<32}, retErrno | 38},
+		"range_matched":        {"setpriority", []uint64{0, 1 << 32}, retAllow},
+		"range_below":          {"setpriority", []uint64{0, 9}, retErrno | 38},
+		"range_above":          {"setpriority", []uint64{0, 4294967300}, retErrno | 38},
+		"ne_matched":           {"kill", []uint64{1, 9}, retErrno | 1},
+		"ne_not_matched":       {"kill", []uint64{1, 0}, retAllow},
+		"capability_rule":      {"reboot", nil, retErrno | 38},
+		"newer_kernel_rule":    {"ptrace", nil, retErrno | 38},
+		"other_rule_unchanged": {"read", nil, retAllow},
+		"trap":                 {"getppid", nil, retTrap},
+		"kill_process":         {"tgkill", nil, retTrap},
+		// SIGSYS, with and without a new handler
+		"sigsys_handler":       {"rt_sigaction", []uint64{31, 1 << 32}, retErrno},
+		"sigsys_query":         {"rt_sigaction", []uint64{31, 0, 1}, retAllow},
+		"other_signal_handler": {"rt_sigaction", []uint64{10, 1}, retAllow},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equals(t, Run(t, program, arch, tc.name, tc.args...), tc.expected)
+		})
+	}
+}
+
+func TestProfile_CompileInvalid(t *testing.T) {
+	_, err := (&seccomp.Profile{DefaultAction: "SCMP_ACT_NOTIFY"}).Compile()
+	assert.Error(t, err)
+	_, err = (&seccomp.Profile{
+		DefaultAction: seccomp.ActAllow,
+		Syscalls: []seccomp.Syscall{{
+			Names:  []string{"read"},
+			Action: seccomp.ActErrno,
+			Args:   []seccomp.Arg{{Index: 6, Op: "SCMP_CMP_EQ"}},
+		}},
+	}).Compile()
+	assert.Error(t, err)
+	for _, action := range []seccomp.Action{seccomp.ActKill, seccomp.ActKillThread} {
+		_, err = (&seccomp.Profile{
+			DefaultAction: seccomp.ActAllow,
+			Syscalls:      []seccomp.Syscall{{Names: []string{"ptrace"}, Action: action}},
+		}).Compile()
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), string(seccomp.ActKillProcess))
+	}
+}
+
+func TestSyscallName(t *testing.T) {
+	number, found := seccomp.SyscallNumber("ptrace")
+	if !found {
+		t.Skipf("seccomp profiles are not supported on %s", runtime.GOARCH)
+	}
+	assert.Equals(t, seccomp.SyscallName(number), "ptrace")
+	assert.Equals(t, seccomp.SyscallName(99999), "99999")
+}
@@ -0,0 +1,6 @@
+//go:build !amd64 && !arm64
+
+package seccomp
+
+// syscalls is empty on the architectures seccomp profiles do not support.
+var syscalls = map[string]uint32{}
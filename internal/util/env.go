@@ -0,0 +1,46 @@
+package util
+
+import (
+	"sort"
+	"strings"
+)
+
+// FilterEnviron returns the variables of environ, in the "key=value" form of
+// os.Environ, whose names are in allowlist. An allowlist entry ending in "*"
+// allows every variable starting with the rest of the entry.
+func FilterEnviron(environ []string, allowlist []string) []string {
+	filtered := make([]string, 0, len(allowlist))
+	for _, variable := range environ {
+		name, _, _ := strings.Cut(variable, "=")
+		for _, allowed := range allowlist {
+			prefix, isPrefix := strings.CutSuffix(allowed, "*")
+			if name == allowed || (isPrefix && strings.HasPrefix(name, prefix)) {
+				filtered = append(filtered, variable)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// MergeEnviron returns environ, in the "key=value" form of os.Environ, with
+// the given variables added, replacing any variable of the same name.
+func MergeEnviron(environ []string, variables map[string]string) []string {
+	merged := make([]string, 0, len(environ)+len(variables))
+	for _, variable := range environ {
+		name, _, _ := strings.Cut(variable, "=")
+		if _, replaced := variables[name]; !replaced {
+			merged = append(merged, variable)
+		}
+	}
+	names := make([]string, 0, len(variables))
+	for name := range variables {
+		names = append(names, name)
+	}
+	// keep the result stable, so that it can be logged and compared
+	sort.Strings(names)
+	for _, name := range names {
+		merged = append(merged, name+"="+variables[name])
+	}
+	return merged
+}
@@ -0,0 +1,33 @@
+package util
+
+import "bytes"
+
+// LineWriter is an io.Writer that calls OnLine for every complete line
+// written to it, without the trailing line break. It is meant to be used as
+// the stdout or stderr of a command, to process its output while it runs.
+type LineWriter struct {
+	OnLine  func(line string)
+	partial []byte
+}
+
+func (w *LineWriter) Write(b []byte) (int, error) {
+	w.partial = append(w.partial, b...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.OnLine(string(bytes.TrimRight(w.partial[:i], "\r")))
+		w.partial = w.partial[i+1:]
+	}
+	return len(b), nil
+}
+
+// Flush passes the last line to OnLine, if it was not terminated by a
+// line break.
+func (w *LineWriter) Flush() {
+	if len(w.partial) > 0 {
+		w.OnLine(string(w.partial))
+		w.partial = nil
+	}
+}
@@ -0,0 +1,43 @@
+package util
+
+import "sync"
+
+// TailBuffer is an io.Writer that only keeps the last bytes written to it, up
+// to its size. It can be read while it is being written to.
+type TailBuffer struct {
+	lock      sync.Mutex
+	size      int
+	data      []byte
+	truncated bool
+}
+
+// NewTailBuffer creates a TailBuffer keeping the last size bytes.
+func NewTailBuffer(size int) *TailBuffer {
+	return &TailBuffer{size: size}
+}
+
+func (b *TailBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.data = append(b.data, p...)
+	if len(b.data) > b.size {
+		// move the tail to the front, so that the buffer does not grow
+		b.data = append(b.data[:0], b.data[len(b.data)-b.size:]...)
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+// String returns the bytes kept by the buffer.
+func (b *TailBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return string(b.data)
+}
+
+// Truncated reports whether older bytes were dropped from the buffer.
+func (b *TailBuffer) Truncated() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.truncated
+}
@@ -0,0 +1,18 @@
+package pythondeployer
+
+import (
+	"context"
+
+	"go.flow.arcalot.io/pythondeployer/internal/connector"
+)
+
+// Prefetcher is implemented by the connectors created by this deployer's
+// factory. Type assert a deployer.Connector to it, to pull the python modules
+// referenced by a workflow before it starts, instead of on their first deploy.
+type Prefetcher interface {
+	// Prefetch pulls the given python modules in parallel, and returns the
+	// errors of all modules that failed to be pulled.
+	Prefetch(ctx context.Context, modules []string) error
+}
+
+var _ Prefetcher = &connector.Connector{}
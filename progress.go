@@ -0,0 +1,22 @@
+package pythondeployer
+
+import "go.flow.arcalot.io/pythondeployer/internal/cliwrapper"
+
+// ProgressReporter receives progress events while python modules are
+// pulled, see NewFactoryWithProgress.
+type ProgressReporter = cliwrapper.ProgressReporter
+
+// ProgressEvent describes the progress of pulling a python module.
+type ProgressEvent = cliwrapper.ProgressEvent
+
+// ProgressStage is a step of pulling a python module.
+type ProgressStage = cliwrapper.ProgressStage
+
+const (
+	ProgressCreatingVenv = cliwrapper.ProgressCreatingVenv
+	ProgressResolving    = cliwrapper.ProgressResolving
+	ProgressDownloading  = cliwrapper.ProgressDownloading
+	ProgressBuilding     = cliwrapper.ProgressBuilding
+	ProgressInstalling   = cliwrapper.ProgressInstalling
+	ProgressInstalled    = cliwrapper.ProgressInstalled
+)
@@ -3,11 +3,16 @@ package pythondeployer
 import (
 	"go.flow.arcalot.io/pythondeployer/internal/config"
 	"regexp"
+	"time"
 
 	"go.flow.arcalot.io/pluginsdk/schema"
 	"go.flow.arcalot.io/pythondeployer/internal/util"
 )
 
+// secretNamePattern matches the names of secrets, which name their files in
+// the secrets directory of a plugin, so "." and ".." are not secret names.
+var secretNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]*[a-zA-Z0-9_-][a-zA-Z0-9_.-]*$`)
+
 // Schema describes the deployment options of the Docker deployment mechanism.
 var Schema = schema.NewTypedScopeSchema[*config.Config](
 	schema.NewStructMappedObjectSchema[*config.Config](
@@ -65,6 +70,1145 @@ var Schema = schema.NewTypedScopeSchema[*config.Config](
 				schema.PointerTo(util.JSONEncode(string(config.ModulePullPolicyIfNotPresent))),
 				nil,
 			),
+			"pullRetry": schema.NewPropertySchema(
+				schema.NewRefSchema("PullRetry", nil),
+				schema.NewDisplayValue(
+					schema.PointerTo("Pull retry"),
+					schema.PointerTo("How module pulls are retried after a transient network failure."),
+					nil,
+				),
+				false,
+				nil,
+				nil,
+				nil,
+				schema.PointerTo("{}"),
+				nil,
+			),
+			"prefetchConcurrency": schema.NewPropertySchema(
+				schema.NewIntSchema(schema.IntPointer(1), nil, nil),
+				schema.NewDisplayValue(
+					schema.PointerTo("Prefetch concurrency"),
+					schema.PointerTo("Number of python modules prefetched at once."),
+					nil,
+				),
+				false,
+				nil,
+				nil,
+				nil,
+				schema.PointerTo("4"),
+				nil,
+			),
+			"pullEnvironment": schema.NewPropertySchema(
+				schema.NewRefSchema("PullEnvironment", nil),
+				schema.NewDisplayValue(
+					schema.PointerTo("Pull environment"),
+					schema.PointerTo("Environment of the pip and git processes pulling a module."),
+					nil,
+				),
+				false,
+				nil,
+				nil,
+				nil,
+				schema.PointerTo("{}"),
+				nil,
+			),
+			"gitCredentials": schema.NewPropertySchema(
+				schema.NewRefSchema("GitCredentials", nil),
+				schema.NewDisplayValue(
+					schema.PointerTo("Git credentials"),
+					schema.PointerTo("Credentials for pulling modules from private git repositories."),
+					nil,
+				),
+				false,
+				nil,
+				nil,
+				nil,
+				schema.PointerTo("{}"),
+				nil,
+			),
+			"sourceRewrites": schema.NewPropertySchema(
+				schema.NewListSchema(schema.NewRefSchema("SourceRewrite", nil), nil, nil),
+				schema.NewDisplayValue(
+					schema.PointerTo("Source rewrites"),
+					schema.PointerTo("Rules redirecting the git repositories of modules, for example to a mirror. "+
+						"The first matching rule is applied."),
+					nil,
+				),
+				false,
+				nil,
+				nil,
+				nil,
+				nil,
+				nil,
+			),
+			"gitMirror": schema.NewPropertySchema(
+				schema.NewBoolSchema(),
+				schema.NewDisplayValue(
+					schema.PointerTo("Git mirror"),
+					schema.PointerTo("Keep bare mirrors of module repositories in the working directory, so that "+
+						"repeated pulls only fetch new objects, and work offline once a commit is mirrored."),
+					nil,
+				),
+				false,
+				nil,
+				nil,
+				nil,
+				schema.PointerTo("false"),
+				nil,
+			),
+			"wheelCache": schema.NewPropertySchema(
+				schema.NewBoolSchema(),
+				schema.NewDisplayValue(
+					schema.PointerTo("Wheel cache"),
+					schema.PointerTo("Keep the wheels built for modules pinned to a commit, and pip's cache, in the "+
+						"working directory, so that new virtual environments for an already seen commit are "+
+						"installed from prebuilt wheels without touching git or building anything."),
+					nil,
+				),
+				false,
+				nil,
+				nil,
+				nil,
+				schema.PointerTo("false"),
+				nil,
+			),
+			"pluginShutdown": schema.NewPropertySchema(
+				schema.NewRefSchema("PluginShutdown", nil),
+				schema.NewDisplayValue(
+					schema.PointerTo("Plugin shutdown"),
+					schema.PointerTo("How long plugin processes get to exit after their stdin is closed, "+
+						"and after SIGTERM, before they are killed."),
+					nil,
+				),
+				false,
+				nil,
+				nil,
+				nil,
+				schema.PointerTo("{}"),
+				nil,
+			),
+			"stderrTailSize": schema.NewPropertySchema(
+				schema.NewIntSchema(schema.IntPointer(0), nil, schema.UnitBytes),
+				schema.NewDisplayValue(
+					schema.PointerTo("Stderr tail size"),
+					schema.PointerTo("Number of bytes kept from the end of the stderr of each plugin, "+
+						"to report errors. The whole stderr is forwarded to the log as it is written."),
+					nil,
+				),
+				false,
+				nil,
+				nil,
+				nil,
+				schema.PointerTo(util.JSONEncode(64*1024)),
+				nil,
+			),
+			"resourceLimits": schema.NewPropertySchema(
+				schema.NewRefSchema("ResourceLimits", nil),
+				schema.NewDisplayValue(
+					schema.PointerTo("Resource limits"),
+					schema.PointerTo("Resource limits (rlimits) of every plugin process."),
+					nil,
+				),
+				false,
+				nil,
+				nil,
+				nil,
+				schema.PointerTo("{}"),
+				nil,
+			),
+			"modules": schema.NewPropertySchema(
+				schema.NewMapSchema(
+					schema.NewStringSchema(schema.IntPointer(1), nil, nil),
+					schema.NewRefSchema("ModuleSettings", nil),
+					nil,
+					nil,
+				),
+				schema.NewDisplayValue(
+					schema.PointerTo("Module settings"),
+					schema.PointerTo("Settings of individual python modules, by module name, "+
+						"taking precedence over the settings of the deployer."),
+					nil,
+				),
+				false,
+				nil,
+				nil,
+				nil,
+				nil,
+				[]string{`{"arcaflow-plugin-example": {"resourceLimits": {"openFiles": 256}}}`},
+			),
+			"cgroup": schema.NewPropertySchema(
+				schema.NewRefSchema("Cgroup", nil),
+				schema.NewDisplayValue(
+					schema.PointerTo("Cgroup"),
+					schema.PointerTo("Run every plugin in a cgroup v2 of its own, to limit and account its "+
+						"memory and CPU usage."),
+					nil,
+				),
+				false,
+				nil,
+				nil,
+				nil,
+				schema.PointerTo("{}"),
+				nil,
+			),
+			"resourceReport": schema.NewPropertySchema(
+				schema.NewBoolSchema(),
+				schema.NewDisplayValue(
+					schema.PointerTo("Resource report"),
+					schema.PointerTo("Write the resource usage of every plugin to the resource-usage.json "+
+						"file of its plugin directory once it exits."),
+					nil,
+				),
+				false,
+				nil,
+				nil,
+				nil,
+				schema.PointerTo("false"),
+				nil,
+			),
+			"pluginEnvironment": schema.NewPropertySchema(
+				schema.NewRefSchema("PluginEnvironment", nil),
+				schema.NewDisplayValue(
+					schema.PointerTo("Plugin environment"),
+					schema.PointerTo("Environment of the plugin processes, which start from a clean environment."),
+					nil,
+				),
+				false,
+				nil,
+				nil,
+				nil,
+				schema.PointerTo("{}"),
+				nil,
+			),
+			"secrets": schema.NewPropertySchema(
+				schema.NewMapSchema(
+					schema.NewStringSchema(schema.IntPointer(1), nil, secretNamePattern),
+					schema.NewStringSchema(schema.IntPointer(1), nil, nil),
+					nil,
+					nil,
+				),
+				schema.NewDisplayValue(
+					schema.PointerTo("Secrets"),
+					schema.PointerTo("Secrets given to every plugin, by name, read from files on the host "+
+						"and placed in a directory whose path is in the ARCAFLOW_SECRETS_DIR variable."),
+					nil,
+				),
+				false,
+				nil,
+				nil,
+				nil,
+				nil,
+				[]string{`{"api-key": "/etc/arcaflow/secrets/api-key"}`},
+			),
+			"sandbox": schema.NewPropertySchema(
+				schema.NewRefSchema("Sandbox", nil),
+				schema.NewDisplayValue(
+					schema.PointerTo("Sandbox"),
+					schema.PointerTo("Linux namespace sandbox of the plugin processes."),
+					nil,
+				),
+				false,
+				nil,
+				nil,
+				nil,
+				schema.PointerTo("{}"),
+				nil,
+			),
+			"pluginUser": schema.NewPropertySchema(
+				schema.NewRefSchema("PluginUser", nil),
+				schema.NewDisplayValue(
+					schema.PointerTo("Plugin user"),
+					schema.PointerTo("User and groups the plugin processes run as, instead of the engine's."),
+					nil,
+				),
+				false,
+				nil,
+				nil,
+				nil,
+				schema.PointerTo("{}"),
+				nil,
+			),
+			"network": schema.NewPropertySchema(
+				networkSchema,
+				schema.NewDisplayValue(
+					schema.PointerTo("Network"),
+					schema.PointerTo("Network access of the plugin processes. With none, plugins run in an empty "+
+						"network namespace, where they can only reach loopback. Defaults to host, unless the "+
+						"sandbox has a private network."),
+					nil,
+				),
+				false,
+				nil,
+				nil,
+				nil,
+				nil,
+				nil,
+			),
+			"auditHook": schema.NewPropertySchema(
+				schema.NewRefSchema("AuditHook", nil),
+				schema.NewDisplayValue(
+					schema.PointerTo("Audit hook"),
+					schema.PointerTo("Python audit hook of the plugin processes, logging or blocking their "+
+						"subprocesses, shell commands, connections and file opens."),
+					nil,
+				),
+				false,
+				nil,
+				nil,
+				nil,
+				schema.PointerTo("{}"),
+				nil,
+			),
 		},
 	),
+	pullRetrySchema,
+	pullEnvironmentSchema,
+	gitCredentialsSchema,
+	sourceRewriteSchema,
+	pluginShutdownSchema,
+	resourceLimitsSchema,
+	moduleSettingsSchema,
+	cgroupSchema,
+	pluginEnvironmentSchema,
+	sandboxSchema,
+	landlockSchema,
+	seccompSchema,
+	pluginUserSchema,
+	auditHookSchema,
+	auditEventsSchema,
+)
+
+var pullRetrySchema = schema.NewStructMappedObjectSchema[config.PullRetry](
+	"PullRetry",
+	map[string]*schema.PropertySchema{
+		"maxAttempts": schema.NewPropertySchema(
+			schema.NewIntSchema(schema.IntPointer(1), nil, nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("Maximum attempts"),
+				schema.PointerTo("Total number of attempts to pull a module, including the first one."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo("3"),
+			nil,
+		),
+		"initialBackoff": schema.NewPropertySchema(
+			schema.NewIntSchema(schema.IntPointer(0), nil, schema.UnitDurationNanoseconds),
+			schema.NewDisplayValue(
+				schema.PointerTo("Initial backoff"),
+				schema.PointerTo("Time to wait before the first retry, doubled for every subsequent retry."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo(util.JSONEncode(time.Second)),
+			nil,
+		),
+		"maxBackoff": schema.NewPropertySchema(
+			schema.NewIntSchema(schema.IntPointer(0), nil, schema.UnitDurationNanoseconds),
+			schema.NewDisplayValue(
+				schema.PointerTo("Maximum backoff"),
+				schema.PointerTo("Upper limit for the time to wait between two attempts."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo(util.JSONEncode(30*time.Second)),
+			nil,
+		),
+	},
+)
+
+var pullEnvironmentSchema = schema.NewStructMappedObjectSchema[config.PullEnvironment](
+	"PullEnvironment",
+	map[string]*schema.PropertySchema{
+		"isolated": schema.NewPropertySchema(
+			schema.NewBoolSchema(),
+			schema.NewDisplayValue(
+				schema.PointerTo("Isolated"),
+				schema.PointerTo("Do not inherit the engine's environment, except for the variables listed in inherit."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo("false"),
+			nil,
+		),
+		"inherit": schema.NewPropertySchema(
+			schema.NewListSchema(schema.NewStringSchema(schema.IntPointer(1), nil, nil), nil, nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("Inherited variables"),
+				schema.PointerTo("Variables inherited from the engine's environment when isolated, entries ending in * match a prefix."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo(util.JSONEncode(config.DefaultPullEnvironmentInherit)),
+			nil,
+		),
+		"variables": schema.NewPropertySchema(
+			schema.NewMapSchema(
+				schema.NewStringSchema(schema.IntPointer(1), nil, nil),
+				schema.NewStringSchema(nil, nil, nil),
+				nil,
+				nil,
+			),
+			schema.NewDisplayValue(
+				schema.PointerTo("Variables"),
+				schema.PointerTo("Variables set explicitly for the pip and git processes."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+	},
+)
+
+var gitCredentialsSchema = schema.NewStructMappedObjectSchema[config.GitCredentials](
+	"GitCredentials",
+	map[string]*schema.PropertySchema{
+		"tokenFiles": schema.NewPropertySchema(
+			schema.NewMapSchema(
+				schema.NewStringSchema(schema.IntPointer(1), nil, nil),
+				schema.NewStringSchema(schema.IntPointer(1), nil, nil),
+				nil,
+				nil,
+			),
+			schema.NewDisplayValue(
+				schema.PointerTo("Token files"),
+				schema.PointerTo("Files holding an access token, by git host, for https repositories."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+		"helper": schema.NewPropertySchema(
+			schema.NewStringSchema(schema.IntPointer(1), nil, nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("Credential helper"),
+				schema.PointerTo("Git credential helper, in the format of git's credential.helper setting."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+		"sshKeyFile": schema.NewPropertySchema(
+			schema.NewStringSchema(schema.IntPointer(1), nil, nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("SSH key file"),
+				schema.PointerTo("Private key used for git+ssh:// repositories."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+		"sshKnownHostsFile": schema.NewPropertySchema(
+			schema.NewStringSchema(schema.IntPointer(1), nil, nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("SSH known hosts file"),
+				schema.PointerTo("Known hosts file used to verify the hosts of git+ssh:// repositories."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+	},
+)
+
+var sourceRewriteSchema = schema.NewStructMappedObjectSchema[config.SourceRewrite](
+	"SourceRewrite",
+	map[string]*schema.PropertySchema{
+		"prefix": schema.NewPropertySchema(
+			schema.NewStringSchema(schema.IntPointer(1), nil, nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("Prefix"),
+				schema.PointerTo("Repository URL prefix to replace."),
+				nil,
+			),
+			false,
+			nil,
+			[]string{"regex"},
+			[]string{"regex"},
+			nil,
+			[]string{`"https://github.com/arcalot/"`},
+		),
+		"regex": schema.NewPropertySchema(
+			schema.NewPatternSchema(),
+			schema.NewDisplayValue(
+				schema.PointerTo("Regex"),
+				schema.PointerTo("Regular expression matching the part of the repository URL to replace."),
+				nil,
+			),
+			false,
+			nil,
+			[]string{"prefix"},
+			[]string{"prefix"},
+			nil,
+			[]string{`"^https://github\\.com/([^/]+)/"`},
+		),
+		"replacement": schema.NewPropertySchema(
+			schema.NewStringSchema(nil, nil, nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("Replacement"),
+				schema.PointerTo("Replacement for the matched part of the repository URL, "+
+					"$1 refers to the first capture group of regex."),
+				nil,
+			),
+			true,
+			nil,
+			nil,
+			nil,
+			nil,
+			[]string{`"https://git.internal.example.com/mirror/"`},
+		),
+	},
+)
+
+var pluginShutdownSchema = schema.NewStructMappedObjectSchema[config.PluginShutdown](
+	"PluginShutdown",
+	map[string]*schema.PropertySchema{
+		"stdinGracePeriod": schema.NewPropertySchema(
+			schema.NewIntSchema(schema.IntPointer(0), nil, schema.UnitDurationNanoseconds),
+			schema.NewDisplayValue(
+				schema.PointerTo("Stdin grace period"),
+				schema.PointerTo("Time the plugin process has to exit after its stdin is closed, "+
+					"before it is sent SIGTERM."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo(util.JSONEncode(5*time.Second)),
+			nil,
+		),
+		"terminateGracePeriod": schema.NewPropertySchema(
+			schema.NewIntSchema(schema.IntPointer(0), nil, schema.UnitDurationNanoseconds),
+			schema.NewDisplayValue(
+				schema.PointerTo("Terminate grace period"),
+				schema.PointerTo("Time the plugin process has to exit after SIGTERM, before it is sent SIGKILL."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo(util.JSONEncode(5*time.Second)),
+			nil,
+		),
+	},
+)
+
+var resourceLimitsSchema = schema.NewStructMappedObjectSchema[config.ResourceLimits](
+	"ResourceLimits",
+	map[string]*schema.PropertySchema{
+		"addressSpace": schema.NewPropertySchema(
+			schema.NewIntSchema(schema.IntPointer(0), nil, schema.UnitBytes),
+			schema.NewDisplayValue(
+				schema.PointerTo("Address space"),
+				schema.PointerTo("Maximum size of the virtual memory of the plugin process."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+		"cpuTime": schema.NewPropertySchema(
+			schema.NewIntSchema(schema.IntPointer(0), nil, schema.UnitDurationNanoseconds),
+			schema.NewDisplayValue(
+				schema.PointerTo("CPU time"),
+				schema.PointerTo("Maximum CPU time of the plugin process, rounded up to seconds."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+		"openFiles": schema.NewPropertySchema(
+			schema.NewIntSchema(schema.IntPointer(0), nil, nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("Open files"),
+				schema.PointerTo("Maximum number of file descriptors of the plugin process."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+		"processes": schema.NewPropertySchema(
+			schema.NewIntSchema(schema.IntPointer(0), nil, nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("Processes"),
+				schema.PointerTo("Maximum number of processes of the user running the plugin, "+
+					"including the processes outside of the plugin."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+		"coreSize": schema.NewPropertySchema(
+			schema.NewIntSchema(schema.IntPointer(0), nil, schema.UnitBytes),
+			schema.NewDisplayValue(
+				schema.PointerTo("Core size"),
+				schema.PointerTo("Maximum size of the core dumps of the plugin process, 0 disables them."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+	},
+)
+
+var moduleSettingsSchema = schema.NewStructMappedObjectSchema[config.ModuleSettings](
+	"ModuleSettings",
+	map[string]*schema.PropertySchema{
+		"resourceLimits": schema.NewPropertySchema(
+			schema.NewRefSchema("ResourceLimits", nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("Resource limits"),
+				schema.PointerTo("Resource limits of the plugin processes of the module, "+
+					"overriding the limits of the deployer one by one."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo("{}"),
+			nil,
+		),
+		"environment": schema.NewPropertySchema(
+			schema.NewMapSchema(
+				schema.NewStringSchema(schema.IntPointer(1), nil, nil),
+				schema.NewStringSchema(nil, nil, nil),
+				nil,
+				nil,
+			),
+			schema.NewDisplayValue(
+				schema.PointerTo("Environment"),
+				schema.PointerTo("Variables set for the plugin processes of the module, "+
+					"replacing the variables of the deployer's plugin environment."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+		"secrets": schema.NewPropertySchema(
+			schema.NewMapSchema(
+				schema.NewStringSchema(schema.IntPointer(1), nil, secretNamePattern),
+				schema.NewStringSchema(schema.IntPointer(1), nil, nil),
+				nil,
+				nil,
+			),
+			schema.NewDisplayValue(
+				schema.PointerTo("Secrets"),
+				schema.PointerTo("Secrets given to the plugin processes of the module, "+
+					"in addition to the secrets of the deployer."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+		"network": schema.NewPropertySchema(
+			networkSchema,
+			schema.NewDisplayValue(
+				schema.PointerTo("Network"),
+				schema.PointerTo("Network access of the plugin processes of the module, "+
+					"replacing the network access of the deployer's plugins."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+	},
+)
+
+var networkSchema = schema.NewStringEnumSchema(map[string]*schema.DisplayValue{
+	string(config.NetworkHost): {NameValue: schema.PointerTo("Host network")},
+	string(config.NetworkNone): {NameValue: schema.PointerTo("No network")},
+})
+
+var cgroupSchema = schema.NewStructMappedObjectSchema[config.Cgroup](
+	"Cgroup",
+	map[string]*schema.PropertySchema{
+		"enabled": schema.NewPropertySchema(
+			schema.NewBoolSchema(),
+			schema.NewDisplayValue(
+				schema.PointerTo("Enabled"),
+				schema.PointerTo("Create a cgroup for every plugin. Plugins run without one, with a warning, "+
+					"when cgroup v2 delegation is unavailable."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo("false"),
+			nil,
+		),
+		"parent": schema.NewPropertySchema(
+			schema.NewStringSchema(nil, nil, nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("Parent"),
+				schema.PointerTo("Delegated cgroup holding the plugin cgroups, relative to the cgroup v2 mount "+
+					"point. It must not contain processes, and is required when cgroups are enabled."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			[]string{`"/system.slice/arcaflow.service/plugins"`},
+		),
+		"memoryMax": schema.NewPropertySchema(
+			schema.NewIntSchema(schema.IntPointer(0), nil, schema.UnitBytes),
+			schema.NewDisplayValue(
+				schema.PointerTo("Memory max"),
+				schema.PointerTo("Memory usage of a plugin above which it is OOM killed (memory.max)."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+		"cpuMax": schema.NewPropertySchema(
+			schema.NewFloatSchema(schema.PointerTo(0.01), nil, nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("CPU max"),
+				schema.PointerTo("Number of CPUs a plugin can use at most (cpu.max)."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+		"pidsMax": schema.NewPropertySchema(
+			schema.NewIntSchema(schema.IntPointer(1), nil, nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("Pids max"),
+				schema.PointerTo("Maximum number of processes of a plugin (pids.max)."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+	},
+)
+
+var pluginEnvironmentSchema = schema.NewStructMappedObjectSchema[config.PluginEnvironment](
+	"PluginEnvironment",
+	map[string]*schema.PropertySchema{
+		"inherit": schema.NewPropertySchema(
+			schema.NewListSchema(schema.NewStringSchema(schema.IntPointer(1), nil, nil), nil, nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("Inherit"),
+				schema.PointerTo("Variables passed on from the engine's environment to the plugins. "+
+					"Entries ending in * match a prefix."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo(util.JSONEncode(config.DefaultPluginEnvironmentInherit)),
+			nil,
+		),
+		"variables": schema.NewPropertySchema(
+			schema.NewMapSchema(
+				schema.NewStringSchema(schema.IntPointer(1), nil, nil),
+				schema.NewStringSchema(nil, nil, nil),
+				nil,
+				nil,
+			),
+			schema.NewDisplayValue(
+				schema.PointerTo("Variables"),
+				schema.PointerTo("Variables set explicitly for the plugin processes."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+	},
+)
+
+var sandboxSchema = schema.NewStructMappedObjectSchema[config.Sandbox](
+	"Sandbox",
+	map[string]*schema.PropertySchema{
+		"enabled": schema.NewPropertySchema(
+			schema.NewBoolSchema(),
+			schema.NewDisplayValue(
+				schema.PointerTo("Enabled"),
+				schema.PointerTo("Run every plugin in new user, mount, PID and IPC namespaces, where it only "+
+					"sees the system directories, its interpreter and venv read-only, and its plugin directory "+
+					"and a private /tmp writable. Requires unprivileged user namespaces."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo("false"),
+			nil,
+		),
+		"privateNetwork": schema.NewPropertySchema(
+			schema.NewBoolSchema(),
+			schema.NewDisplayValue(
+				schema.PointerTo("Private network"),
+				schema.PointerTo("Also run sandboxed plugins in a new network namespace, with nothing but loopback."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo("false"),
+			nil,
+		),
+		"landlock": schema.NewPropertySchema(
+			schema.NewRefSchema("Landlock", nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("Landlock"),
+				schema.PointerTo("Landlock filesystem restrictions of the plugin processes, "+
+					"which work with or without namespaces."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo("{}"),
+			nil,
+		),
+		"seccomp": schema.NewPropertySchema(
+			schema.NewRefSchema("Seccomp", nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("Seccomp"),
+				schema.PointerTo("Seccomp system call filter of the plugin processes, "+
+					"which works with or without namespaces."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo("{}"),
+			nil,
+		),
+	},
 )
+
+var landlockSchema = schema.NewStructMappedObjectSchema[config.Landlock](
+	"Landlock",
+	map[string]*schema.PropertySchema{
+		"enabled": schema.NewPropertySchema(
+			schema.NewBoolSchema(),
+			schema.NewDisplayValue(
+				schema.PointerTo("Enabled"),
+				schema.PointerTo("Only let plugins read the system directories, their interpreter and venv, and "+
+					"write to their plugin directory, using Landlock."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo("false"),
+			nil,
+		),
+		"required": schema.NewPropertySchema(
+			schema.NewBoolSchema(),
+			schema.NewDisplayValue(
+				schema.PointerTo("Required"),
+				schema.PointerTo("Fail deploying plugins on kernels without Landlock, instead of running them "+
+					"without filesystem restrictions and logging a warning."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo("false"),
+			nil,
+		),
+	},
+)
+
+var seccompSchema = schema.NewStructMappedObjectSchema[config.Seccomp](
+	"Seccomp",
+	map[string]*schema.PropertySchema{
+		"enabled": schema.NewPropertySchema(
+			schema.NewBoolSchema(),
+			schema.NewDisplayValue(
+				schema.PointerTo("Enabled"),
+				schema.PointerTo("Filter the system calls of plugins with a seccomp profile. A plugin making a "+
+					"blocked system call is killed, and the system call is reported in its exit error."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo("false"),
+			nil,
+		),
+		"profile": schema.NewPropertySchema(
+			schema.NewStringSchema(nil, nil, nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("Profile"),
+				schema.PointerTo("Path of a seccomp profile in the JSON format of Docker and OCI runtimes. When "+
+					"empty, the default profile allows what CPython needs, and blocks system calls like ptrace, "+
+					"mount, bpf or kernel module loading."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+	},
+)
+
+var pluginUserSchema = schema.NewStructMappedObjectSchema[config.PluginUser](
+	"PluginUser",
+	map[string]*schema.PropertySchema{
+		"uid": schema.NewPropertySchema(
+			schema.NewIntSchema(schema.IntPointer(0), nil, nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("UID"),
+				schema.PointerTo("User ID of the plugin processes. Switching to it needs the engine to have the "+
+					"CAP_SETUID, CAP_SETGID, CAP_CHOWN, CAP_DAC_OVERRIDE and CAP_FOWNER capabilities, like root."),
+				nil,
+			),
+			false,
+			[]string{"gid"},
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+		"gid": schema.NewPropertySchema(
+			schema.NewIntSchema(schema.IntPointer(0), nil, nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("GID"),
+				schema.PointerTo("Primary group ID of the plugin processes."),
+				nil,
+			),
+			false,
+			[]string{"uid"},
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+		"groups": schema.NewPropertySchema(
+			schema.NewListSchema(schema.NewIntSchema(schema.IntPointer(0), nil, nil), nil, nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("Groups"),
+				schema.PointerTo("Supplementary group IDs of the plugin processes, which have none otherwise."),
+				nil,
+			),
+			false,
+			[]string{"uid"},
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+	},
+)
+
+var auditHookSchema = schema.NewStructMappedObjectSchema[config.AuditHook](
+	"AuditHook",
+	map[string]*schema.PropertySchema{
+		"enabled": schema.NewPropertySchema(
+			schema.NewBoolSchema(),
+			schema.NewDisplayValue(
+				schema.PointerTo("Enabled"),
+				schema.PointerTo("Install an audit hook in the python interpreters of every plugin, reporting "+
+					"their audited events to the deployer. Audit hooks are no security boundary."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo("false"),
+			nil,
+		),
+		"events": schema.NewPropertySchema(
+			schema.NewRefSchema("AuditEvents", nil),
+			schema.NewDisplayValue(
+				schema.PointerTo("Events"),
+				schema.PointerTo("Action taken on every category of audited events. The categories left unset "+
+					"are not audited, and every category is logged when none is set."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo("{}"),
+			[]string{`{"subprocess.Popen": "block", "os.system": "block", "socket.connect": "log"}`},
+		),
+		"report": schema.NewPropertySchema(
+			schema.NewBoolSchema(),
+			schema.NewDisplayValue(
+				schema.PointerTo("Report"),
+				schema.PointerTo("Write the audited events of every plugin to the audit-report.json file of "+
+					"its plugin directory once it exits."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			schema.PointerTo("false"),
+			nil,
+		),
+	},
+)
+
+var auditEventsSchema = schema.NewStructMappedObjectSchema[config.AuditEvents](
+	"AuditEvents",
+	map[string]*schema.PropertySchema{
+		"subprocess.Popen": schema.NewPropertySchema(
+			auditActionSchema,
+			schema.NewDisplayValue(
+				schema.PointerTo("Subprocesses"),
+				schema.PointerTo("Subprocesses started with subprocess, os.exec*, os.posix_spawn* or os.spawn*."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+		"os.system": schema.NewPropertySchema(
+			auditActionSchema,
+			schema.NewDisplayValue(
+				schema.PointerTo("Shell commands"),
+				schema.PointerTo("Shell commands run with os.system."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+		"socket.connect": schema.NewPropertySchema(
+			auditActionSchema,
+			schema.NewDisplayValue(
+				schema.PointerTo("Connections"),
+				schema.PointerTo("Connections of sockets."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+		"open": schema.NewPropertySchema(
+			auditActionSchema,
+			schema.NewDisplayValue(
+				schema.PointerTo("File opens"),
+				schema.PointerTo("Files opened outside of the plugin directory, except for reading the interpreter, "+
+					"the venv and the secrets."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
+	},
+)
+
+var auditActionSchema = schema.NewStringEnumSchema(map[string]*schema.DisplayValue{
+	string(config.AuditActionLog):   {NameValue: schema.PointerTo("Log")},
+	string(config.AuditActionBlock): {NameValue: schema.PointerTo("Block")},
+})